@@ -8,3 +8,8 @@ type Registry interface {
 	RecordDuration(string, prometheus.Labels, float64)
 	PrometheusRegistry() *prometheus.Registry
 }
+
+// GaugeRegistry defines the interface for setting gauges.
+type GaugeRegistry interface {
+	SetGauge(string, prometheus.Labels, float64)
+}
@@ -17,6 +17,7 @@ type registry struct {
 	metricsMu  sync.Mutex
 	counters   map[string]*prometheus.CounterVec
 	histograms map[string]*prometheus.HistogramVec
+	gauges     map[string]*prometheus.GaugeVec
 }
 
 // NewRegistry creates a new metrics registry with the specified subsystem and namespace.
@@ -27,6 +28,7 @@ func NewRegistry(subsystem, namespace string) Registry {
 		PromRegistry: prometheus.NewRegistry(),
 		counters:     make(map[string]*prometheus.CounterVec),
 		histograms:   make(map[string]*prometheus.HistogramVec),
+		gauges:       make(map[string]*prometheus.GaugeVec),
 	}
 
 	registerMetrics(r)
@@ -77,6 +79,25 @@ func (r *registry) RecordDuration(name string, labels prometheus.Labels, duratio
 	histogram.With(labels).Observe(duration)
 }
 
+// SetGauge sets a gauge for the given Series, dynamically determining label names from the input labels.
+func (r *registry) SetGauge(name string, labels prometheus.Labels, value float64) {
+	r.metricsMu.Lock()
+	defer r.metricsMu.Unlock()
+
+	sanitized := r.sanitizeMetricName(name)
+	gauge, exists := r.gauges[sanitized]
+	if !exists {
+		gauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Subsystem: r.Subsystem,
+			Namespace: r.Namespace,
+			Name:      sanitized,
+		}, getLabelNames(labels))
+		r.PromRegistry.MustRegister(gauge)
+		r.gauges[sanitized] = gauge
+	}
+	gauge.With(labels).Set(value)
+}
+
 // PrometheusRegistry returns the underlying Prometheus registry.
 func (r *registry) PrometheusRegistry() *prometheus.Registry {
 	return r.PromRegistry
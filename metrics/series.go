@@ -98,6 +98,7 @@ const (
 	seriesTypeSuccess  = "success"
 	seriesTypeError    = "error"
 	seriesTypeDuration = "duration"
+	seriesTypeGauge    = "gauge"
 )
 
 // Info returns the metric name and labels for an informational event.
@@ -149,6 +150,19 @@ func (s Series) Duration(d time.Duration, msg string) (string, prometheus.Labels
 	return "operation_duration_seconds", mergeLabels(labels, s.labels), d.Seconds()
 }
 
+// Gauge returns the metric name and labels for setting a current value, where msg carries any additional information
+func (s Series) Gauge(value float64, msg string) (string, prometheus.Labels, float64) {
+	labels := prometheus.Labels{
+		"series_type": s.seriesType.String(),
+		"sub_type":    s.subType,
+		"operation":   s.operation,
+		"status":      seriesTypeGauge,
+		"message":     msg,
+	}
+
+	return "operation_value", mergeLabels(labels, s.labels), value
+}
+
 // appendOperation appends the operation to the Series operation string.
 func (s Series) appendOperation(operation string) string {
 	return s.operation + "_" + operation
@@ -20,11 +20,19 @@ type Server interface {
 	Stop(ctx context.Context)
 }
 
+// Mounter defines the interface for serving extra handlers next to the metrics.
+type Mounter interface {
+	Handle(pattern string, handler http.Handler)
+}
+
+var _ Mounter = (*server)(nil)
+
 type server struct {
 	logger      clog.CLog
 	registry    Registry
 	healthCheck *HealthChecker
 	srv         *http.Server
+	handlers    map[string]http.Handler
 }
 
 func NewServer(logger clog.CLog, registry Registry, healthCheck *HealthChecker) *server {
@@ -32,9 +40,16 @@ func NewServer(logger clog.CLog, registry Registry, healthCheck *HealthChecker)
 		logger:      logger,
 		registry:    registry,
 		healthCheck: healthCheck,
+		handlers:    make(map[string]http.Handler),
 	}
 }
 
+// Handle mounts an extra handler, e.g. the queue admin API, next to the metrics and health endpoints.
+// It must be called before Start.
+func (s *server) Handle(pattern string, handler http.Handler) {
+	s.handlers[pattern] = handler
+}
+
 func (s *server) start(ctx context.Context, address string) {
 	mux := http.NewServeMux()
 
@@ -42,6 +57,10 @@ func (s *server) start(ctx context.Context, address string) {
 	mux.HandleFunc(livenessEndpoint, s.healthCheck.LivenessHandler)
 	mux.HandleFunc(readinessEndpoint, s.healthCheck.ReadinessHandler)
 
+	for pattern, handler := range s.handlers {
+		mux.Handle(pattern, handler)
+	}
+
 	ctx = s.logger.AddKeysValuesToCtx(ctx, map[string]interface{}{
 		"metrics_address": address,
 	})
@@ -18,6 +18,9 @@ func (s *registryStub) Inc(_ string, _ prometheus.Labels) {}
 // RecordDuration is a no-op method for recording durations in the stub registry.
 func (s *registryStub) RecordDuration(_ string, _ prometheus.Labels, _ float64) {}
 
+// SetGauge is a no-op method for setting gauges in the stub registry.
+func (s *registryStub) SetGauge(_ string, _ prometheus.Labels, _ float64) {}
+
 // PrometheusRegistry returns nil for the stub registry.
 func (s *registryStub) PrometheusRegistry() *prometheus.Registry {
 	return nil
@@ -0,0 +1,467 @@
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultAdminPrefix   = "/queue"
+	defaultAdminPageSize = 100
+	maxAdminPageSize     = 1000
+)
+
+var (
+	// ErrAdminReadOnly is returned by the admin API for changes while AdminOptions.Writable is off.
+	ErrAdminReadOnly = errors.New("queue admin API is read-only")
+	// ErrAdminUnauthorized is returned by the admin API for every request while AdminOptions.Authorizer is nil.
+	ErrAdminUnauthorized = errors.New("queue admin API has no authorizer")
+)
+
+// AdminAction is the kind of access an admin request needs.
+type AdminAction string
+
+const (
+	AdminRead        AdminAction = "read"         // AdminRead lists topics, stats and events.
+	AdminReadPayload AdminAction = "read_payload" // AdminReadPayload reads the data and headers of events.
+	AdminWrite       AdminAction = "write"        // AdminWrite replays and discards events.
+)
+
+// Authorizer decides whether an admin request may perform the action, an error rejects it with 403 Forbidden.
+type Authorizer func(r *http.Request, action AdminAction) error
+
+// AllowAll is the Authorizer allowing every request, for an admin API only reachable by trusted callers.
+func AllowAll(_ *http.Request, _ AdminAction) error {
+	return nil
+}
+
+// AdminOptions configures the admin API, see EventBus.AdminHandler.
+type AdminOptions struct {
+	Prefix     string     // Prefix is the path the routes are served under, "/queue" when empty.
+	Writable   bool       // Writable enables replaying and discarding events, the API is read-only otherwise.
+	Authorizer Authorizer // Authorizer checks every request, all requests are denied when nil, see AllowAll.
+}
+
+// AdminHandler returns the admin API of the bus, to be mounted under the prefix of the options,
+// e.g. mux.Handle("/queue/", bus.AdminHandler(opts)). Responses are JSON. Routes:
+//
+//	GET    <prefix>/topics                     topics with their subscribers and in-memory load
+//	GET    <prefix>/stats                      pending, failed and dead counts per topic, with the oldest age
+//	GET    <prefix>/events                     events by topic, subscriber and status, paged with after_id and limit
+//	GET    <prefix>/events/{id}                a single event
+//	POST   <prefix>/events/{id}/replay         replays a dead-lettered event
+//	DELETE <prefix>/events/{id}                discards an event
+//	POST   <prefix>/dead-letters/replay        replays dead-lettered events by topic, subscriber, from and to
+//	DELETE <prefix>/dead-letters               discards dead-lettered events by topic, subscriber, from and to
+//
+// The bulk dead letter routes need the topic, or all=true to act on every topic. All routes but topics need the outbox.
+// Events are served without their data and headers unless payload=true is asked for, which needs AdminReadPayload.
+func (bus *eventBus) AdminHandler(opts AdminOptions) http.Handler {
+	if opts.Prefix == "" {
+		opts.Prefix = defaultAdminPrefix
+	}
+
+	a := &admin{bus: bus, opts: opts}
+	p := opts.Prefix
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+p+"/topics", a.handle(AdminRead, a.topics))
+	mux.HandleFunc("GET "+p+"/stats", a.handle(AdminRead, a.stats))
+	mux.HandleFunc("GET "+p+"/events", a.handle(AdminRead, a.events))
+	mux.HandleFunc("GET "+p+"/events/{id}", a.handle(AdminRead, a.event))
+	mux.HandleFunc("POST "+p+"/events/{id}/replay", a.handle(AdminWrite, a.replay))
+	mux.HandleFunc("DELETE "+p+"/events/{id}", a.handle(AdminWrite, a.discard))
+	mux.HandleFunc("POST "+p+"/dead-letters/replay", a.handle(AdminWrite, a.replayDead))
+	mux.HandleFunc("DELETE "+p+"/dead-letters", a.handle(AdminWrite, a.purgeDead))
+
+	return mux
+}
+
+// admin serves the admin API of a bus.
+type admin struct {
+	bus  *eventBus
+	opts AdminOptions
+}
+
+// errBadRequest marks errors caused by invalid request parameters.
+var errBadRequest = errors.New("bad request")
+
+// adminTopic describes a topic of the bus.
+type adminTopic struct {
+	Topic       string   `json:"topic"`
+	Subscribers []string `json:"subscribers"`
+	InFlight    int      `json:"in_flight"`
+	Queued      int      `json:"queued"`
+	Paused      bool     `json:"paused"`
+}
+
+// adminStats counts the events of a topic not acknowledged yet.
+type adminStats struct {
+	Topic            string  `json:"topic"`
+	Pending          int     `json:"pending"`
+	Failed           int     `json:"failed"`
+	Dead             int     `json:"dead"`
+	OldestPendingAge float64 `json:"oldest_pending_age_seconds"`
+}
+
+// adminEvent is an outbox event as served by the admin API.
+type adminEvent struct {
+	ID          int               `json:"id"`
+	Topic       string            `json:"topic"`
+	Subscriber  string            `json:"subscriber"`
+	Status      AckStatus         `json:"status"`
+	Retry       int               `json:"retry"`
+	LastError   string            `json:"last_error,omitempty"`
+	OrderingKey string            `json:"ordering_key,omitempty"`
+	DedupKey    string            `json:"dedup_key,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Data        []byte            `json:"data,omitempty"`
+	CreatedAt   time.Time         `json:"created_at"`
+	AvailableAt *time.Time        `json:"available_at,omitempty"`
+	FailedAt    *time.Time        `json:"failed_at,omitempty"`
+}
+
+// adminEventPage is a page of events, NextAfterID is set when more events may follow.
+type adminEventPage struct {
+	Events      []*adminEvent `json:"events"`
+	NextAfterID int           `json:"next_after_id,omitempty"`
+}
+
+// adminCount reports the number of events affected by a change.
+type adminCount struct {
+	Count int `json:"count"`
+}
+
+// adminError is the body of error responses.
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// handle wraps an admin route with the authorization and the encoding of its result.
+func (a *admin) handle(action AdminAction, route func(r *http.Request) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if action == AdminWrite && !a.opts.Writable {
+			a.write(w, r, http.StatusForbidden, adminError{Error: ErrAdminReadOnly.Error()})
+			return
+		}
+
+		if err := a.authorize(r, action); err != nil {
+			a.write(w, r, http.StatusForbidden, adminError{Error: err.Error()})
+			return
+		}
+		if payload(r) {
+			if err := a.authorize(r, AdminReadPayload); err != nil {
+				a.write(w, r, http.StatusForbidden, adminError{Error: err.Error()})
+				return
+			}
+		}
+
+		result, err := route(r)
+		switch {
+		case err == nil:
+			a.write(w, r, http.StatusOK, result)
+		case errors.Is(err, errBadRequest):
+			a.write(w, r, http.StatusBadRequest, adminError{Error: err.Error()})
+		case errors.Is(err, ErrEventNotFound):
+			a.write(w, r, http.StatusNotFound, adminError{Error: err.Error()})
+		case errors.Is(err, ErrOutboxNotConfigured):
+			a.write(w, r, http.StatusNotImplemented, adminError{Error: err.Error()})
+		default:
+			a.bus.log.ErrorCtx(r.Context(), err, "Queue admin request failed")
+			a.write(w, r, http.StatusInternalServerError, adminError{Error: http.StatusText(http.StatusInternalServerError)})
+		}
+	}
+}
+
+// authorize checks the action with the authorizer, denying everything without one.
+func (a *admin) authorize(r *http.Request, action AdminAction) error {
+	if a.opts.Authorizer == nil {
+		return ErrAdminUnauthorized
+	}
+	return a.opts.Authorizer(r, action)
+}
+
+// write encodes the body as the JSON response.
+func (a *admin) write(w http.ResponseWriter, r *http.Request, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		a.bus.log.ErrorCtx(r.Context(), err, "Failed to write queue admin response")
+	}
+}
+
+func (a *admin) topics(_ *http.Request) (any, error) {
+	subscribers := make(map[string][]string)
+
+	a.bus.lock.RLock()
+	for topic, subs := range a.bus.handlers {
+		for _, sub := range subs {
+			subscribers[topic] = append(subscribers[topic], sub.name)
+		}
+	}
+	a.bus.lock.RUnlock()
+
+	stats := a.bus.PoolStats().Topics
+	for topic := range stats {
+		if _, ok := subscribers[topic]; !ok {
+			subscribers[topic] = []string{}
+		}
+	}
+
+	topics := make([]*adminTopic, 0, len(subscribers))
+	for _, topic := range slices.Sorted(maps.Keys(subscribers)) {
+		topics = append(topics, &adminTopic{
+			Topic:       topic,
+			Subscribers: subscribers[topic],
+			InFlight:    stats[topic].InFlight,
+			Queued:      stats[topic].Queued,
+			Paused:      a.bus.Paused(topic),
+		})
+	}
+
+	return topics, nil
+}
+
+func (a *admin) stats(r *http.Request) (any, error) {
+	if a.bus.outbox == nil {
+		return nil, ErrOutboxNotConfigured
+	}
+
+	stats, err := a.bus.outbox.EventStats(r.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*adminStats, 0, len(stats))
+	for _, s := range stats {
+		age := 0.0
+		if s.OldestPending > 0 {
+			age = max(time.Since(time.Unix(s.OldestPending, 0)).Seconds(), 0)
+		}
+
+		result = append(result, &adminStats{
+			Topic:            s.Topic,
+			Pending:          s.Pending,
+			Failed:           s.Failed,
+			Dead:             s.Dead,
+			OldestPendingAge: age,
+		})
+	}
+
+	return result, nil
+}
+
+func (a *admin) events(r *http.Request) (any, error) {
+	if a.bus.outbox == nil {
+		return nil, ErrOutboxNotConfigured
+	}
+
+	query := r.URL.Query()
+	filter := EventFilter{
+		Topic:      query.Get("topic"),
+		Subscriber: query.Get("subscriber"),
+		Status:     AckStatus(query.Get("status")),
+		Limit:      defaultAdminPageSize,
+	}
+
+	var err error
+	if filter.AfterID, err = queryInt(query.Get("after_id"), 0); err != nil {
+		return nil, err
+	}
+	if filter.Limit, err = queryInt(query.Get("limit"), defaultAdminPageSize); err != nil {
+		return nil, err
+	}
+	filter.Limit = min(max(filter.Limit, 1), maxAdminPageSize)
+
+	events, err := a.bus.outbox.ListEvents(r.Context(), filter)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &adminEventPage{Events: make([]*adminEvent, 0, len(events))}
+	for _, event := range events {
+		page.Events = append(page.Events, toAdminEvent(event, payload(r)))
+	}
+	if len(events) == filter.Limit {
+		page.NextAfterID = events[len(events)-1].ID
+	}
+
+	return page, nil
+}
+
+func (a *admin) event(r *http.Request) (any, error) {
+	if a.bus.outbox == nil {
+		return nil, ErrOutboxNotConfigured
+	}
+
+	id, err := eventID(r)
+	if err != nil {
+		return nil, err
+	}
+
+	event, err := a.bus.outbox.GetEvent(r.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+
+	return toAdminEvent(event, payload(r)), nil
+}
+
+func (a *admin) replay(r *http.Request) (any, error) {
+	id, err := eventID(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = a.bus.ReplayDeadLetter(r.Context(), id); err != nil {
+		return nil, err
+	}
+
+	return adminCount{Count: 1}, nil
+}
+
+func (a *admin) discard(r *http.Request) (any, error) {
+	if a.bus.outbox == nil {
+		return nil, ErrOutboxNotConfigured
+	}
+
+	id, err := eventID(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = a.bus.outbox.DeleteEvent(r.Context(), id); err != nil {
+		return nil, err
+	}
+
+	return adminCount{Count: 1}, nil
+}
+
+func (a *admin) replayDead(r *http.Request) (any, error) {
+	filter, err := bulkDeadLetterFilter(r)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := a.bus.ReplayDeadLetters(r.Context(), filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return adminCount{Count: count}, nil
+}
+
+func (a *admin) purgeDead(r *http.Request) (any, error) {
+	filter, err := bulkDeadLetterFilter(r)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := a.bus.PurgeDeadLetters(r.Context(), filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return adminCount{Count: count}, nil
+}
+
+// toAdminEvent converts an outbox event for the admin API, its data and headers are only kept with payload.
+func toAdminEvent(event *OutboxEvent, payload bool) *adminEvent {
+	result := &adminEvent{
+		ID:          event.ID,
+		Topic:       event.Topic,
+		Subscriber:  event.Subscriber,
+		Status:      event.AckStatus,
+		Retry:       event.Retry,
+		LastError:   event.LastError,
+		OrderingKey: event.OrderingKey,
+		DedupKey:    event.DedupKey,
+		CreatedAt:   time.Unix(event.CreatedAt, 0),
+	}
+	if payload {
+		result.Headers = event.Headers
+		result.Data = event.Data
+	}
+	if event.AvailableAt > 0 {
+		availableAt := fromUnixMilli(event.AvailableAt)
+		result.AvailableAt = &availableAt
+	}
+	if event.FailedAt > 0 {
+		failedAt := time.Unix(event.FailedAt, 0)
+		result.FailedAt = &failedAt
+	}
+
+	return result
+}
+
+// payload reports whether the request asks for the data and headers of events.
+func payload(r *http.Request) bool {
+	return r.URL.Query().Get("payload") == "true"
+}
+
+// eventID parses the event ID of the request path.
+func eventID(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("%w: invalid event id %q", errBadRequest, r.PathValue("id"))
+	}
+	return id, nil
+}
+
+// deadLetterFilter parses the dead letter filter of the request query, times are RFC 3339.
+func deadLetterFilter(r *http.Request) (DeadLetterFilter, error) {
+	query := r.URL.Query()
+	filter := DeadLetterFilter{
+		Topic:      query.Get("topic"),
+		Subscriber: query.Get("subscriber"),
+	}
+
+	for name, bound := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, fmt.Errorf("%w: invalid %s %q", errBadRequest, name, value)
+		}
+		*bound = t
+	}
+
+	return filter, nil
+}
+
+// bulkDeadLetterFilter parses the dead letter filter of a bulk change, which must name the topic
+// or explicitly ask for all topics with all=true, so a bare request never affects every dead letter.
+func bulkDeadLetterFilter(r *http.Request) (DeadLetterFilter, error) {
+	filter, err := deadLetterFilter(r)
+	if err != nil {
+		return filter, err
+	}
+
+	if filter.Topic == "" && r.URL.Query().Get("all") != "true" {
+		return filter, fmt.Errorf("%w: topic or all=true is required", errBadRequest)
+	}
+	return filter, nil
+}
+
+// queryInt parses an integer query parameter, def is returned when it is empty.
+func queryInt(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid number %q", errBadRequest, value)
+	}
+	return n, nil
+}
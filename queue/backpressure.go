@@ -0,0 +1,119 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrQueueFull is returned when an event is rejected because the queue of the bus or of its topic is full.
+var ErrQueueFull = errors.New("event queue is full")
+
+// BackpressurePolicy decides what publishing does when the queue of the bus or of the topic is full.
+// The queue of a topic holds as many events waiting for a worker as the queue of the bus.
+type BackpressurePolicy string
+
+const (
+	// BackpressureBlock waits for room in the queue until the publishing ctx is done, ErrQueueFull is returned then.
+	BackpressureBlock BackpressurePolicy = "block"
+	// BackpressureFailFast rejects the event with ErrQueueFull right away. Events persisted to the outbox
+	// before the queue filled up are kept there, they are handled once loaded or claimed from the outbox.
+	BackpressureFailFast BackpressurePolicy = "fail_fast"
+	// BackpressurePersist only saves the event to the outbox, it is handled once claimed by the relay,
+	// or loaded on the next start without it. It requires WithOutbox.
+	BackpressurePersist BackpressurePolicy = "persist"
+)
+
+// WithBackpressure sets the policy applied when the queue is full, BackpressureBlock by default.
+// PublishOptions.Backpressure overrides it per event.
+func (bus *eventBus) WithBackpressure(policy BackpressurePolicy) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	bus.backpressure = policy
+}
+
+// backpressurePolicy returns the policy applying to an event published with the options.
+func (bus *eventBus) backpressurePolicy(opt PublishOptions) BackpressurePolicy {
+	if opt.Backpressure != "" {
+		return opt.Backpressure
+	}
+
+	bus.lock.RLock()
+	defer bus.lock.RUnlock()
+
+	if bus.backpressure == "" {
+		return BackpressureBlock
+	}
+	return bus.backpressure
+}
+
+// full reports whether the queue or the lane of the topic has no room left.
+func (bus *eventBus) full(topic string) bool {
+	return len(bus.queue) >= cap(bus.queue) || bus.laneFull(topic) != nil
+}
+
+// laneFull returns a channel closed once the lane of the topic has room, nil when it has room already.
+func (bus *eventBus) laneFull(topic string) <-chan struct{} {
+	bus.lock.RLock()
+	pool := bus.pool
+	bus.lock.RUnlock()
+
+	if pool == nil {
+		return nil
+	}
+	if l := pool.existing(topic); l != nil {
+		return l.full()
+	}
+	return nil
+}
+
+// dispatch puts a published event in the queue applying the policy. An event fitting in the queue and in the lane
+// of its topic is always accepted, ctx only bounds the wait for room, so a done ctx does not reject events while
+// there is room.
+func (bus *eventBus) dispatch(ctx context.Context, event *Event, policy BackpressurePolicy) error {
+	for {
+		select {
+		case <-bus.drain:
+			return ErrBusClosed
+		default:
+		}
+
+		room := bus.laneFull(event.Topic)
+		if room == nil {
+			bus.inflight.Add(1)
+			select {
+			case bus.queue <- event:
+				return nil
+			default:
+				bus.inflight.Add(-1)
+			}
+		}
+
+		if policy == BackpressureFailFast {
+			return ErrQueueFull
+		}
+
+		if room == nil {
+			bus.inflight.Add(1)
+			select {
+			case bus.queue <- event:
+				return nil
+			case <-bus.drain:
+				bus.inflight.Add(-1)
+				return ErrBusClosed
+			case <-ctx.Done():
+				bus.inflight.Add(-1)
+				return fmt.Errorf("%w: %w", ErrQueueFull, ctx.Err())
+			}
+		}
+
+		select {
+		case <-room:
+		case <-bus.drain:
+			return ErrBusClosed
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %w", ErrQueueFull, ctx.Err())
+		}
+	}
+}
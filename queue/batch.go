@@ -0,0 +1,234 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultBatchMaxSize = 100
+	defaultBatchMaxWait = time.Second
+)
+
+// BatchHandler handles a batch of events of a topic at once, see SubscribeBatch.
+type BatchHandler func(ctx context.Context, events []*Event) BatchResult
+
+// BatchResult holds the outcome of the events of a batch, events missing from it are NACKed.
+// Errors are recorded per event with Event.SetError.
+type BatchResult map[*Event]AckStatus
+
+// BatchStatus returns a result giving the same status to all the events.
+func BatchStatus(events []*Event, status AckStatus) BatchResult {
+	result := make(BatchResult, len(events))
+	for _, event := range events {
+		result[event] = status
+	}
+	return result
+}
+
+// BatchOptions configures the accumulation of events of a batch subscription.
+type BatchOptions struct {
+	MaxSize int           // MaxSize is the number of events handing the batch over right away, 100 when zero.
+	MaxWait time.Duration // MaxWait is how long the first event of a batch waits for the others, 1s when zero.
+}
+
+// batcher accumulates the deliveries of a batch subscription.
+type batcher struct {
+	opts    BatchOptions
+	handler BatchHandler
+	waiting *atomic.Int64 // waiting counts the worker of the batch being filled as waiting for time to pass, see Idle.
+	lock    sync.Mutex
+	current *pendingBatch
+}
+
+// pendingBatch is a batch being filled, ready is closed once it is full.
+type pendingBatch struct {
+	events []*Event
+	ready  chan struct{}
+}
+
+func newBatcher(handler BatchHandler, opts BatchOptions, waiting *atomic.Int64) *batcher {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = defaultBatchMaxSize
+	}
+	if opts.MaxWait <= 0 {
+		opts.MaxWait = defaultBatchMaxWait
+	}
+
+	return &batcher{opts: opts, handler: handler, waiting: waiting}
+}
+
+// add appends the event to the batch being filled. The batch is returned to the caller that started it,
+// who hands it over to the handler. The caller waits for the batch until it is full or taken.
+func (b *batcher) add(event *Event) *pendingBatch {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	var started *pendingBatch
+	if b.current == nil {
+		b.current = &pendingBatch{ready: make(chan struct{})}
+		started = b.current
+		b.waiting.Add(1)
+	}
+
+	batch := b.current
+	batch.events = append(batch.events, event)
+	if len(batch.events) >= b.opts.MaxSize {
+		close(batch.ready)
+		b.current = nil
+		b.waiting.Add(-1)
+	}
+
+	return started
+}
+
+// take stops filling the batch and returns its events.
+func (b *batcher) take(batch *pendingBatch) []*Event {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.current == batch {
+		b.current = nil
+		b.waiting.Add(-1)
+	}
+	return batch.events
+}
+
+// SubscribeBatch subscribes a handler receiving the events of the topic in batches. See Subscribe.
+//
+// Deliveries are accumulated until MaxSize events are waiting or the first of them waited for MaxWait, a worker of
+// the topic waits along with the batch, so the topic needs more than one worker, see SubscribeOptions.Concurrency.
+// The outcome of every event is applied as in Subscribe, with a single outbox update per status.
+// Middlewares and SubscribeOptions.Timeout do not apply to batch handlers.
+func (bus *eventBus) SubscribeBatch(
+	topic string,
+	handler BatchHandler,
+	batch BatchOptions,
+	delays []int,
+	durationType time.Duration,
+	opts ...SubscribeOptions,
+) {
+	bus.subscribe(topic, nil, newBatcher(handler, batch, &bus.waiting), delays, durationType, opts...)
+}
+
+// batchEvent adds the delivery to the batch of its subscription. The caller starting a batch waits for it
+// to fill up and handles it, the others return right away.
+func (bus *eventBus) batchEvent(ctx context.Context, sub *subscription, event *Event) {
+	batch := sub.batch.add(event)
+	if batch == nil {
+		return
+	}
+
+	timer := bus.clockOf().NewTimer(sub.batch.opts.MaxWait)
+	defer timer.Stop()
+
+	// the worker holds its slot while the batch fills up, it waits for time to pass until the batch is full or taken
+	select {
+	case <-batch.ready:
+	case <-timer.C():
+	case <-bus.drain:
+	case <-ctx.Done():
+		sub.batch.take(batch)
+		return
+	}
+
+	bus.handleBatch(ctx, sub, sub.batch.take(batch))
+}
+
+// handleBatch calls the batch handler and applies the outcome of every event.
+func (bus *eventBus) handleBatch(ctx context.Context, sub *subscription, events []*Event) {
+	ctx, span := bus.startSpan(ctx, "process "+events[0].Topic)
+	span.SetAttributeString(SpanAttrTopic, events[0].Topic)
+	span.SetAttributeString(SpanAttrSubscriber, sub.name)
+	span.SetAttributeInt(SpanAttrBatchSize, len(events))
+
+	started := time.Now()
+	result := bus.callBatchHandler(ctx, sub, events)
+	took := time.Since(started)
+
+	var acked, retried, dead []*Event
+	for _, event := range events {
+		handled, ok := result[event]
+		if !ok || handled == "" {
+			handled = NACK
+		}
+
+		status := handled
+		if status == NACK {
+			delay, retry := nextRetry(sub.policy, event)
+			if retry {
+				event.Retry++
+				event.NextRetry = delay
+				event.AvailableAt = bus.now().Add(delay)
+			} else {
+				status = DEAD
+			}
+		}
+		bus.recordHandled(event, handled, status, took)
+		bus.recordOutcome(ctx, event, handled)
+
+		switch status {
+		case ACK:
+			event.AckStatus = ACK
+			acked = append(acked, event)
+		case NACK:
+			retried = append(retried, event)
+		default:
+			event.AckStatus = DEAD
+			dead = append(dead, event)
+		}
+	}
+
+	switch {
+	case len(acked) == len(events):
+		endConsumerSpan(span, ACK, "")
+	default:
+		endConsumerSpan(span, NACK, fmt.Sprintf("%d of %d events not acknowledged", len(events)-len(acked), len(events)))
+	}
+
+	bus.log.DebugCtx(ctx, "Batch of %d events handled: %d acknowledged, %d retried, %d dead-lettered",
+		len(events), len(acked), len(retried), len(dead))
+
+	if bus.outbox != nil {
+		bus.markEventsAsProcessed(ctx, acked)
+		bus.updateEventStatuses(ctx, retried)
+		bus.markEventsAsDead(ctx, dead)
+	}
+
+	if bus.relay != nil {
+		for _, event := range events {
+			bus.relay.forget(event.ID)
+		}
+		bus.rescheduleEvents(ctx, retried)
+	} else {
+		for _, event := range retried {
+			bus.scheduleEvent(ctx, event)
+		}
+	}
+
+	for _, event := range append(acked, dead...) {
+		bus.release(ctx, event)
+	}
+}
+
+// callBatchHandler calls the batch handler, turning a panic into a NACK of the whole batch.
+func (bus *eventBus) callBatchHandler(ctx context.Context, sub *subscription, events []*Event) (result BatchResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := fmt.Errorf("batch handler panic: %v", r)
+			bus.log.ErrorCtx(bus.log.AddKeysValuesToCtx(ctx, map[string]interface{}{
+				"stack": string(debug.Stack()),
+			}), err, "Batch handler panicked")
+			for _, event := range events {
+				event.SetError(err)
+			}
+			result = BatchStatus(events, NACK)
+		}
+	}()
+
+	return sub.batch.handler(ctx, events)
+}
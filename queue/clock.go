@@ -0,0 +1,120 @@
+package queue
+
+import "time"
+
+// Clock tells the time to the bus and runs its timers. Tests replace it with a fake to drive delays,
+// retries and cool-downs without waiting, see Testable.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer fires once on its channel after the duration it was created with, like time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// SystemClock is the Clock of the system time.
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (SystemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{timer: time.NewTimer(d)}
+}
+
+// systemTimer adapts a time.Timer to Timer.
+type systemTimer struct {
+	timer *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t systemTimer) Stop() bool {
+	return t.timer.Stop()
+}
+
+// ticker fires every interval of a clock, like time.Ticker. A tick stays pending until next is called,
+// so the bus calls it once it handled the tick and a fake clock counts the tick as firing until then.
+type ticker struct {
+	clock    Clock
+	interval time.Duration
+	timer    Timer
+}
+
+// newTicker starts a ticker firing every interval of the clock. The interval must be positive.
+func newTicker(clock Clock, interval time.Duration) *ticker {
+	return &ticker{clock: clock, interval: interval, timer: clock.NewTimer(interval)}
+}
+
+// C returns the channel of the current tick.
+func (t *ticker) C() <-chan time.Time {
+	return t.timer.C()
+}
+
+// next stops the current tick and waits for the following one, an interval from now.
+func (t *ticker) next() {
+	t.timer.Stop()
+	t.timer = t.clock.NewTimer(t.interval)
+}
+
+// stop stops the ticker.
+func (t *ticker) stop() {
+	t.timer.Stop()
+}
+
+// WithClock replaces the system clock of the bus. It must be called before publishing or subscribing.
+// The clock drives publishing delays, retries, batch waits, rate limits, circuit breaker cool-downs,
+// the relay poll and lease intervals, the retention runs and the metrics sampling.
+func (bus *eventBus) WithClock(clock Clock) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	bus.clock = clock
+}
+
+// now returns the current time of the clock of the bus.
+func (bus *eventBus) now() time.Time {
+	return bus.clockOf().Now()
+}
+
+// clockOf returns the clock of the bus.
+func (bus *eventBus) clockOf() Clock {
+	bus.lock.RLock()
+	defer bus.lock.RUnlock()
+
+	return bus.clock
+}
+
+// Idle reports whether the bus has nothing to do right now: no event is queued, waiting for a worker or handled.
+// Events waiting for their AvailableAt moment or for a rate limit, parked by a paused topic or accumulated
+// by a batch waiting for more events do not count, they need time to pass first.
+//
+// Every event is counted at each step until the next step counts it, and the counters are read in the order
+// of the steps, so Idle never misses an event moving between goroutines. The timers of the clock are not
+// taken into account: a timer that fired is only done once stopped, see queuetest.FakeClock.
+func (bus *eventBus) Idle() bool {
+	if bus.inflight.Load() > 0 {
+		return false
+	}
+
+	bus.lock.RLock()
+	pool := bus.pool
+	bus.lock.RUnlock()
+
+	if pool == nil {
+		return true
+	}
+	if pool.queued() > 0 {
+		return false
+	}
+
+	// busy is read before waiting: a worker stops waiting before another one it waited for stops being busy
+	busy := pool.busy.Load()
+	return busy == bus.waiting.Load()
+}
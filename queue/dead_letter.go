@@ -0,0 +1,114 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrOutboxNotConfigured is returned by operations that need the outbox when WithOutbox was not called.
+var ErrOutboxNotConfigured = errors.New("outbox is not configured")
+
+// ListDeadLetters returns dead-lettered events matching the filter.
+func (bus *eventBus) ListDeadLetters(ctx context.Context, filter DeadLetterFilter) ([]*OutboxEvent, error) {
+	if bus.outbox == nil {
+		return nil, ErrOutboxNotConfigured
+	}
+
+	return bus.outbox.LoadDeadEvents(ctx, filter)
+}
+
+// GetDeadLetter returns a single dead-lettered event by its ID.
+func (bus *eventBus) GetDeadLetter(ctx context.Context, eventID int) (*OutboxEvent, error) {
+	if bus.outbox == nil {
+		return nil, ErrOutboxNotConfigured
+	}
+
+	event, err := bus.outbox.GetEvent(ctx, eventID)
+	if err != nil {
+		return nil, err
+	}
+	if event.AckStatus != DEAD {
+		return nil, ErrEventNotFound
+	}
+
+	return event, nil
+}
+
+// ReplayDeadLetter resets the retry state of a dead-lettered event and enqueues it for processing again.
+func (bus *eventBus) ReplayDeadLetter(ctx context.Context, eventID int) error {
+	if bus.outbox == nil {
+		return ErrOutboxNotConfigured
+	}
+
+	outboxEvent, err := bus.outbox.ReviveDeadEvent(ctx, eventID)
+	if err != nil {
+		return err
+	}
+
+	// in the relay mode revived events are claimed from the outbox like any other pending event
+	if bus.relay != nil {
+		return nil
+	}
+
+	event := convertOutboxEventToEvent(outboxEvent)
+	if !bus.admit(event) {
+		return nil
+	}
+
+	return bus.enqueue(ctx, event)
+}
+
+// ReplayDeadLetters resets the retry state of dead-lettered events matching the filter and enqueues them for
+// processing again. It returns the number of replayed events, also when enqueuing them fails: the events
+// not enqueued stay pending in the outbox, like the others are once replayed.
+func (bus *eventBus) ReplayDeadLetters(ctx context.Context, filter DeadLetterFilter) (int, error) {
+	if bus.outbox == nil {
+		return 0, ErrOutboxNotConfigured
+	}
+
+	events, err := bus.outbox.ReviveDeadEvents(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	if bus.relay != nil {
+		return len(events), nil
+	}
+
+	for i, outboxEvent := range events {
+		event := convertOutboxEventToEvent(outboxEvent)
+		if !bus.admit(event) {
+			continue
+		}
+
+		if err = bus.enqueue(ctx, event); err != nil {
+			return len(events), fmt.Errorf("%d of %d replayed events left pending in outbox: %w",
+				len(events)-i, len(events), err)
+		}
+	}
+
+	return len(events), nil
+}
+
+// PurgeDeadLetters deletes dead-lettered events matching the filter and returns the number of deleted events.
+func (bus *eventBus) PurgeDeadLetters(ctx context.Context, filter DeadLetterFilter) (int, error) {
+	if bus.outbox == nil {
+		return 0, ErrOutboxNotConfigured
+	}
+
+	return bus.outbox.DeleteDeadEvents(ctx, filter)
+}
+
+// enqueue pushes an event to the in-memory queue, giving up when the context is done.
+// Events that could not be enqueued stay pending in the outbox.
+func (bus *eventBus) enqueue(ctx context.Context, event *Event) error {
+	bus.inflight.Add(1)
+	select {
+	case bus.queue <- event:
+		return nil
+	case <-ctx.Done():
+		bus.inflight.Add(-1)
+		return fmt.Errorf("enqueue event %d: %w", event.ID, ctx.Err())
+	}
+}
@@ -0,0 +1,86 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gateway-fm/scriptorium/transactions"
+)
+
+// DefaultDedupWindow is how long dedup keys of published events are remembered unless WithDedupWindow is called.
+const DefaultDedupWindow = 24 * time.Hour
+
+// errNotAcknowledged rolls back the transaction of an Idempotent handler that did not acknowledge its event.
+var errNotAcknowledged = errors.New("event not acknowledged")
+
+// WithDedupWindow sets how long the dedup key of a published event is remembered, see PublishOptions.DedupKey.
+func (bus *eventBus) WithDedupWindow(window time.Duration) {
+	if window <= 0 {
+		return
+	}
+
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	bus.dedupWindow = window
+}
+
+// MarkProcessed records that the subscription of the event handled it and reports whether it is the first time.
+// The event is identified by its dedup key, or by its outbox ID when it has none.
+//
+// Called within the transaction of the handler side effects, it makes at-least-once delivery effectively-once:
+// a redelivered event finds its key already recorded and can be acknowledged right away. See Idempotent.
+func (bus *eventBus) MarkProcessed(ctx context.Context, event *Event) (bool, error) {
+	if bus.outbox == nil {
+		return false, ErrOutboxNotConfigured
+	}
+
+	return bus.outbox.MarkProcessed(ctx, &ProcessedEvent{
+		Topic:       event.Topic,
+		Subscriber:  event.Subscriber,
+		Key:         processedKey(event),
+		ProcessedAt: time.Now().Unix(),
+	})
+}
+
+// Idempotent wraps a handler so each event is handled at most once by its subscription. The handler runs
+// within a transaction of trm along with MarkProcessed, events already processed are acknowledged without
+// calling it. The transaction is rolled back unless the handler acknowledges the event, so retries find
+// the event unprocessed.
+func Idempotent(bus EventBus, trm transactions.TransactionManager, handler EventHandler) EventHandler {
+	return func(ctx context.Context, event *Event) AckStatus {
+		status := ACK
+
+		err := trm.Do(ctx, func(ctx context.Context) error {
+			first, err := bus.MarkProcessed(ctx, event)
+			if err != nil {
+				return err
+			}
+			if !first {
+				return nil
+			}
+
+			status = handler(ctx, event)
+			if status != ACK {
+				return errNotAcknowledged
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errNotAcknowledged) {
+			event.SetError(err)
+			return NACK
+		}
+
+		return status
+	}
+}
+
+// processedKey returns the key identifying the event among the events processed by its subscription.
+func processedKey(event *Event) string {
+	if event.DedupKey != "" {
+		return event.DedupKey
+	}
+	return "id:" + strconv.Itoa(event.ID)
+}
@@ -0,0 +1,63 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"runtime/debug"
+)
+
+// ErrHandlerTimeout is recorded as the error of an event whose handler exceeded SubscribeOptions.Timeout.
+var ErrHandlerTimeout = errors.New("event handler timed out")
+
+// runHandler calls the handler of the subscription with the event. A panicking handler is recovered and the event
+// is NACKed with the panic recorded. With a timeout the handler ctx is cancelled once it passes and the attempt is
+// NACKed whatever the handler returns. The NACK is only reported once the handler returned, so a handler ignoring
+// its ctx keeps its worker and the slots of the bus and of the topic, and its retry never runs alongside it.
+func (bus *eventBus) runHandler(ctx context.Context, sub *subscription, event *Event) AckStatus {
+	if sub.timeout <= 0 {
+		return bus.callHandler(ctx, sub, event)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sub.timeout)
+	defer cancel()
+
+	// the handler works on its own copy, the event only takes its outcome when it returns in time
+	attempt := *event
+	attempt.Headers = maps.Clone(event.Headers)
+	done := make(chan AckStatus, 1)
+
+	go func() {
+		done <- bus.callHandler(ctx, sub, &attempt)
+	}()
+
+	select {
+	case status := <-done:
+		event.LastError = attempt.LastError
+		event.RetryAfter = attempt.RetryAfter
+		return status
+	case <-ctx.Done():
+		bus.log.ErrorCtx(ctx, ErrHandlerTimeout, "Handler timed out after %s", sub.timeout)
+		event.SetError(ErrHandlerTimeout)
+
+		<-done
+		return NACK
+	}
+}
+
+// callHandler calls the handler of the subscription wrapped with its middlewares, turning a panic into a NACK.
+func (bus *eventBus) callHandler(ctx context.Context, sub *subscription, event *Event) (status AckStatus) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := fmt.Errorf("event handler panic: %v", r)
+			bus.log.ErrorCtx(bus.log.AddKeysValuesToCtx(ctx, map[string]interface{}{
+				"stack": string(debug.Stack()),
+			}), err, "Handler panicked")
+			event.SetError(err)
+			status = NACK
+		}
+	}()
+
+	return bus.chain(sub)(ctx, event)
+}
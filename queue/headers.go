@@ -0,0 +1,100 @@
+package queue
+
+import (
+	"context"
+	"maps"
+
+	"github.com/gateway-fm/scriptorium/helper"
+)
+
+// Well-known event headers.
+const (
+	HeaderRequestID   = "x-request-id" // HeaderRequestID carries the request ID of the publishing context.
+	HeaderPublicKey   = "x-public-key" // HeaderPublicKey carries the public key of the user publishing the event.
+	HeaderTraceparent = "traceparent"  // HeaderTraceparent carries the W3C trace context of the publisher.
+	HeaderTracestate  = "tracestate"   // HeaderTracestate carries the W3C trace state of the publisher.
+	HeaderPublisher   = "x-publisher"  // HeaderPublisher carries the name of the publishing service, if set.
+)
+
+// Propagator copies request scoped values from the publishing context into event headers,
+// and back from the headers into the context of the handlers.
+//
+// The signatures only use standard types, so OpenTelemetry propagators can be adapted without this package
+// depending on them, e.g. with propagation.MapCarrier(headers).
+type Propagator interface {
+	Inject(ctx context.Context, headers map[string]string)
+	Extract(ctx context.Context, headers map[string]string) context.Context
+}
+
+// RequestPropagator propagates the request ID and the public key kept in the context by the helper package.
+type RequestPropagator struct{}
+
+func (RequestPropagator) Inject(ctx context.Context, headers map[string]string) {
+	if requestID := helper.GetRequestID(ctx); requestID != "" {
+		headers[HeaderRequestID] = requestID
+	}
+	if publicKey := helper.GetPublicKey(ctx); publicKey != "" {
+		headers[HeaderPublicKey] = publicKey
+	}
+}
+
+func (RequestPropagator) Extract(ctx context.Context, headers map[string]string) context.Context {
+	if requestID, ok := headers[HeaderRequestID]; ok {
+		ctx = helper.SetRequestID(ctx, requestID)
+	}
+	if publicKey, ok := headers[HeaderPublicKey]; ok {
+		ctx = context.WithValue(ctx, helper.PublicKey, publicKey)
+	}
+	return ctx
+}
+
+// PublisherPropagator stamps every event with the name of the publishing service.
+type PublisherPropagator string
+
+func (p PublisherPropagator) Inject(_ context.Context, headers map[string]string) {
+	headers[HeaderPublisher] = string(p)
+}
+
+func (p PublisherPropagator) Extract(ctx context.Context, _ map[string]string) context.Context {
+	return ctx
+}
+
+// WithPropagators adds propagators to the bus, they run after the default RequestPropagator.
+func (bus *eventBus) WithPropagators(propagators ...Propagator) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	bus.propagators = append(bus.propagators, propagators...)
+}
+
+// injectHeaders collects the headers of an event published with ctx, extra headers are added last.
+func (bus *eventBus) injectHeaders(ctx context.Context, extra map[string]string) map[string]string {
+	bus.lock.RLock()
+	propagators := bus.propagators
+	bus.lock.RUnlock()
+
+	headers := make(map[string]string)
+	for _, propagator := range propagators {
+		propagator.Inject(ctx, headers)
+	}
+	maps.Copy(headers, extra)
+
+	return headers
+}
+
+// extractHeaders restores the values carried by the event headers into the handler context.
+func (bus *eventBus) extractHeaders(ctx context.Context, event *Event) context.Context {
+	if len(event.Headers) == 0 {
+		return ctx
+	}
+
+	bus.lock.RLock()
+	propagators := bus.propagators
+	bus.lock.RUnlock()
+
+	for _, propagator := range propagators {
+		ctx = propagator.Extract(ctx, event.Headers)
+	}
+
+	return ctx
+}
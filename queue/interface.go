@@ -2,8 +2,10 @@ package queue
 
 import (
 	"context"
+	"net/http"
 	"time"
 
+	"github.com/gateway-fm/scriptorium/metrics"
 	"github.com/gateway-fm/scriptorium/transactions"
 
 	"github.com/gateway-fm/scriptorium/clog"
@@ -11,12 +13,55 @@ import (
 
 // EventBus defines an interface for subscribing to topics, publishing events, and managing event processing.
 type EventBus interface {
-	Subscribe(topic string, handler EventHandler, delays []int, durationType time.Duration)
-	Publish(topic string, data []byte)
+	Subscribe(topic string, handler EventHandler, delays []int, durationType time.Duration, opts ...SubscribeOptions)
+	SubscribeBatch(
+		topic string,
+		handler BatchHandler,
+		batch BatchOptions,
+		delays []int,
+		durationType time.Duration,
+		opts ...SubscribeOptions,
+	)
+	Publish(topic string, data []byte, opts ...PublishOptions) error
+	PublishCtx(ctx context.Context, topic string, data []byte, opts ...PublishOptions) error
+	PublishAt(ctx context.Context, topic string, data []byte, at time.Time, opts ...PublishOptions) error
+	PublishAfter(ctx context.Context, topic string, data []byte, delay time.Duration, opts ...PublishOptions) error
 	StartProcessing(ctx context.Context) error
 	Stop()
+	Shutdown(ctx context.Context) error
 	ExceededMaxRetries(event *Event) bool
 	SetLogger(log *clog.CustomLogger)
 	AddEventToCtx(ctx context.Context, event *Event) context.Context
-	WithOutbox(factory transactions.TransactionFactory)
+	WithOutbox(factory transactions.TransactionFactory, opts ...OutboxOptions)
+	WithRelay(opts RelayOptions)
+	WithBackpressure(policy BackpressurePolicy)
+	WithPropagators(propagators ...Propagator)
+	WithTracer(tracer Tracer)
+	Use(middlewares ...Middleware)
+	RelayTo(topic string, sink Sink, delays []int, durationType time.Duration, opts ...SubscribeOptions)
+	WithMetrics(registry metrics.Registry, interval time.Duration)
+	WithDedupWindow(window time.Duration)
+	WithCircuitBreaker(opts BreakerOptions)
+	WithParkLimit(limit int)
+	Pause(topic string)
+	Resume(topic string)
+	Paused(topic string) bool
+	WithRetention(opts RetentionOptions)
+	MarkProcessed(ctx context.Context, event *Event) (bool, error)
+	SetConcurrency(workers int)
+	PoolStats() PoolStats
+	ListDeadLetters(ctx context.Context, filter DeadLetterFilter) ([]*OutboxEvent, error)
+	GetDeadLetter(ctx context.Context, eventID int) (*OutboxEvent, error)
+	ReplayDeadLetter(ctx context.Context, eventID int) error
+	ReplayDeadLetters(ctx context.Context, filter DeadLetterFilter) (int, error)
+	PurgeDeadLetters(ctx context.Context, filter DeadLetterFilter) (int, error)
+	AdminHandler(opts AdminOptions) http.Handler
+}
+
+// Testable is implemented by the bus returned by NewEventBus next to EventBus. It lets tests replace the clock
+// and the outbox of the bus and wait for it to settle, see the queuetest package.
+type Testable interface {
+	WithOutboxStore(store OutboxStore)
+	WithClock(clock Clock)
+	Idle() bool
 }
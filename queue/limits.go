@@ -0,0 +1,141 @@
+package queue
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MetricOpThrottled counts deliveries held back by a rate limit or a concurrency cap, the message is the subscriber.
+const MetricOpThrottled = "throttled"
+
+// RateLimit paces deliveries with a token bucket, see SubscribeOptions.RateLimit.
+type RateLimit struct {
+	Rate     float64 // Rate is the number of events per second, no limit applies when it is not positive.
+	Burst    int     // Burst is the number of events that may be handled at once after a pause, 1 when zero.
+	PerTopic bool    // PerTopic shares the limit between all subscriptions of the topic.
+}
+
+// tokenBucket is a token bucket refilled at a constant rate.
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit, now time.Time) *tokenBucket {
+	if limit.Rate <= 0 {
+		return nil
+	}
+
+	burst := float64(max(limit.Burst, 1))
+	return &tokenBucket{
+		rate:   limit.Rate,
+		burst:  burst,
+		tokens: burst,
+		last:   now,
+	}
+}
+
+// reserve takes a token and returns how long to wait until it is available.
+func (b *tokenBucket) reserve(now time.Time) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel gives back a reserved token that was not used.
+func (b *tokenBucket) cancel() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.tokens = min(b.burst, b.tokens+1)
+}
+
+// wait takes a token, waiting for it until ctx is done or the bus drains. It reports whether it had to wait.
+func (b *tokenBucket) wait(ctx context.Context, clock Clock, drain <-chan struct{}) (bool, error) {
+	delay := b.reserve(clock.Now())
+	if delay <= 0 {
+		return false, nil
+	}
+
+	timer := clock.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C():
+		return true, nil
+	case <-drain:
+		b.cancel()
+		return true, nil
+	case <-ctx.Done():
+		b.cancel()
+		return true, ctx.Err()
+	}
+}
+
+// throttle holds the event back until the rate limits and the concurrency cap of its subscription allow handling it.
+// The returned func frees the concurrency slot taken, it must be called once the event is handled. Waiting stops
+// early when the bus drains, an error is only returned when ctx is done.
+func (bus *eventBus) throttle(ctx context.Context, event *Event) (func(), error) {
+	bus.lock.RLock()
+	topicLimit := bus.rateLimits[event.Topic]
+	clock := bus.clock
+	bus.lock.RUnlock()
+
+	sub := bus.subscription(event.Topic, event.Subscriber)
+
+	buckets := []*tokenBucket{topicLimit}
+	if sub != nil {
+		buckets = append(buckets, sub.limiter)
+	}
+
+	throttled := false
+	for _, bucket := range buckets {
+		if bucket == nil {
+			continue
+		}
+
+		bus.waiting.Add(1)
+		waited, err := bucket.wait(ctx, clock, bus.drain)
+		bus.waiting.Add(-1)
+		throttled = throttled || waited
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	release := func() {}
+	if sub != nil && sub.inFlight != nil {
+		select {
+		case sub.inFlight <- struct{}{}:
+			release = func() { <-sub.inFlight }
+		default:
+			throttled = true
+
+			select {
+			case sub.inFlight <- struct{}{}:
+				release = func() { <-sub.inFlight }
+			case <-bus.drain:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	if throttled {
+		bus.registry.Inc(series(event.Topic, MetricOpThrottled).Info(event.Subscriber))
+	}
+
+	return release, nil
+}
@@ -0,0 +1,153 @@
+package queue
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/gateway-fm/scriptorium/metrics"
+)
+
+// DefaultMetricsInterval is how often the queue depth and the outbox backlog age are sampled
+// unless WithMetrics is given another interval.
+const DefaultMetricsInterval = 15 * time.Second
+
+// Operations of the databus_consumer series recorded by the bus, the topic is used as the series sub type.
+const (
+	MetricOpPublish    = "publish"     // MetricOpPublish counts published, failed and duplicate events.
+	MetricOpHandle     = "handle"      // MetricOpHandle records the handler duration, the message is the subscriber.
+	MetricOpAck        = "ack"         // MetricOpAck counts acknowledged events, the message is the subscriber.
+	MetricOpNack       = "nack"        // MetricOpNack counts not acknowledged events, the message is the subscriber.
+	MetricOpRetry      = "retry"       // MetricOpRetry counts scheduled retries, the message is the subscriber.
+	MetricOpDeadLetter = "dead_letter" // MetricOpDeadLetter counts dead-lettered events, the message is the subscriber.
+	MetricOpQueueDepth = "queue_depth" // MetricOpQueueDepth is the number of events waiting for a worker.
+	MetricOpBacklogAge = "backlog_age" // MetricOpBacklogAge is the age in seconds of the oldest due pending outbox event.
+)
+
+// WithMetrics makes the bus record its metrics to the registry. The queue depth and the outbox backlog age
+// are sampled every interval while processing, DefaultMetricsInterval is used when it is not positive.
+// Gauges are only recorded by registries implementing metrics.GaugeRegistry.
+func (bus *eventBus) WithMetrics(registry metrics.Registry, interval time.Duration) {
+	if interval <= 0 {
+		interval = DefaultMetricsInterval
+	}
+
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	bus.registry = registry
+	bus.metricsInterval = interval
+}
+
+// series returns the series of an operation on a topic.
+func series(topic, operation string) metrics.Series {
+	_, s := metrics.NewSeries(metrics.SeriesTypeDatabusConsumer, topic).WithOperation(context.Background(), operation)
+	return s
+}
+
+// recordPublish counts a published event, reason is empty on success.
+func (bus *eventBus) recordPublish(topic, reason string) {
+	s := series(topic, MetricOpPublish)
+	if reason != "" {
+		bus.registry.Inc(s.Error(reason))
+		return
+	}
+	bus.registry.Inc(s.Success())
+}
+
+// recordDuplicate counts an event dropped as a duplicate of an earlier event.
+func (bus *eventBus) recordDuplicate(topic string) {
+	bus.registry.Inc(series(topic, MetricOpPublish).Info("duplicate"))
+}
+
+// recordHandled records the duration and the outcome of a handler invocation.
+func (bus *eventBus) recordHandled(event *Event, handled, status AckStatus, took time.Duration) {
+	bus.registry.RecordDuration(series(event.Topic, MetricOpHandle).Duration(took, event.Subscriber))
+
+	if handled == ACK {
+		bus.registry.Inc(series(event.Topic, MetricOpAck).Info(event.Subscriber))
+		return
+	}
+	bus.registry.Inc(series(event.Topic, MetricOpNack).Info(event.Subscriber))
+
+	if status == NACK {
+		bus.registry.Inc(series(event.Topic, MetricOpRetry).Info(event.Subscriber))
+		return
+	}
+	bus.registry.Inc(series(event.Topic, MetricOpDeadLetter).Info(event.Subscriber))
+}
+
+// runMetrics samples the gauges of the bus until ctx is done or the bus drains.
+func (bus *eventBus) runMetrics(ctx context.Context) {
+	bus.lock.RLock()
+	interval := bus.metricsInterval
+	bus.lock.RUnlock()
+
+	ticker := newTicker(bus.clockOf(), interval)
+	defer ticker.stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-bus.drain:
+			return
+		case <-ticker.C():
+			bus.sampleMetrics(ctx)
+			ticker.next()
+		}
+	}
+}
+
+// setGauge sets a gauge when the registry of the bus implements metrics.GaugeRegistry.
+func (bus *eventBus) setGauge(name string, labels prometheus.Labels, value float64) {
+	if gauges, ok := bus.registry.(metrics.GaugeRegistry); ok {
+		gauges.SetGauge(name, labels, value)
+	}
+}
+
+// sampleMetrics records the queue depth of every topic and, with the outbox, the age of its backlog.
+func (bus *eventBus) sampleMetrics(ctx context.Context) {
+	if _, ok := bus.registry.(metrics.GaugeRegistry); !ok {
+		return
+	}
+
+	topics := make(map[string]struct{})
+
+	bus.lock.RLock()
+	for topic := range bus.handlers {
+		topics[topic] = struct{}{}
+	}
+	bus.lock.RUnlock()
+
+	stats := bus.PoolStats().Topics
+	for topic := range stats {
+		topics[topic] = struct{}{}
+	}
+	for topic := range topics {
+		bus.setGauge(series(topic, MetricOpQueueDepth).Gauge(float64(stats[topic].Queued), ""))
+	}
+
+	if bus.outbox == nil {
+		return
+	}
+
+	oldest, err := bus.outbox.OldestPendingEvents(ctx)
+	if err != nil {
+		bus.log.ErrorCtx(ctx, err, "Failed to load outbox backlog")
+		return
+	}
+
+	now := bus.now()
+	for topic := range oldest {
+		topics[topic] = struct{}{}
+	}
+	for topic := range topics {
+		age := 0.0
+		if at, ok := oldest[topic]; ok {
+			age = max(now.Sub(at).Seconds(), 0)
+		}
+		bus.setGauge(series(topic, MetricOpBacklogAge).Gauge(age, ""))
+	}
+}
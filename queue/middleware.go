@@ -0,0 +1,148 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/gateway-fm/scriptorium/clog"
+	"github.com/gateway-fm/scriptorium/metrics"
+)
+
+// MetricOpHandler is the operation of the databus_consumer series recorded by MetricsMiddleware.
+const MetricOpHandler = "handler"
+
+// Middleware wraps an EventHandler with cross-cutting behaviour.
+//
+// Bus-wide middlewares registered with Use wrap the middlewares of the subscription, see SubscribeOptions,
+// which wrap the handler. Within each group the first middleware is the outermost one.
+type Middleware func(next EventHandler) EventHandler
+
+// Use registers bus-wide middlewares, they apply to every subscription including the existing ones.
+func (bus *eventBus) Use(middlewares ...Middleware) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	bus.middlewares = append(bus.middlewares, middlewares...)
+}
+
+// chain wraps the handler of the subscription with the bus-wide and the subscription middlewares.
+func (bus *eventBus) chain(sub *subscription) EventHandler {
+	bus.lock.RLock()
+	middlewares := bus.middlewares
+	bus.lock.RUnlock()
+
+	handler := sub.handler
+	for i := len(sub.middlewares) - 1; i >= 0; i-- {
+		handler = sub.middlewares[i](handler)
+	}
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+
+	return handler
+}
+
+// LoggingMiddleware logs the outcome and the duration of every handler call.
+func LoggingMiddleware(log *clog.CustomLogger) Middleware {
+	return func(next EventHandler) EventHandler {
+		return func(ctx context.Context, event *Event) AckStatus {
+			started := time.Now()
+			status := next(ctx, event)
+			took := time.Since(started)
+
+			if status == ACK {
+				log.DebugCtx(ctx, "Event handled in %s", took)
+				return status
+			}
+
+			msg := event.LastError
+			if msg == "" {
+				msg = "event not acknowledged"
+			}
+			log.ErrorCtx(ctx, errors.New(msg), "Event handling failed in %s with %s", took, status)
+
+			return status
+		}
+	}
+}
+
+// RecoveryMiddleware recovers a panicking handler, logging the panic with its stack, and NACKs the event.
+func RecoveryMiddleware(log *clog.CustomLogger) Middleware {
+	return func(next EventHandler) EventHandler {
+		return func(ctx context.Context, event *Event) (status AckStatus) {
+			defer func() {
+				if r := recover(); r != nil {
+					err := fmt.Errorf("event handler panic: %v", r)
+					log.ErrorCtx(log.AddKeysValuesToCtx(ctx, map[string]interface{}{
+						"stack": string(debug.Stack()),
+					}), err, "Handler panicked")
+					event.SetError(err)
+					status = NACK
+				}
+			}()
+
+			return next(ctx, event)
+		}
+	}
+}
+
+// TimeoutMiddleware cancels the handler ctx once the timeout passes and NACKs the event when it did.
+// Unlike SubscribeOptions.Timeout, it waits for the handler to return.
+func TimeoutMiddleware(timeout time.Duration) Middleware {
+	return func(next EventHandler) EventHandler {
+		return func(ctx context.Context, event *Event) AckStatus {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			status := next(ctx, event)
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				event.SetError(ErrHandlerTimeout)
+				return NACK
+			}
+
+			return status
+		}
+	}
+}
+
+// MetricsMiddleware records the duration and the outcome of every handler call in the databus_consumer series
+// of its topic, under the MetricOpHandler operation.
+func MetricsMiddleware(registry metrics.Registry) Middleware {
+	return func(next EventHandler) EventHandler {
+		return func(ctx context.Context, event *Event) AckStatus {
+			started := time.Now()
+			status := next(ctx, event)
+
+			s := series(event.Topic, MetricOpHandler)
+			registry.RecordDuration(s.Duration(time.Since(started), event.Subscriber))
+			if status == ACK {
+				registry.Inc(s.Success())
+			} else {
+				registry.Inc(s.Error(string(status)))
+			}
+
+			return status
+		}
+	}
+}
+
+// TracingMiddleware wraps every handler call in a span started with the tracer.
+func TracingMiddleware(tracer Tracer) Middleware {
+	return func(next EventHandler) EventHandler {
+		return func(ctx context.Context, event *Event) AckStatus {
+			ctx, span := tracer.Start(ctx, "handle "+event.Topic)
+			span.SetAttributeString(SpanAttrTopic, event.Topic)
+			span.SetAttributeString(SpanAttrSubscriber, event.Subscriber)
+			span.SetAttributeInt(SpanAttrEventID, event.ID)
+			span.SetAttributeInt(SpanAttrRetry, event.Retry)
+
+			status := next(ctx, event)
+			endConsumerSpan(span, status, event.LastError)
+
+			return status
+		}
+	}
+}
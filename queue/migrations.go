@@ -0,0 +1,264 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+
+	"github.com/gateway-fm/scriptorium/transactions"
+)
+
+// migration is a versioned step of the outbox schema. Statements are idempotent, so a migration also brings
+// tables created by hand before the queue owned its schema up to date.
+type migration struct {
+	version    int
+	name       string
+	statements func(t outboxTables) []string
+}
+
+// outboxTables holds the quoted names used by the migrations.
+type outboxTables struct {
+	outbox          string // outbox is the quoted outbox table.
+	processed       string // processed is the quoted processed events table.
+	archive         string // archive is the quoted archive of acknowledged events.
+	migrations      string // migrations is the quoted table of applied migrations.
+	prefix          string // prefix is the outbox table name the index names start with.
+	processedPrefix string // processedPrefix is the processed events table name its index names start with.
+}
+
+// index returns the quoted name of an index of the outbox table.
+func (t outboxTables) index(name string) string {
+	return quoteIdent(t.prefix + "_" + name)
+}
+
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create outbox table",
+		statements: func(t outboxTables) []string {
+			return []string{
+				`CREATE TABLE IF NOT EXISTS ` + t.outbox + ` (
+					id bigserial PRIMARY KEY,
+					data bytea,
+					topic text NOT NULL,
+					retry integer NOT NULL DEFAULT 0,
+					next_retry bigint NOT NULL DEFAULT 0,
+					ack_status text NOT NULL,
+					created_at bigint NOT NULL DEFAULT 0,
+					updated_at bigint NOT NULL DEFAULT 0
+				)`,
+			}
+		},
+	},
+	{
+		version: 2,
+		name:    "add delivery state",
+		statements: func(t outboxTables) []string {
+			return []string{
+				`ALTER TABLE ` + t.outbox + `
+					ADD COLUMN IF NOT EXISTS subscriber text NOT NULL DEFAULT '',
+					ADD COLUMN IF NOT EXISTS last_error text NOT NULL DEFAULT '',
+					ADD COLUMN IF NOT EXISTS failed_at bigint NOT NULL DEFAULT 0,
+					ADD COLUMN IF NOT EXISTS headers jsonb,
+					ADD COLUMN IF NOT EXISTS available_at bigint NOT NULL DEFAULT 0`,
+			}
+		},
+	},
+	{
+		version: 3,
+		name:    "add relay leases",
+		statements: func(t outboxTables) []string {
+			return []string{
+				`ALTER TABLE ` + t.outbox + `
+					ADD COLUMN IF NOT EXISTS lease_owner text NOT NULL DEFAULT '',
+					ADD COLUMN IF NOT EXISTS lease_until bigint NOT NULL DEFAULT 0`,
+			}
+		},
+	},
+	{
+		version: 4,
+		name:    "replace payload deduplication with dedup keys",
+		statements: func(t outboxTables) []string {
+			return []string{
+				`ALTER TABLE ` + t.outbox + `
+					ADD COLUMN IF NOT EXISTS ordering_key text NOT NULL DEFAULT '',
+					ADD COLUMN IF NOT EXISTS dedup_key text NOT NULL DEFAULT ''`,
+				// unique indexes on the payload collapse distinct events with identical data, drop them
+				// whatever their names
+				`DO $$
+				DECLARE
+					idx record;
+				BEGIN
+					FOR idx IN
+						SELECT i.indexrelid::regclass::text AS index_name, c.conname
+						FROM pg_index i
+						LEFT JOIN pg_constraint c ON c.conindid = i.indexrelid AND c.conrelid = i.indrelid
+						WHERE i.indrelid = ` + quoteLiteral(t.outbox) + `::regclass
+							AND i.indisunique AND NOT i.indisprimary
+							AND ARRAY(
+								SELECT a.attname::text FROM pg_attribute a
+								WHERE a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+								ORDER BY a.attname
+							) IN (ARRAY['data', 'topic'], ARRAY['data', 'subscriber', 'topic'])
+					LOOP
+						IF idx.conname IS NOT NULL THEN
+							EXECUTE 'ALTER TABLE ' || ` + quoteLiteral(t.outbox) + ` || ' DROP CONSTRAINT ' || quote_ident(idx.conname);
+						ELSE
+							EXECUTE 'DROP INDEX ' || idx.index_name;
+						END IF;
+					END LOOP;
+				END
+				$$`,
+				`CREATE UNIQUE INDEX IF NOT EXISTS ` + t.index("dedup_key_idx") + ` ON ` + t.outbox + `
+					(topic, subscriber, dedup_key) WHERE dedup_key <> ''`,
+			}
+		},
+	},
+	{
+		version: 5,
+		name:    "add pending, ordering and dead letter indexes",
+		statements: func(t outboxTables) []string {
+			return []string{
+				`CREATE INDEX IF NOT EXISTS ` + t.index("pending_idx") + ` ON ` + t.outbox + `
+					(available_at, id) WHERE ack_status = 'NACK'`,
+				`CREATE INDEX IF NOT EXISTS ` + t.index("ordering_idx") + ` ON ` + t.outbox + `
+					(topic, subscriber, ordering_key, id) WHERE ordering_key <> '' AND ack_status = 'NACK'`,
+				`CREATE INDEX IF NOT EXISTS ` + t.index("dead_idx") + ` ON ` + t.outbox + `
+					(failed_at) WHERE ack_status = 'DEAD'`,
+			}
+		},
+	},
+	{
+		version: 6,
+		name:    "create processed events table",
+		statements: func(t outboxTables) []string {
+			return []string{
+				`CREATE TABLE IF NOT EXISTS ` + t.processed + ` (
+					topic text NOT NULL,
+					subscriber text NOT NULL,
+					key text NOT NULL,
+					processed_at bigint NOT NULL DEFAULT 0,
+					PRIMARY KEY (topic, subscriber, key)
+				)`,
+			}
+		},
+	},
+	{
+		version: 7,
+		name:    "add archive of acknowledged events",
+		statements: func(t outboxTables) []string {
+			// columns added to the outbox table later must be added to the archive as well, before archived_at
+			return []string{
+				`UPDATE ` + t.outbox + ` SET updated_at = created_at WHERE ack_status = 'ACK' AND updated_at = 0`,
+				`CREATE INDEX IF NOT EXISTS ` + t.index("acked_idx") + ` ON ` + t.outbox + `
+					(updated_at) WHERE ack_status = 'ACK'`,
+				`CREATE TABLE IF NOT EXISTS ` + t.archive + ` (LIKE ` + t.outbox + `)`,
+				`ALTER TABLE ` + t.archive + ` ADD COLUMN IF NOT EXISTS archived_at bigint NOT NULL DEFAULT 0`,
+			}
+		},
+	},
+	{
+		version: 8,
+		name:    "add processed events expiry index",
+		statements: func(t outboxTables) []string {
+			return []string{
+				// outboxes may share the processed events table, its index is named after it
+				`CREATE INDEX IF NOT EXISTS ` + quoteIdent(t.processedPrefix+"_processed_at_idx") + ` ON ` + t.processed + `
+					(processed_at)`,
+			}
+		},
+	},
+}
+
+// Migrate creates or upgrades the outbox tables named by opts, applying within a transaction of trm the migrations
+// not applied yet. Applied versions are recorded in the "<table>_migrations" table. It is safe to call on every
+// start, concurrent calls wait for each other. Only the first of opts is taken into account.
+func Migrate(
+	ctx context.Context,
+	trm transactions.TransactionManager,
+	factory transactions.TransactionFactory,
+	opts ...OutboxOptions,
+) error {
+	var opt OutboxOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	opt = opt.withDefaults()
+
+	tables := outboxTables{
+		outbox:          quoteIdent(string(opt.qualify(opt.Table))),
+		processed:       quoteIdent(string(opt.qualify(opt.ProcessedTable))),
+		archive:         quoteIdent(string(opt.qualify(opt.ArchiveTable))),
+		migrations:      quoteIdent(string(opt.qualify(opt.Table + "_migrations"))),
+		prefix:          opt.Table,
+		processedPrefix: opt.ProcessedTable,
+	}
+
+	return trm.Do(ctx, func(ctx context.Context) error {
+		tx := factory.Transaction(ctx)
+
+		// concurrent migrations of the same outbox wait for each other
+		_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext(?))`, tables.outbox)
+		if err != nil {
+			return fmt.Errorf("lock outbox migrations: %w", err)
+		}
+
+		if opt.Schema != "" {
+			if _, err = tx.ExecContext(ctx, `CREATE SCHEMA IF NOT EXISTS `+quoteIdent(opt.Schema)); err != nil {
+				return fmt.Errorf("create outbox schema: %w", err)
+			}
+		}
+
+		_, err = tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS `+tables.migrations+` (
+			version integer PRIMARY KEY,
+			name text NOT NULL,
+			applied_at bigint NOT NULL
+		)`)
+		if err != nil {
+			return fmt.Errorf("create outbox migrations table: %w", err)
+		}
+
+		var current int
+		_, err = tx.QueryOneContext(ctx, pg.Scan(&current), `SELECT coalesce(max(version), 0) FROM `+tables.migrations)
+		if err != nil {
+			return fmt.Errorf("load outbox schema version: %w", err)
+		}
+
+		for _, m := range migrations {
+			if m.version <= current {
+				continue
+			}
+
+			for _, statement := range m.statements(tables) {
+				if _, err = tx.ExecContext(ctx, statement); err != nil {
+					return fmt.Errorf("apply outbox migration %d %q: %w", m.version, m.name, err)
+				}
+			}
+
+			_, err = tx.ExecContext(ctx, `INSERT INTO `+tables.migrations+` (version, name, applied_at) VALUES (?, ?, ?)`,
+				m.version, m.name, time.Now().Unix())
+			if err != nil {
+				return fmt.Errorf("record outbox migration %d: %w", m.version, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// quoteIdent quotes a possibly schema qualified identifier.
+func quoteIdent(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = `"` + strings.ReplaceAll(part, `"`, `""`) + `"`
+	}
+	return strings.Join(parts, ".")
+}
+
+// quoteLiteral quotes a string literal.
+func quoteLiteral(s string) string {
+	return `'` + strings.ReplaceAll(s, `'`, `''`) + `'`
+}
@@ -0,0 +1,111 @@
+package queue
+
+import (
+	"context"
+	"sync"
+)
+
+// orderingKey identifies the ordered deliveries of a subscription.
+type orderingKey struct {
+	topic      string
+	subscriber string
+	key        string
+}
+
+// sequence holds the event of an ordering key being handled or retried and the events waiting behind it.
+type sequence struct {
+	active  *Event
+	pending []*Event
+}
+
+// sequencer keeps events sharing an ordering key from being handled concurrently or out of order.
+type sequencer struct {
+	lock      sync.Mutex
+	sequences map[orderingKey]*sequence
+}
+
+func newSequencer() *sequencer {
+	return &sequencer{sequences: make(map[orderingKey]*sequence)}
+}
+
+func keyOf(event *Event) orderingKey {
+	return orderingKey{topic: event.Topic, subscriber: event.Subscriber, key: event.OrderingKey}
+}
+
+// admit reports whether the event may be handled now. Otherwise it is held until the events
+// of its ordering key admitted before it are done, see release.
+//
+// In the relay mode the outbox only lets the first pending event of an ordering key be claimed,
+// so every claimed event is admitted.
+func (bus *eventBus) admit(event *Event) bool {
+	if event.OrderingKey == "" || bus.relay != nil {
+		return true
+	}
+
+	s := bus.sequencer
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := keyOf(event)
+	seq, ok := s.sequences[key]
+	if !ok {
+		s.sequences[key] = &sequence{active: event}
+		return true
+	}
+
+	if seq.active == event || (event.ID != 0 && seq.active.ID == event.ID) {
+		return true
+	}
+
+	for _, pending := range seq.pending {
+		if pending == event || (event.ID != 0 && pending.ID == event.ID) {
+			return false
+		}
+	}
+	seq.pending = append(seq.pending, event)
+
+	return false
+}
+
+// release marks an acknowledged or dead-lettered event as done and schedules the next event of its ordering key.
+func (bus *eventBus) release(ctx context.Context, event *Event) {
+	if event.OrderingKey == "" || bus.relay != nil {
+		return
+	}
+
+	s := bus.sequencer
+	s.lock.Lock()
+
+	key := keyOf(event)
+	seq, ok := s.sequences[key]
+	if !ok || seq.active != event && (event.ID == 0 || seq.active.ID != event.ID) {
+		s.lock.Unlock()
+		return
+	}
+
+	if len(seq.pending) == 0 {
+		delete(s.sequences, key)
+		s.lock.Unlock()
+		return
+	}
+
+	next := seq.pending[0]
+	seq.active = next
+	seq.pending = seq.pending[1:]
+	s.lock.Unlock()
+
+	bus.scheduleEvent(ctx, next)
+}
+
+// held returns the number of events waiting behind another event of their ordering key.
+func (s *sequencer) held() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	held := 0
+	for _, seq := range s.sequences {
+		held += len(seq.pending)
+	}
+
+	return held
+}
@@ -1,8 +1,50 @@
 package queue
 
-import "context"
+import (
+	"context"
+	"sync"
+)
+
+// outboxLoad keeps the outbox events taken by the bus until it loaded the outbox on start, so an event published
+// in the meantime is not both dispatched by its publisher and loaded.
+type outboxLoad struct {
+	lock    sync.Mutex
+	done    bool
+	claimed map[int]struct{}
+}
+
+// claim reports whether the event is for the caller to dispatch, false when it was claimed already.
+// Every event is for its publisher once the outbox is loaded.
+func (l *outboxLoad) claim(eventID int) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.done || eventID == 0 {
+		return true
+	}
+	if _, ok := l.claimed[eventID]; ok {
+		return false
+	}
+	if l.claimed == nil {
+		l.claimed = make(map[int]struct{})
+	}
+	l.claimed[eventID] = struct{}{}
+	return true
+}
+
+// finish forgets the claimed events once the outbox is loaded.
+func (l *outboxLoad) finish() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.done = true
+	l.claimed = nil
+}
 
 // loadEventsFromOutbox loads events from the outbox table into the in-memory queue.
+// Due events are enqueued in the background, the others are scheduled for their AvailableAt moment.
+// Events are loaded in order of their IDs, so events sharing an ordering key keep their publishing order.
+// Events already dispatched by their publisher are skipped, see outboxLoad.
 func (bus *eventBus) loadEventsFromOutbox(ctx context.Context) error {
 	if bus.outbox == nil {
 		return nil
@@ -14,13 +56,64 @@ func (bus *eventBus) loadEventsFromOutbox(ctx context.Context) error {
 		return err
 	}
 
-	for _, outboxEvent := range events {
-		bus.queue <- convertOutboxEventToEvent(outboxEvent)
-	}
+	bus.inflight.Add(1)
+	go func() {
+		defer bus.inflight.Add(-1)
+		defer bus.load.finish()
+
+		for _, outboxEvent := range events {
+			event := convertOutboxEventToEvent(outboxEvent)
+			if !bus.load.claim(event.ID) || !bus.admit(event) {
+				continue
+			}
+
+			if bus.now().Before(event.AvailableAt) {
+				bus.scheduleEvent(ctx, event)
+				continue
+			}
+
+			if err := bus.enqueue(ctx, event); err != nil {
+				return
+			}
+		}
+	}()
 
 	return nil
 }
 
+// saveDeliveries inserts the deliveries of an event into the outbox table, sets their IDs and returns them.
+// Deliveries dropped as duplicates of earlier events are left out. Leased deliveries are held by the relay
+// of this bus right away.
+func (bus *eventBus) saveDeliveries(ctx context.Context, deliveries []*Event, leased bool) ([]*Event, error) {
+	outboxEvents := make([]*OutboxEvent, len(deliveries))
+	for i, delivery := range deliveries {
+		outboxEvents[i] = convertEventToOutboxEvent(delivery)
+		if leased {
+			outboxEvents[i].LeaseOwner = bus.relay.opts.Owner
+			outboxEvents[i].LeaseUntil = bus.now().Add(bus.relay.opts.LeaseDuration).Unix()
+		}
+	}
+
+	bus.lock.RLock()
+	window := bus.dedupWindow
+	bus.lock.RUnlock()
+
+	if err := bus.outbox.InsertEvents(ctx, outboxEvents, window); err != nil {
+		return nil, err
+	}
+
+	saved := make([]*Event, 0, len(deliveries))
+	for i, delivery := range deliveries {
+		if outboxEvents[i].ID == 0 {
+			continue
+		}
+		delivery.ID = outboxEvents[i].ID
+		saved = append(saved, delivery)
+	}
+
+	return saved, nil
+}
+
 // updateEventStatus updates the status and retry count of an event in the outbox table.
 func (bus *eventBus) updateEventStatus(ctx context.Context, event *Event) {
 	outboxEvent := convertEventToOutboxEvent(event)
@@ -37,9 +130,57 @@ func (bus *eventBus) markEventAsProcessed(ctx context.Context, eventID int) {
 	}
 }
 
-// markEventAsFailed marks an event as failed in the outbox table.
-func (bus *eventBus) markEventAsFailed(ctx context.Context, eventID int) {
-	if err := bus.outbox.MarkEventAsFailed(ctx, eventID); err != nil {
-		bus.log.ErrorCtx(ctx, err, "Failed to mark event as failed in outbox")
+// markEventAsDead moves an event to dead letters in the outbox table.
+func (bus *eventBus) markEventAsDead(ctx context.Context, event *Event) {
+	if err := bus.outbox.MarkEventAsDead(ctx, event.ID, event.LastError); err != nil {
+		bus.log.ErrorCtx(ctx, err, "Failed to mark event as dead in outbox")
+	}
+}
+
+// markEventsAsProcessed marks events as processed in the outbox table at once.
+func (bus *eventBus) markEventsAsProcessed(ctx context.Context, events []*Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	ids := make([]int, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+	}
+
+	if err := bus.outbox.MarkEventsAsProcessed(ctx, ids); err != nil {
+		bus.log.ErrorCtx(ctx, err, "Failed to mark events as processed in outbox")
+	}
+}
+
+// updateEventStatuses updates the status and retry count of events in the outbox table at once.
+func (bus *eventBus) updateEventStatuses(ctx context.Context, events []*Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	outboxEvents := make([]*OutboxEvent, len(events))
+	for i, event := range events {
+		outboxEvents[i] = convertEventToOutboxEvent(event)
+	}
+
+	if err := bus.outbox.UpdateEventStatuses(ctx, outboxEvents); err != nil {
+		bus.log.ErrorCtx(ctx, err, "Failed to update event statuses in outbox")
+	}
+}
+
+// markEventsAsDead moves events to dead letters in the outbox table at once.
+func (bus *eventBus) markEventsAsDead(ctx context.Context, events []*Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	outboxEvents := make([]*OutboxEvent, len(events))
+	for i, event := range events {
+		outboxEvents[i] = convertEventToOutboxEvent(event)
+	}
+
+	if err := bus.outbox.MarkEventsAsDead(ctx, outboxEvents); err != nil {
+		bus.log.ErrorCtx(ctx, err, "Failed to mark events as dead in outbox")
 	}
 }
@@ -2,53 +2,314 @@ package queue
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
+
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/go-pg/pg/v10/types"
 
 	"github.com/gateway-fm/scriptorium/transactions"
 )
 
+// ErrEventNotFound is returned when the requested event does not exist in the outbox table.
+var ErrEventNotFound = errors.New("event not found in outbox")
+
 // OutboxEvent represents an event stored in the outbox table.
 type OutboxEvent struct {
-	ID        int       `pg:",pk"`        // Primary key
-	Data      []byte    `pg:"data"`       // Data column
-	Topic     string    `pg:"topic"`      // Topic column
-	Retry     int       `pg:"retry"`      // Retry column
-	NextRetry uint      `pg:"next_retry"` // NextRetry column as minutes
-	AckStatus AckStatus `pg:"ack_status"` // AckStatus column
-	CreatedAt int64     `pg:"created_at"` // CreatedAt column as Unix timestamp
-	UpdatedAt int64     `pg:"updated_at"` // UpdatedAt column as Unix timestamp
+	tableName struct{} `pg:"_,alias:outbox_event"` // the table is set on every query by OutboxRepository
+
+	ID          int               `pg:",pk"`                   // Primary key
+	Data        []byte            `pg:"data"`                  // Data column
+	Topic       string            `pg:"topic"`                 // Topic column
+	Retry       int               `pg:"retry,use_zero"`        // Retry column
+	NextRetry   uint              `pg:"next_retry,use_zero"`   // NextRetry column as minutes, informational, see AvailableAt
+	AckStatus   AckStatus         `pg:"ack_status"`            // AckStatus column
+	Subscriber  string            `pg:"subscriber,use_zero"`   // Subscriber column, the subscription the event is delivered to
+	LastError   string            `pg:"last_error,use_zero"`   // LastError column, the error of the last failed attempt
+	FailedAt    int64             `pg:"failed_at,use_zero"`    // FailedAt column as Unix timestamp, set when the event is dead-lettered
+	LeaseOwner  string            `pg:"lease_owner,use_zero"`  // LeaseOwner column, the relay instance currently holding the event
+	LeaseUntil  int64             `pg:"lease_until,use_zero"`  // LeaseUntil column as Unix timestamp, the event can't be claimed before it
+	Headers     map[string]string `pg:"headers,type:jsonb"`    // Headers column, the event metadata as JSON
+	OrderingKey string            `pg:"ordering_key,use_zero"` // OrderingKey column, events sharing it are handled in order of their IDs
+	DedupKey    string            `pg:"dedup_key,use_zero"`    // DedupKey column, the key deduplicating the event within the dedup window
+	AvailableAt int64             `pg:"available_at,use_zero"` // AvailableAt column as Unix timestamp in milliseconds, the event is not handled before it
+	CreatedAt   int64             `pg:"created_at"`            // CreatedAt column as Unix timestamp
+	UpdatedAt   int64             `pg:"updated_at"`            // UpdatedAt column as Unix timestamp
+}
+
+// DeadLetterFilter narrows down dead-lettered events by topic, subscriber and the time they failed.
+type DeadLetterFilter struct {
+	Topic      string    // Topic matches a single topic, all topics are matched when empty.
+	Subscriber string    // Subscriber matches a single subscription, all subscriptions are matched when empty.
+	From       time.Time // From is the inclusive lower bound of the failure time, unbounded when zero.
+	To         time.Time // To is the exclusive upper bound of the failure time, unbounded when zero.
+	Limit      int       // Limit caps the number of listed events, unlimited when zero.
+}
+
+// apply adds the filter conditions to a query over dead-lettered events.
+func (f DeadLetterFilter) apply(q *orm.Query) (*orm.Query, error) {
+	q = q.Where("ack_status = ?", DEAD)
+
+	if f.Topic != "" {
+		q = q.Where("topic = ?", f.Topic)
+	}
+	if f.Subscriber != "" {
+		q = q.Where("subscriber = ?", f.Subscriber)
+	}
+	if !f.From.IsZero() {
+		q = q.Where("failed_at >= ?", f.From.Unix())
+	}
+	if !f.To.IsZero() {
+		q = q.Where("failed_at < ?", f.To.Unix())
+	}
+
+	return q, nil
+}
+
+// Default names of the outbox tables.
+const (
+	DefaultOutboxTable    = "outbox_events"
+	DefaultProcessedTable = "processed_events"
+)
+
+// OutboxOptions names the tables of the outbox, so several buses can share a database.
+type OutboxOptions struct {
+	Schema         string // Schema holds the tables, the search path decides when empty.
+	Table          string // Table is the name of the outbox table, DefaultOutboxTable when empty.
+	ProcessedTable string // ProcessedTable is the name of the processed events table, DefaultProcessedTable when empty.
+	ArchiveTable   string // ArchiveTable is the name of the archive of acknowledged events, "<Table>_archive" when empty.
+}
+
+// withDefaults returns the options with the default names filled in.
+func (o OutboxOptions) withDefaults() OutboxOptions {
+	if o.Table == "" {
+		o.Table = DefaultOutboxTable
+	}
+	if o.ProcessedTable == "" {
+		o.ProcessedTable = DefaultProcessedTable
+	}
+	if o.ArchiveTable == "" {
+		o.ArchiveTable = o.Table + "_archive"
+	}
+	return o
+}
+
+// qualify returns the identifier of a table of the outbox.
+func (o OutboxOptions) qualify(table string) types.Ident {
+	if o.Schema == "" {
+		return types.Ident(table)
+	}
+	return types.Ident(o.Schema + "." + table)
+}
+
+// EventFilter narrows down outbox events by topic, subscriber and status, and pages through them by ID.
+type EventFilter struct {
+	Topic      string    // Topic matches a single topic, all topics are matched when empty.
+	Subscriber string    // Subscriber matches a single subscription, all subscriptions are matched when empty.
+	Status     AckStatus // Status matches a single status, all statuses are matched when empty.
+	AfterID    int       // AfterID is the exclusive lower bound of the event IDs, the last ID of the previous page.
+	Limit      int       // Limit caps the number of listed events, unlimited when zero.
+}
+
+// apply adds the filter conditions to a query over events.
+func (f EventFilter) apply(q *orm.Query) (*orm.Query, error) {
+	if f.Topic != "" {
+		q = q.Where("topic = ?", f.Topic)
+	}
+	if f.Subscriber != "" {
+		q = q.Where("subscriber = ?", f.Subscriber)
+	}
+	if f.Status != "" {
+		q = q.Where("ack_status = ?", f.Status)
+	}
+	if f.AfterID > 0 {
+		q = q.Where("id > ?", f.AfterID)
+	}
+	if f.Limit > 0 {
+		q = q.Limit(f.Limit)
+	}
+
+	return q, nil
+}
+
+// TopicEventStats counts the events of a topic that are not acknowledged yet.
+type TopicEventStats struct {
+	Topic         string
+	Pending       int   // Pending is the number of events not attempted yet.
+	Failed        int   // Failed is the number of events waiting for a retry.
+	Dead          int   // Dead is the number of dead-lettered events.
+	OldestPending int64 // OldestPending is the creation Unix timestamp of the oldest pending or failed event, 0 when none.
+}
+
+// AckedFilter narrows down acknowledged events by topic and the time they were acknowledged.
+type AckedFilter struct {
+	Topic         string    // Topic matches a single topic, all topics are matched when empty.
+	ExcludeTopics []string  // ExcludeTopics are never matched.
+	Before        time.Time // Before is the exclusive upper bound of the acknowledgement time.
+}
+
+// apply adds the filter conditions to a query over acknowledged events.
+func (f AckedFilter) apply(q *orm.Query) (*orm.Query, error) {
+	q = q.Where("ack_status = ?", ACK).
+		Where("updated_at < ?", f.Before.Unix())
+
+	if f.Topic != "" {
+		q = q.Where("topic = ?", f.Topic)
+	}
+	if len(f.ExcludeTopics) > 0 {
+		q = q.Where("topic NOT IN (?)", pg.In(f.ExcludeTopics))
+	}
+
+	return q, nil
+}
+
+// OutboxStore persists the events of the bus, see Testable.
+// OutboxRepository is the store of the outbox tables, the queuetest package has an in-memory one.
+type OutboxStore interface {
+	InsertEvents(ctx context.Context, events []*OutboxEvent, dedupWindow time.Duration) error
+	LoadPendingEvents(ctx context.Context) ([]*OutboxEvent, error)
+	GetEvent(ctx context.Context, eventID int) (*OutboxEvent, error)
+	UpdateEventStatus(ctx context.Context, event *OutboxEvent) error
+	UpdateEventStatuses(ctx context.Context, events []*OutboxEvent) error
+	MarkEventAsProcessed(ctx context.Context, eventID int) error
+	MarkEventsAsProcessed(ctx context.Context, eventIDs []int) error
+	MarkEventAsDead(ctx context.Context, eventID int, lastError string) error
+	MarkEventsAsDead(ctx context.Context, events []*OutboxEvent) error
+
+	LoadDeadEvents(ctx context.Context, filter DeadLetterFilter) ([]*OutboxEvent, error)
+	ReviveDeadEvents(ctx context.Context, filter DeadLetterFilter) ([]*OutboxEvent, error)
+	ReviveDeadEvent(ctx context.Context, eventID int) (*OutboxEvent, error)
+	DeleteDeadEvents(ctx context.Context, filter DeadLetterFilter) (int, error)
+
+	ClaimEvents(ctx context.Context, owner string, limit int, lease time.Duration, excludeTopics ...string) ([]*OutboxEvent, error)
+	ExtendLeases(ctx context.Context, owner string, eventIDs []int, lease time.Duration) error
+	ReleaseLeases(ctx context.Context, owner string, eventIDs []int, until time.Time) error
+	OldestPendingEvents(ctx context.Context) (map[string]time.Time, error)
+
+	MarkProcessed(ctx context.Context, event *ProcessedEvent) (bool, error)
+	DeleteProcessedEvents(ctx context.Context, before time.Time, limit int) (int, error)
+	DeleteAckedEvents(ctx context.Context, filter AckedFilter, limit int) (int, error)
+	ArchiveAckedEvents(ctx context.Context, filter AckedFilter, limit int) (int, error)
+
+	ListEvents(ctx context.Context, filter EventFilter) ([]*OutboxEvent, error)
+	DeleteEvent(ctx context.Context, eventID int) error
+	EventStats(ctx context.Context) ([]*TopicEventStats, error)
 }
 
 // OutboxRepository provides methods to interact with the outbox table.
 type OutboxRepository struct {
 	transactionFactory transactions.TransactionFactory
+	table              types.Ident // table is the outbox table.
+	processedTable     types.Ident // processedTable is the processed events table.
+	archiveTable       types.Ident // archiveTable is the archive of acknowledged events.
+}
+
+// NewOutboxRepository creates a new OutboxRepository. Only the first of opts is taken into account.
+func NewOutboxRepository(transactionFactory transactions.TransactionFactory, opts ...OutboxOptions) *OutboxRepository {
+	var opt OutboxOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	opt = opt.withDefaults()
+
+	return &OutboxRepository{
+		transactionFactory: transactionFactory,
+		table:              opt.qualify(opt.Table),
+		processedTable:     opt.qualify(opt.ProcessedTable),
+		archiveTable:       opt.qualify(opt.ArchiveTable),
+	}
 }
 
-// NewOutboxRepository creates a new OutboxRepository.
-func NewOutboxRepository(transactionFactory transactions.TransactionFactory) *OutboxRepository {
-	return &OutboxRepository{transactionFactory: transactionFactory}
+// model starts a query on the outbox table within the transaction found in ctx.
+func (r *OutboxRepository) model(ctx context.Context, model ...interface{}) *orm.Query {
+	return r.query(r.transactionFactory.Transaction(ctx), model...)
 }
 
-// InsertEvent inserts a new event into the outbox table or updates it if it already exists.
-func (r *OutboxRepository) InsertEvent(ctx context.Context, event *OutboxEvent) error {
-	_, err := r.transactionFactory.Transaction(ctx).
-		Model(event).
-		OnConflict("(data, topic) DO UPDATE").
-		Set("retry = EXCLUDED.retry, next_retry = EXCLUDED.next_retry, ack_status = EXCLUDED.ack_status, updated_at = EXCLUDED.updated_at").
-		Returning("*").
-		Insert()
-	if err != nil {
-		return fmt.Errorf("insert event into outbox: %w", err)
+// query starts a query on the outbox table within tx.
+// The models have no table of their own, the configured one is set on every query.
+func (r *OutboxRepository) query(tx transactions.Transaction, model ...interface{}) *orm.Query {
+	return tx.Model(model...).TableExpr("?", r.table)
+}
+
+// InsertEvent inserts a new event into the outbox table, see InsertEvents.
+func (r *OutboxRepository) InsertEvent(ctx context.Context, event *OutboxEvent, dedupWindow time.Duration) error {
+	return r.InsertEvents(ctx, []*OutboxEvent{event}, dedupWindow)
+}
+
+// InsertEvents inserts several events into the outbox table and sets their IDs.
+//
+// Events with a dedup key are skipped, keeping a zero ID, when an event with the same topic, subscriber
+// and key was inserted within the dedup window, whatever its status, or is still pending. Rows already in the table
+// are never modified apart from forgetting the dedup keys older than the window of rows no longer pending: a pending
+// row keeps its key, which its Idempotent handlers record as processed. It relies on a partial unique index
+// on (topic, subscriber, dedup_key) covering the rows with a non-empty dedup key.
+func (r *OutboxRepository) InsertEvents(ctx context.Context, events []*OutboxEvent, dedupWindow time.Duration) error {
+	tx := r.transactionFactory.Transaction(ctx)
+
+	var (
+		plain  []*OutboxEvent
+		keyed  []*OutboxEvent
+		topics = make(map[string][]string)
+	)
+	for _, event := range events {
+		if event.DedupKey == "" {
+			plain = append(plain, event)
+			continue
+		}
+		keyed = append(keyed, event)
+		topics[event.Topic] = append(topics[event.Topic], event.DedupKey)
+	}
+
+	if len(plain) > 0 {
+		if _, err := r.query(tx, &plain).Returning("*").Insert(); err != nil {
+			return fmt.Errorf("insert events into outbox: %w", err)
+		}
 	}
+
+	if len(keyed) == 0 {
+		return nil
+	}
+
+	expired := time.Now().Add(-dedupWindow).Unix()
+	for topic, keys := range topics {
+		_, err := r.query(tx, (*OutboxEvent)(nil)).
+			Set("dedup_key = ''").
+			Where("topic = ?", topic).
+			Where("dedup_key IN (?)", pg.In(keys)).
+			Where("created_at < ?", expired).
+			Where("ack_status <> ?", NACK).
+			Update()
+		if err != nil {
+			return fmt.Errorf("expire dedup keys in outbox: %w", err)
+		}
+	}
+
+	for _, event := range keyed {
+		_, err := r.query(tx, event).
+			OnConflict("(topic, subscriber, dedup_key) WHERE dedup_key <> '' DO NOTHING").
+			Returning("*").
+			Insert()
+		// a single model with RETURNING expects a row, a skipped duplicate yields no rows
+		if errors.Is(err, pg.ErrNoRows) {
+			event.ID = 0
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("insert event into outbox: %w", err)
+		}
+	}
+
 	return nil
 }
 
 // LoadPendingEvents loads all pending events from the outbox table.
 func (r *OutboxRepository) LoadPendingEvents(ctx context.Context) ([]*OutboxEvent, error) {
 	var events []*OutboxEvent
-	query := r.transactionFactory.Transaction(ctx).
-		Model(&events).
-		Where("ack_status = ?", NACK)
+	query := r.model(ctx, &events).
+		Where("ack_status = ?", NACK).
+		Order("id ASC")
 
 	if err := query.Select(); err != nil {
 		return nil, fmt.Errorf("load pending events from outbox: %w", err)
@@ -58,9 +319,8 @@ func (r *OutboxRepository) LoadPendingEvents(ctx context.Context) ([]*OutboxEven
 
 // UpdateEventStatus updates the status and retry count of an event in the outbox table.
 func (r *OutboxRepository) UpdateEventStatus(ctx context.Context, event *OutboxEvent) error {
-	_, err := r.transactionFactory.Transaction(ctx).
-		Model(event).
-		Column("retry", "next_retry", "ack_status").
+	_, err := r.model(ctx, event).
+		Column("retry", "next_retry", "available_at", "ack_status", "last_error").
 		Where("id = ?", event.ID).
 		Update()
 	if err != nil {
@@ -71,9 +331,9 @@ func (r *OutboxRepository) UpdateEventStatus(ctx context.Context, event *OutboxE
 
 // MarkEventAsProcessed marks an event as processed in the outbox table.
 func (r *OutboxRepository) MarkEventAsProcessed(ctx context.Context, eventID int) error {
-	_, err := r.transactionFactory.Transaction(ctx).
-		Model(&OutboxEvent{}).
+	_, err := r.model(ctx, &OutboxEvent{}).
 		Set("ack_status = ?", ACK).
+		Set("updated_at = ?", time.Now().Unix()).
 		Where("id = ?", eventID).
 		Update()
 	if err != nil {
@@ -82,10 +342,62 @@ func (r *OutboxRepository) MarkEventAsProcessed(ctx context.Context, eventID int
 	return nil
 }
 
+// UpdateEventStatuses updates the status and retry count of events in the outbox table with a single statement.
+func (r *OutboxRepository) UpdateEventStatuses(ctx context.Context, events []*OutboxEvent) error {
+	ids := make([]int, len(events))
+	retries := make([]int, len(events))
+	nextRetries := make([]int64, len(events))
+	availableAt := make([]int64, len(events))
+	statuses := make([]string, len(events))
+	lastErrors := make([]string, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+		retries[i] = event.Retry
+		nextRetries[i] = int64(event.NextRetry)
+		availableAt[i] = event.AvailableAt
+		statuses[i] = string(event.AckStatus)
+		lastErrors[i] = event.LastError
+	}
+
+	_, err := r.transactionFactory.Transaction(ctx).ExecContext(ctx, `UPDATE ? AS outbox_event SET
+			retry = data.retry,
+			next_retry = data.next_retry,
+			available_at = data.available_at,
+			ack_status = data.ack_status,
+			last_error = data.last_error
+		FROM (SELECT
+			unnest(?::bigint[]) AS id,
+			unnest(?::integer[]) AS retry,
+			unnest(?::bigint[]) AS next_retry,
+			unnest(?::bigint[]) AS available_at,
+			unnest(?::text[]) AS ack_status,
+			unnest(?::text[]) AS last_error
+		) AS data
+		WHERE outbox_event.id = data.id`,
+		r.table, pg.Array(ids), pg.Array(retries), pg.Array(nextRetries), pg.Array(availableAt),
+		pg.Array(statuses), pg.Array(lastErrors))
+	if err != nil {
+		return fmt.Errorf("update event statuses in outbox: %w", err)
+	}
+	return nil
+}
+
+// MarkEventsAsProcessed marks events as processed in the outbox table.
+func (r *OutboxRepository) MarkEventsAsProcessed(ctx context.Context, eventIDs []int) error {
+	_, err := r.model(ctx, &OutboxEvent{}).
+		Set("ack_status = ?", ACK).
+		Set("updated_at = ?", time.Now().Unix()).
+		Where("id IN (?)", pg.In(eventIDs)).
+		Update()
+	if err != nil {
+		return fmt.Errorf("mark events as processed in outbox: %w", err)
+	}
+	return nil
+}
+
 // MarkEventAsFailed marks an event as failed in the outbox table.
 func (r *OutboxRepository) MarkEventAsFailed(ctx context.Context, eventID int) error {
-	_, err := r.transactionFactory.Transaction(ctx).
-		Model(&OutboxEvent{}).
+	_, err := r.model(ctx, &OutboxEvent{}).
 		Set("ack_status = ?", NACK).
 		Where("id = ?", eventID).
 		Update()
@@ -94,3 +406,352 @@ func (r *OutboxRepository) MarkEventAsFailed(ctx context.Context, eventID int) e
 	}
 	return nil
 }
+
+// MarkEventAsDead moves an event to dead letters in the outbox table, keeping the error of its last attempt.
+func (r *OutboxRepository) MarkEventAsDead(ctx context.Context, eventID int, lastError string) error {
+	now := time.Now().Unix()
+
+	_, err := r.model(ctx, &OutboxEvent{}).
+		Set("ack_status = ?", DEAD).
+		Set("last_error = ?", lastError).
+		Set("failed_at = ?", now).
+		Set("updated_at = ?", now).
+		Where("id = ?", eventID).
+		Update()
+	if err != nil {
+		return fmt.Errorf("mark event as dead in outbox: %w", err)
+	}
+	return nil
+}
+
+// MarkEventsAsDead moves events to dead letters in the outbox table with a single statement,
+// keeping the error of their last attempt.
+func (r *OutboxRepository) MarkEventsAsDead(ctx context.Context, events []*OutboxEvent) error {
+	ids := make([]int, len(events))
+	lastErrors := make([]string, len(events))
+	for i, event := range events {
+		ids[i] = event.ID
+		lastErrors[i] = event.LastError
+	}
+
+	now := time.Now().Unix()
+	_, err := r.transactionFactory.Transaction(ctx).ExecContext(ctx, `UPDATE ? AS outbox_event SET
+			ack_status = ?,
+			last_error = data.last_error,
+			failed_at = ?,
+			updated_at = ?
+		FROM (SELECT unnest(?::bigint[]) AS id, unnest(?::text[]) AS last_error) AS data
+		WHERE outbox_event.id = data.id`,
+		r.table, DEAD, now, now, pg.Array(ids), pg.Array(lastErrors))
+	if err != nil {
+		return fmt.Errorf("mark events as dead in outbox: %w", err)
+	}
+	return nil
+}
+
+// GetEvent loads a single event from the outbox table by its ID.
+func (r *OutboxRepository) GetEvent(ctx context.Context, eventID int) (*OutboxEvent, error) {
+	event := &OutboxEvent{}
+	err := r.model(ctx, event).
+		Where("id = ?", eventID).
+		Select()
+	if errors.Is(err, pg.ErrNoRows) {
+		return nil, ErrEventNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get event from outbox: %w", err)
+	}
+	return event, nil
+}
+
+// LoadDeadEvents loads dead-lettered events matching the filter, oldest failures first.
+func (r *OutboxRepository) LoadDeadEvents(ctx context.Context, filter DeadLetterFilter) ([]*OutboxEvent, error) {
+	var events []*OutboxEvent
+	query := r.model(ctx, &events).
+		Apply(filter.apply).
+		Order("failed_at ASC", "id ASC")
+
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+
+	if err := query.Select(); err != nil {
+		return nil, fmt.Errorf("load dead events from outbox: %w", err)
+	}
+	return events, nil
+}
+
+// ReviveDeadEvents resets the retry state of dead-lettered events matching the filter and returns them.
+func (r *OutboxRepository) ReviveDeadEvents(ctx context.Context, filter DeadLetterFilter) ([]*OutboxEvent, error) {
+	var events []*OutboxEvent
+	_, err := r.model(ctx, (*OutboxEvent)(nil)).
+		Set("retry = 0").
+		Set("next_retry = 0").
+		Set("available_at = 0").
+		Set("ack_status = ?", NACK).
+		Set("failed_at = 0").
+		Set("lease_owner = ''").
+		Set("lease_until = 0").
+		Set("updated_at = ?", time.Now().Unix()).
+		Apply(filter.apply).
+		Returning("*").
+		Update(&events)
+	if err != nil {
+		return nil, fmt.Errorf("revive dead events in outbox: %w", err)
+	}
+	return events, nil
+}
+
+// ReviveDeadEvent resets the retry state of a single dead-lettered event and returns it.
+func (r *OutboxRepository) ReviveDeadEvent(ctx context.Context, eventID int) (*OutboxEvent, error) {
+	event := &OutboxEvent{}
+	_, err := r.model(ctx, event).
+		Set("retry = 0").
+		Set("next_retry = 0").
+		Set("available_at = 0").
+		Set("ack_status = ?", NACK).
+		Set("failed_at = 0").
+		Set("lease_owner = ''").
+		Set("lease_until = 0").
+		Set("updated_at = ?", time.Now().Unix()).
+		Where("id = ?", eventID).
+		Where("ack_status = ?", DEAD).
+		Returning("*").
+		Update()
+	// a single model with RETURNING expects a row, a missing or live event yields no rows
+	if errors.Is(err, pg.ErrNoRows) {
+		return nil, ErrEventNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("revive dead event in outbox: %w", err)
+	}
+	return event, nil
+}
+
+// DeleteDeadEvents deletes dead-lettered events matching the filter and returns the number of deleted rows.
+func (r *OutboxRepository) DeleteDeadEvents(ctx context.Context, filter DeadLetterFilter) (int, error) {
+	res, err := r.model(ctx, (*OutboxEvent)(nil)).
+		Apply(filter.apply).
+		Delete()
+	if err != nil {
+		return 0, fmt.Errorf("delete dead events from outbox: %w", err)
+	}
+	return res.RowsAffected(), nil
+}
+
+// ClaimEvents leases up to limit pending events that are not leased by anyone else to the owner and returns them.
+// Rows locked by concurrent claims are skipped, so several instances can poll the same table.
+// Events with an ordering key are only claimed once no earlier event with the key is pending for their subscriber.
+// Events of the excluded topics are not claimed.
+func (r *OutboxRepository) ClaimEvents(
+	ctx context.Context,
+	owner string,
+	limit int,
+	lease time.Duration,
+	excludeTopics ...string,
+) ([]*OutboxEvent, error) {
+	tx := r.transactionFactory.Transaction(ctx)
+	now := time.Now()
+
+	due := r.query(tx, (*OutboxEvent)(nil)).
+		Column("id").
+		Where("ack_status = ?", NACK).
+		Where("lease_until <= ?", now.Unix()).
+		Where("available_at <= ?", now.UnixMilli()).
+		Where("ordering_key = '' OR NOT EXISTS (SELECT 1 FROM ? AS earlier "+
+			"WHERE earlier.topic = outbox_event.topic AND earlier.subscriber = outbox_event.subscriber "+
+			"AND earlier.ordering_key = outbox_event.ordering_key AND earlier.ack_status = ? "+
+			"AND earlier.id < outbox_event.id)", r.table, NACK).
+		Order("id ASC").
+		Limit(limit).
+		For("UPDATE SKIP LOCKED")
+	if len(excludeTopics) > 0 {
+		due = due.Where("topic NOT IN (?)", pg.In(excludeTopics))
+	}
+
+	var events []*OutboxEvent
+	_, err := r.query(tx, (*OutboxEvent)(nil)).
+		Set("lease_owner = ?", owner).
+		Set("lease_until = ?", now.Add(lease).Unix()).
+		Where("id IN (?)", due).
+		Returning("*").
+		Update(&events)
+	if err != nil {
+		return nil, fmt.Errorf("claim events from outbox: %w", err)
+	}
+	return events, nil
+}
+
+// ExtendLeases prolongs the leases the owner holds on the given events.
+func (r *OutboxRepository) ExtendLeases(ctx context.Context, owner string, eventIDs []int, lease time.Duration) error {
+	_, err := r.model(ctx, (*OutboxEvent)(nil)).
+		Set("lease_until = ?", time.Now().Add(lease).Unix()).
+		Where("id IN (?)", pg.In(eventIDs)).
+		Where("lease_owner = ?", owner).
+		Update()
+	if err != nil {
+		return fmt.Errorf("extend leases in outbox: %w", err)
+	}
+	return nil
+}
+
+// ReleaseLeases gives up the leases the owner holds on the given events, they can be claimed again from until on.
+func (r *OutboxRepository) ReleaseLeases(ctx context.Context, owner string, eventIDs []int, until time.Time) error {
+	_, err := r.model(ctx, (*OutboxEvent)(nil)).
+		Set("lease_owner = ''").
+		Set("lease_until = ?", until.Unix()).
+		Where("id IN (?)", pg.In(eventIDs)).
+		Where("lease_owner = ?", owner).
+		Update()
+	if err != nil {
+		return fmt.Errorf("release leases in outbox: %w", err)
+	}
+	return nil
+}
+
+// OldestPendingEvents returns, per topic, the moment the oldest due pending event became available.
+// It backs the outbox backlog age metric.
+func (r *OutboxRepository) OldestPendingEvents(ctx context.Context) (map[string]time.Time, error) {
+	var rows []struct {
+		Topic  string
+		Oldest int64
+	}
+
+	now := time.Now()
+	err := r.model(ctx, (*OutboxEvent)(nil)).
+		ColumnExpr("topic").
+		ColumnExpr("min(greatest(available_at, created_at * 1000)) AS oldest").
+		Where("ack_status = ?", NACK).
+		Where("available_at <= ?", now.UnixMilli()).
+		Group("topic").
+		Select(&rows)
+	if err != nil {
+		return nil, fmt.Errorf("load oldest pending events from outbox: %w", err)
+	}
+
+	oldest := make(map[string]time.Time, len(rows))
+	for _, row := range rows {
+		oldest[row.Topic] = fromUnixMilli(row.Oldest)
+	}
+	return oldest, nil
+}
+
+// ProcessedEvent records that a subscription handled an event, see EventBus.MarkProcessed.
+type ProcessedEvent struct {
+	tableName struct{} `pg:"_,alias:processed_event"` // the table is set on every query by OutboxRepository
+
+	Topic       string `pg:"topic,pk"`      // Topic column
+	Subscriber  string `pg:"subscriber,pk"` // Subscriber column, the subscription that handled the event
+	Key         string `pg:"key,pk"`        // Key column, the dedup key of the event or its outbox ID
+	ProcessedAt int64  `pg:"processed_at"`  // ProcessedAt column as Unix timestamp
+}
+
+// MarkProcessed inserts the processed event unless it already exists and reports whether it was inserted.
+func (r *OutboxRepository) MarkProcessed(ctx context.Context, event *ProcessedEvent) (bool, error) {
+	res, err := r.transactionFactory.Transaction(ctx).
+		Model(event).
+		TableExpr("?", r.processedTable).
+		OnConflict("DO NOTHING").
+		Insert()
+	if err != nil {
+		return false, fmt.Errorf("mark event as processed: %w", err)
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// DeleteProcessedEvents deletes up to limit records of events processed before the given time and returns
+// the number of deleted rows. Rows locked by concurrent deletions are skipped.
+func (r *OutboxRepository) DeleteProcessedEvents(ctx context.Context, before time.Time, limit int) (int, error) {
+	res, err := r.transactionFactory.Transaction(ctx).ExecContext(ctx, "DELETE FROM ? WHERE (topic, subscriber, key) IN "+
+		"(SELECT topic, subscriber, key FROM ? WHERE processed_at < ? LIMIT ? FOR UPDATE SKIP LOCKED)",
+		r.processedTable, r.processedTable, before.Unix(), limit)
+	if err != nil {
+		return 0, fmt.Errorf("delete processed events: %w", err)
+	}
+	return res.RowsAffected(), nil
+}
+
+// DeleteAckedEvents deletes up to limit acknowledged events matching the filter and returns the number of deleted rows.
+// Rows locked by concurrent deletions are skipped.
+func (r *OutboxRepository) DeleteAckedEvents(ctx context.Context, filter AckedFilter, limit int) (int, error) {
+	tx := r.transactionFactory.Transaction(ctx)
+
+	res, err := r.query(tx, (*OutboxEvent)(nil)).
+		Where("id IN (?)", r.ackedBatch(tx, filter, limit)).
+		Delete()
+	if err != nil {
+		return 0, fmt.Errorf("delete acked events from outbox: %w", err)
+	}
+	return res.RowsAffected(), nil
+}
+
+// ArchiveAckedEvents moves up to limit acknowledged events matching the filter to the archive table
+// and returns the number of moved rows. Rows locked by concurrent moves are skipped.
+func (r *OutboxRepository) ArchiveAckedEvents(ctx context.Context, filter AckedFilter, limit int) (int, error) {
+	tx := r.transactionFactory.Transaction(ctx)
+
+	// the archive has the columns of the outbox table followed by archived_at, see Migrate
+	res, err := tx.ExecContext(ctx, "WITH moved AS (DELETE FROM ? WHERE id IN (?) RETURNING *) "+
+		"INSERT INTO ? SELECT moved.*, ? FROM moved",
+		r.table, r.ackedBatch(tx, filter, limit), r.archiveTable, time.Now().Unix())
+	if err != nil {
+		return 0, fmt.Errorf("archive acked events from outbox: %w", err)
+	}
+	return res.RowsAffected(), nil
+}
+
+// ackedBatch selects the IDs of up to limit acknowledged events matching the filter, locking their rows.
+func (r *OutboxRepository) ackedBatch(tx transactions.Transaction, filter AckedFilter, limit int) *orm.Query {
+	return r.query(tx, (*OutboxEvent)(nil)).
+		Column("id").
+		Apply(filter.apply).
+		Order("id ASC").
+		Limit(limit).
+		For("UPDATE SKIP LOCKED")
+}
+
+// ListEvents loads events matching the filter in the order of their IDs.
+func (r *OutboxRepository) ListEvents(ctx context.Context, filter EventFilter) ([]*OutboxEvent, error) {
+	var events []*OutboxEvent
+	err := r.model(ctx, &events).
+		Apply(filter.apply).
+		Order("id ASC").
+		Select()
+	if err != nil {
+		return nil, fmt.Errorf("list events from outbox: %w", err)
+	}
+	return events, nil
+}
+
+// DeleteEvent deletes a single event from the outbox table by its ID.
+func (r *OutboxRepository) DeleteEvent(ctx context.Context, eventID int) error {
+	res, err := r.model(ctx, (*OutboxEvent)(nil)).
+		Where("id = ?", eventID).
+		Delete()
+	if err != nil {
+		return fmt.Errorf("delete event from outbox: %w", err)
+	}
+	if res.RowsAffected() == 0 {
+		return ErrEventNotFound
+	}
+	return nil
+}
+
+// EventStats counts the events not acknowledged yet per topic.
+func (r *OutboxRepository) EventStats(ctx context.Context) ([]*TopicEventStats, error) {
+	var stats []*TopicEventStats
+	err := r.model(ctx, (*OutboxEvent)(nil)).
+		ColumnExpr("topic").
+		ColumnExpr("count(*) FILTER (WHERE ack_status = ? AND retry = 0) AS pending", NACK).
+		ColumnExpr("count(*) FILTER (WHERE ack_status = ? AND retry > 0) AS failed", NACK).
+		ColumnExpr("count(*) FILTER (WHERE ack_status = ?) AS dead", DEAD).
+		ColumnExpr("coalesce(min(created_at) FILTER (WHERE ack_status = ?), 0) AS oldest_pending", NACK).
+		Where("ack_status <> ?", ACK).
+		Group("topic").
+		Order("topic ASC").
+		Select(&stats)
+	if err != nil {
+		return nil, fmt.Errorf("load event stats from outbox: %w", err)
+	}
+	return stats, nil
+}
@@ -0,0 +1,333 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+)
+
+const defaultBreakerCooldown = 30 * time.Second
+
+// DefaultParkLimit is the number of events parked in memory per topic unless WithParkLimit is called.
+const DefaultParkLimit = 10000
+
+// errParkLimit is reported for events given up because their topic has too many parked events.
+var errParkLimit = errors.New("too many events parked for the topic")
+
+// MetricOpBreaker counts the state changes of the circuit breaker of a topic, the message is the new state.
+const MetricOpBreaker = "breaker"
+
+// BreakerState is the state of the circuit breaker of a topic.
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"    // BreakerClosed delivers events normally.
+	BreakerOpen     BreakerState = "open"      // BreakerOpen delivers nothing until the cool-down passes.
+	BreakerHalfOpen BreakerState = "half_open" // BreakerHalfOpen delivers a single probe event.
+)
+
+// BreakerOptions configures the circuit breaker pausing a topic whose handlers keep failing.
+type BreakerOptions struct {
+	Threshold int           // Threshold is the number of consecutive NACKs of the topic opening the breaker.
+	Cooldown  time.Duration // Cooldown is how long the breaker stays open before probing the topic, 30s when zero.
+}
+
+// topicGate holds the delivery state of a topic.
+type topicGate struct {
+	paused   bool         // paused is set by Pause.
+	state    BreakerState // state is the state of the circuit breaker.
+	failures int          // failures is the number of consecutive NACKs.
+	probe    *Event       // probe is the event handled as the probe of a half-open breaker, nil until one is.
+	parked   []*Event     // parked holds the events that arrived while the topic was not delivering.
+}
+
+// gates holds back the events of paused topics and of topics with an open circuit breaker.
+type gates struct {
+	lock    sync.Mutex
+	topics  map[string]*topicGate
+	breaker BreakerOptions
+	limit   int // limit is the number of events parked per topic.
+}
+
+func newGates() *gates {
+	return &gates{topics: make(map[string]*topicGate), limit: DefaultParkLimit}
+}
+
+// topic returns the gate of the topic, creating it on first use. The lock must be held.
+func (g *gates) topic(topic string) *topicGate {
+	t, ok := g.topics[topic]
+	if !ok {
+		t = &topicGate{state: BreakerClosed}
+		g.topics[topic] = t
+	}
+	return t
+}
+
+// held returns the number of parked events.
+func (g *gates) held() int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	held := 0
+	for _, t := range g.topics {
+		held += len(t.parked)
+	}
+	return held
+}
+
+// blocked returns the topics whose events must not be claimed from the outbox: the ones not delivering,
+// and the half-open ones while their probe is handled.
+func (g *gates) blocked() []string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	var topics []string
+	for topic, t := range g.topics {
+		if t.paused || t.state == BreakerOpen || t.probe != nil {
+			topics = append(topics, topic)
+		}
+	}
+	slices.Sort(topics)
+	return topics
+}
+
+// Pause stops delivering the events of the topic. Events keep being published, persisted and retried,
+// they wait without being handled until Resume is called: in the outbox with the relay, which does not claim them,
+// otherwise parked in memory up to the park limit, see WithParkLimit.
+func (bus *eventBus) Pause(topic string) {
+	bus.gates.lock.Lock()
+	defer bus.gates.lock.Unlock()
+
+	bus.gates.topic(topic).paused = true
+}
+
+// Resume delivers the events of a paused topic again, including the ones that arrived while it was paused.
+// The circuit breaker of the topic still applies.
+func (bus *eventBus) Resume(topic string) {
+	bus.gates.lock.Lock()
+	t := bus.gates.topic(topic)
+	t.paused = false
+	events := bus.unpark(t)
+	bus.gates.lock.Unlock()
+
+	bus.redeliver(events)
+}
+
+// Paused reports whether the topic delivers nothing, because of Pause or of its open circuit breaker.
+func (bus *eventBus) Paused(topic string) bool {
+	bus.gates.lock.Lock()
+	defer bus.gates.lock.Unlock()
+
+	t, ok := bus.gates.topics[topic]
+	return ok && (t.paused || t.state == BreakerOpen)
+}
+
+// WithCircuitBreaker pauses a topic once its handlers NACK Threshold events in a row. After the cool-down
+// a single event of the topic is handled as a probe: an ACK resumes the topic, a NACK pauses it again.
+// A Threshold of zero disables the breaker.
+func (bus *eventBus) WithCircuitBreaker(opts BreakerOptions) {
+	if opts.Cooldown <= 0 {
+		opts.Cooldown = defaultBreakerCooldown
+	}
+
+	bus.gates.lock.Lock()
+	defer bus.gates.lock.Unlock()
+
+	bus.gates.breaker = opts
+}
+
+// WithParkLimit sets the number of events of a paused topic, or of one with an open circuit breaker,
+// held in memory, DefaultParkLimit by default. Events over the limit are given up: one saved to the outbox
+// is left there and handled once loaded on the next start, any other is dropped.
+func (bus *eventBus) WithParkLimit(limit int) {
+	if limit <= 0 {
+		return
+	}
+
+	bus.gates.lock.Lock()
+	defer bus.gates.lock.Unlock()
+
+	bus.gates.limit = limit
+}
+
+// park holds the event back when its topic is not delivering and reports whether it did. The first event let through
+// by a half-open breaker becomes its probe, checking the probe again lets it through. With the relay, an event saved
+// to the outbox is not kept in memory, its lease is released instead and the relay claims it again once the topic
+// delivers.
+func (bus *eventBus) park(ctx context.Context, event *Event) bool {
+	bus.gates.lock.Lock()
+
+	t, ok := bus.gates.topics[event.Topic]
+	if !ok {
+		bus.gates.lock.Unlock()
+		return false
+	}
+
+	switch {
+	case t.paused, t.state == BreakerOpen:
+	case t.state == BreakerHalfOpen && (t.probe == nil || t.probe == event):
+		t.probe = event
+		bus.gates.lock.Unlock()
+		return false
+	case t.state == BreakerHalfOpen:
+	default:
+		bus.gates.lock.Unlock()
+		return false
+	}
+
+	claimed := bus.relay != nil && event.ID != 0
+	full := len(t.parked) >= bus.gates.limit
+	if !claimed && !full {
+		t.parked = append(t.parked, event)
+	}
+	bus.gates.lock.Unlock()
+
+	switch {
+	case claimed:
+		bus.rescheduleEvent(ctx, event)
+	case full:
+		bus.reject(ctx, event, errParkLimit)
+	}
+	return true
+}
+
+// unpark returns the parked events of the topic that may be delivered: all of them once the topic delivers again,
+// the first one as the probe of a half-open breaker. The lock must be held.
+func (bus *eventBus) unpark(t *topicGate) []*Event {
+	var events []*Event
+
+	switch {
+	case t.paused:
+	case t.state == BreakerClosed:
+		events, t.parked = t.parked, nil
+	case t.state == BreakerHalfOpen && t.probe == nil && len(t.parked) > 0:
+		events, t.parked = t.parked[:1], t.parked[1:]
+	}
+
+	return events
+}
+
+// redeliver puts events back into the queue, giving up once the bus drains.
+func (bus *eventBus) redeliver(events []*Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	bus.inflight.Add(int64(len(events)))
+	go func() {
+		for _, event := range events {
+			select {
+			case bus.queue <- event:
+			case <-bus.drain:
+				bus.inflight.Add(-1)
+				bus.gates.lock.Lock()
+				t := bus.gates.topic(event.Topic)
+				t.parked = append(t.parked, event)
+				bus.gates.lock.Unlock()
+			}
+		}
+	}()
+}
+
+// probeKey marks the ctx of the worker handling the probe of a half-open breaker, so the deliveries
+// the probe is split into count as the probe too.
+type probeKey struct{}
+
+// withProbe marks ctx when the event is the probe of the half-open breaker of its topic.
+func (bus *eventBus) withProbe(ctx context.Context, event *Event) context.Context {
+	bus.gates.lock.Lock()
+	defer bus.gates.lock.Unlock()
+
+	if t, ok := bus.gates.topics[event.Topic]; ok && t.probe == event {
+		return context.WithValue(ctx, probeKey{}, event)
+	}
+	return ctx
+}
+
+// recordOutcome feeds the circuit breaker of the topic of the event with the status returned by a handler. Events
+// rejected with DEAD say nothing about the health of the topic, except for the probe, which got an answer. While the
+// breaker is half-open only the outcome of the probe counts, events handled before it opened are ignored.
+func (bus *eventBus) recordOutcome(ctx context.Context, event *Event, handled AckStatus) {
+	bus.gates.lock.Lock()
+
+	opts := bus.gates.breaker
+	if opts.Threshold <= 0 {
+		bus.gates.lock.Unlock()
+		return
+	}
+
+	topic := event.Topic
+	t := bus.gates.topic(topic)
+	if t.state == BreakerHalfOpen {
+		probe, _ := ctx.Value(probeKey{}).(*Event)
+		if t.probe == nil || event != t.probe && probe != t.probe {
+			bus.gates.lock.Unlock()
+			return
+		}
+	}
+
+	var (
+		state  BreakerState
+		events []*Event
+	)
+
+	switch {
+	case handled != NACK && t.state == BreakerHalfOpen:
+		t.state, t.probe, t.failures = BreakerClosed, nil, 0
+		state, events = BreakerClosed, bus.unpark(t)
+	case handled == ACK:
+		t.failures = 0
+	case handled == DEAD:
+	case t.state == BreakerHalfOpen:
+		t.state, t.probe = BreakerOpen, nil
+		state = BreakerOpen
+	case t.state == BreakerClosed:
+		t.failures++
+		if t.failures >= opts.Threshold {
+			t.state = BreakerOpen
+			state = BreakerOpen
+		}
+	}
+	bus.gates.lock.Unlock()
+
+	switch state {
+	case BreakerOpen:
+		bus.log.WarnCtx(ctx, "Circuit breaker of topic %s opened for %s", topic, opts.Cooldown)
+		bus.registry.Inc(series(topic, MetricOpBreaker).Info(string(BreakerOpen)))
+		go bus.cooldown(topic, bus.clockOf().NewTimer(opts.Cooldown))
+	case BreakerClosed:
+		bus.log.InfoCtx(ctx, "Circuit breaker of topic %s closed", topic)
+		bus.registry.Inc(series(topic, MetricOpBreaker).Info(string(BreakerClosed)))
+		bus.redeliver(events)
+	}
+}
+
+// cooldown probes the topic once the timer of the cool-down of its open breaker fires, unless the bus drains first.
+func (bus *eventBus) cooldown(topic string, timer Timer) {
+	defer timer.Stop()
+
+	select {
+	case <-timer.C():
+		bus.probe(topic)
+	case <-bus.drain:
+	}
+}
+
+// probe moves the open breaker of the topic to half-open, delivering one parked event as a probe.
+func (bus *eventBus) probe(topic string) {
+	bus.gates.lock.Lock()
+
+	t := bus.gates.topic(topic)
+	if t.state != BreakerOpen {
+		bus.gates.lock.Unlock()
+		return
+	}
+	t.state = BreakerHalfOpen
+	events := bus.unpark(t)
+	bus.gates.lock.Unlock()
+
+	bus.registry.Inc(series(topic, MetricOpBreaker).Info(string(BreakerHalfOpen)))
+	bus.redeliver(events)
+}
@@ -2,9 +2,14 @@ package queue
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"maps"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/gateway-fm/scriptorium/metrics"
 	"github.com/gateway-fm/scriptorium/transactions"
 
 	"github.com/gateway-fm/scriptorium/clog"
@@ -15,31 +20,136 @@ type AckStatus string
 const (
 	ACK  AckStatus = "ACK"  // message acknowledged, no need to retry.
 	NACK AckStatus = "NACK" // message not acknowledged, need to retry.
+	DEAD AckStatus = "DEAD" // message exhausted its retries or was rejected, moved to dead letters.
 )
 
 // Event represents a message or event that can be published to a topic within the EventBus.
 type Event struct {
-	ID        int           // ID is the identifier for the event in the database.
-	Data      []byte        // Data is the binary payload of the event.
-	Retry     int           // Retry indicates how many times this event has been retried.
-	Topic     string        // Topic is the name of the topic to which the event is published.
-	NextRetry time.Duration // NextRetry specifies the delay before the next retry attempt.
-	AckStatus AckStatus     // AckStatus specifies whether the message is done.
+	ID          int               // ID is the identifier for the event in the database.
+	Data        []byte            // Data is the binary payload of the event.
+	Retry       int               // Retry indicates how many times this event has been retried.
+	Topic       string            // Topic is the name of the topic to which the event is published.
+	NextRetry   time.Duration     // NextRetry specifies the delay before the next retry attempt.
+	AckStatus   AckStatus         // AckStatus specifies whether the message is done.
+	Subscriber  string            // Subscriber is the name of the subscription the event is delivered to.
+	LastError   string            // LastError is the error reported by the last failed handling attempt.
+	AvailableAt time.Time         // AvailableAt is the moment the event may be handled from, zero means right away.
+	CreatedAt   time.Time         // CreatedAt is the moment the event was published.
+	RetryAfter  time.Duration     // RetryAfter is a handler hint on when to retry the event, see SetRetryAfter.
+	Headers     map[string]string // Headers carry metadata of the publishing context, see Propagator.
+	OrderingKey string            // OrderingKey orders the event after earlier events with the same key, see PublishOptions.
+	DedupKey    string            // DedupKey identifies the event for deduplication, see PublishOptions.
+}
+
+// SetError records the reason of a failed handling attempt, it is stored along with the event in the outbox.
+func (e *Event) SetError(err error) {
+	if err == nil {
+		e.LastError = ""
+		return
+	}
+	e.LastError = err.Error()
+}
+
+// SetRetryAfter asks the bus to retry a NACKed event after the given delay instead of the one of the retry policy,
+// e.g. when an upstream responds with 429 and Retry-After. The policy still decides whether the event is retried.
+func (e *Event) SetRetryAfter(delay time.Duration) {
+	e.RetryAfter = delay
 }
 
 // EventHandler is a function type that processes an Event and returns an error if the processing fails.
 type EventHandler func(ctx context.Context, event *Event) AckStatus
 
+// SubscribeOptions holds optional settings for a topic subscription.
+type SubscribeOptions struct {
+	Name        string        // Name identifies the subscription within its topic, required with the outbox, see ErrUnnamedSubscription.
+	Concurrency int           // Concurrency limits in-flight events for the topic, the bus-wide limit is used when zero.
+	RetryPolicy RetryPolicy   // RetryPolicy replaces the delays passed to Subscribe when set.
+	Timeout     time.Duration // Timeout bounds every handler call, a call exceeding it is a failed attempt holding its worker until it returns.
+	Middlewares []Middleware  // Middlewares wrap the handler, inside the bus-wide middlewares registered with Use.
+
+	// RateLimit paces the deliveries of the subscription, or of the whole topic with RateLimit.PerTopic.
+	// MaxInFlight caps the deliveries of the subscription handled at once, unlimited when zero.
+	// Events over the limits wait in the bus, holding a worker of their topic, and are not failed attempts.
+	RateLimit   RateLimit
+	MaxInFlight int
+}
+
+// PublishOptions holds optional settings for a published event.
+type PublishOptions struct {
+	// OrderingKey makes the deliveries of events sharing the key to a subscription strictly ordered:
+	// an event is handled only once the previous event with the key, in publishing order, was acknowledged
+	// or dead-lettered, so a NACKed event holds back the later ones while it is retried.
+	// Events with different keys, or without a key, are handled in parallel.
+	OrderingKey string
+
+	// DedupKey identifies the event for deduplication: an event published with the key of an event published
+	// to the topic within the dedup window, or still pending, is dropped, see WithDedupWindow. Events without a key
+	// are never deduplicated. It needs the outbox.
+	DedupKey string
+
+	// Headers are added to the headers of the event, overriding the ones set by the propagators.
+	Headers map[string]string
+
+	// Backpressure overrides the policy of the bus for the event, see WithBackpressure.
+	Backpressure BackpressurePolicy
+}
+
+// ErrUnnamedSubscription is returned by StartProcessing when a subscription has no name while the outbox is configured.
+// Deliveries persisted in the outbox are routed by the name of their subscription, while the "<topic>#<index>" names
+// given by default depend on the order of the Subscribe calls, which may change between deploys or instances.
+var ErrUnnamedSubscription = errors.New("subscription has no name")
+
+// subscription is a named handler of a topic with its own delivery and retry state.
+type subscription struct {
+	name        string
+	unnamed     bool // unnamed is set when the name was given by default.
+	handler     EventHandler
+	policy      RetryPolicy
+	timeout     time.Duration
+	middlewares []Middleware
+	limiter     *tokenBucket  // limiter paces the deliveries of the subscription, nil when unlimited.
+	inFlight    chan struct{} // inFlight caps the deliveries handled at once, nil when unlimited.
+	batch       *batcher      // batch accumulates the deliveries of a batch subscription, nil for event handlers.
+}
+
 // eventBus implements the EventBus interface with support for topic-based subscriptions and event retries.
 type eventBus struct {
 	ctx      context.Context            // ctx is the base context for all operations.
 	cf       context.CancelFunc         // cf is a function to cancel the context, used for stopping the event processing.
 	log      *clog.CustomLogger         // log is a custom logger for logging information about event processing.
-	handlers map[string][]EventHandler  // handlers store a slice of event handlers for each topic.
-	delay    map[string][]time.Duration // delay specifies the retry delays for each topic.
+	handlers map[string][]*subscription // handlers store a slice of subscriptions for each topic.
 	queue    chan *Event                // queue is the channel through which events are published and processed.
-	lock     sync.RWMutex               // lock is used to synchronize access to handlers and delays.
-	outbox   *OutboxRepository
+	lock     sync.RWMutex               // lock is used to synchronize access to handlers and policies.
+	outbox   OutboxStore
+
+	workers     int                     // workers is the bus-wide limit of in-flight events.
+	sem         chan struct{}           // sem bounds the number of in-flight events across all topics.
+	concurrency map[string]int          // concurrency holds per-topic limits of in-flight events.
+	rateLimits  map[string]*tokenBucket // rateLimits holds the rate limits shared by the subscriptions of a topic.
+	pool        *workerPool             // pool runs the handlers of the current StartProcessing call.
+	relay       *relay                  // relay claims events from a shared outbox, nil unless WithRelay is called.
+	retention   *retention              // retention removes acknowledged events from the outbox, nil unless WithRetention is called.
+	propagators []Propagator            // propagators copy context values into event headers and back.
+	tracer      Tracer                  // tracer creates producer and consumer spans, nil disables tracing.
+	middlewares []Middleware            // middlewares wrap the handlers of every subscription.
+
+	backpressure BackpressurePolicy // backpressure applies when the queue is full, BackpressureBlock when empty.
+
+	registry        metrics.Registry // registry records the metrics of the bus, a no-op stub unless WithMetrics is called.
+	metricsInterval time.Duration    // metricsInterval is how often gauges are sampled, zero disables sampling.
+
+	closed        atomic.Bool         // closed is set once Shutdown is called.
+	closeOnce     sync.Once           // closeOnce guards closing drain.
+	drain         chan struct{}       // drain is closed once Shutdown is called.
+	scheduledLock sync.Mutex          // scheduledLock guards scheduled.
+	scheduled     map[*Event]struct{} // scheduled holds events waiting for their AvailableAt moment.
+	sequencer     *sequencer          // sequencer holds back events behind earlier events of their ordering key.
+	gates         *gates              // gates hold back the events of paused topics.
+	dedupWindow   time.Duration       // dedupWindow is how long dedup keys of published events are remembered.
+	clock         Clock               // clock drives delays and timers, the system clock unless WithClock is called.
+	waiting       atomic.Int64        // waiting counts the workers waiting for time to pass, see Idle.
+	load          outboxLoad          // load keeps the events dispatched by their publisher while the outbox is loaded.
+	inflight      atomic.Int64        // inflight counts the events on their way to a lane and the goroutines handing them over, see Idle.
 }
 
 // NewEventBus creates a new instance of an eventBus with a specified buffer size for the event queue and attaches a logger.
@@ -48,9 +158,23 @@ func NewEventBus(ctx context.Context, size int) EventBus {
 	return &eventBus{
 		ctx:      ctx,
 		cf:       cf,
-		handlers: make(map[string][]EventHandler),
-		delay:    make(map[string][]time.Duration),
+		handlers: make(map[string][]*subscription),
 		queue:    make(chan *Event, size),
+
+		workers:     DefaultConcurrency,
+		sem:         make(chan struct{}, DefaultConcurrency),
+		concurrency: make(map[string]int),
+		rateLimits:  make(map[string]*tokenBucket),
+		propagators: []Propagator{RequestPropagator{}},
+		registry:    metrics.NewRegistryStub(),
+
+		drain:     make(chan struct{}),
+		scheduled: make(map[*Event]struct{}),
+		sequencer: newSequencer(),
+		gates:     newGates(),
+
+		dedupWindow: DefaultDedupWindow,
+		clock:       SystemClock{},
 	}
 }
 
@@ -58,55 +182,325 @@ func (bus *eventBus) SetLogger(log *clog.CustomLogger) {
 	bus.log = log
 }
 
-func (bus *eventBus) WithOutbox(factory transactions.TransactionFactory) {
-	bus.outbox = NewOutboxRepository(factory)
+// WithOutbox persists events in the outbox tables named by opts, see Migrate for creating them.
+// Only the first of opts is taken into account.
+func (bus *eventBus) WithOutbox(factory transactions.TransactionFactory, opts ...OutboxOptions) {
+	bus.outbox = NewOutboxRepository(factory, opts...)
+}
+
+// WithOutboxStore persists events in the given store instead of the outbox tables, e.g. an in-memory store in tests.
+func (bus *eventBus) WithOutboxStore(store OutboxStore) {
+	bus.outbox = store
 }
 
 // Subscribe adds an event handler for a specific topic with predefined retry delays.
+// Only the first of opts is taken into account, its RetryPolicy takes precedence over delays.
+// Every subscription gets its own copy of each event and retries it independently of the other subscriptions.
+// Subscribing again with the name of an existing subscription replaces it.
 func (bus *eventBus) Subscribe(
 	topic string,
 	handler EventHandler,
 	delays []int,
 	durationType time.Duration,
+	opts ...SubscribeOptions,
+) {
+	bus.subscribe(topic, handler, nil, delays, durationType, opts...)
+}
+
+// subscribe adds a subscription handling events one by one with the handler, or in batches with the batcher.
+func (bus *eventBus) subscribe(
+	topic string,
+	handler EventHandler,
+	batch *batcher,
+	delays []int,
+	durationType time.Duration,
+	opts ...SubscribeOptions,
 ) {
 	bus.lock.Lock()
 	defer bus.lock.Unlock()
 
-	delaysDuration := make([]time.Duration, len(delays))
+	var opt SubscribeOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+
+	sub := &subscription{
+		name:        opt.Name,
+		handler:     handler,
+		policy:      opt.RetryPolicy,
+		timeout:     opt.Timeout,
+		middlewares: opt.Middlewares,
+		batch:       batch,
+	}
+	if sub.name == "" {
+		sub.name = fmt.Sprintf("%s#%d", topic, len(bus.handlers[topic]))
+		sub.unnamed = true
+	}
+	if sub.policy == nil {
+		sub.policy = NewDelaysPolicy(delays, durationType)
+	}
+
+	if opt.Concurrency > 0 {
+		bus.concurrency[topic] = opt.Concurrency
+	}
+	if opt.RateLimit.PerTopic {
+		bus.rateLimits[topic] = newTokenBucket(opt.RateLimit, bus.clock.Now())
+	} else {
+		sub.limiter = newTokenBucket(opt.RateLimit, bus.clock.Now())
+	}
+	if opt.MaxInFlight > 0 {
+		sub.inFlight = make(chan struct{}, opt.MaxInFlight)
+	}
+
+	for i, existing := range bus.handlers[topic] {
+		if existing.name == sub.name {
+			bus.handlers[topic][i] = sub
+			return
+		}
+	}
+
+	bus.handlers[topic] = append(bus.handlers[topic], sub)
+}
+
+// unnamedSubscription returns the topic of a subscription named by default, if any.
+func (bus *eventBus) unnamedSubscription() (string, bool) {
+	bus.lock.RLock()
+	defer bus.lock.RUnlock()
 
-	for index, delay := range delays {
-		delaysDuration[index] = time.Duration(delay) * durationType
+	for topic, subs := range bus.handlers {
+		for _, sub := range subs {
+			if sub.unnamed {
+				return topic, true
+			}
+		}
 	}
+	return "", false
+}
+
+// subscriptions returns the subscriptions of a topic.
+func (bus *eventBus) subscriptions(topic string) []*subscription {
+	bus.lock.RLock()
+	defer bus.lock.RUnlock()
+
+	return append([]*subscription(nil), bus.handlers[topic]...)
+}
+
+// subscription returns the subscription of a topic with the given name, or nil.
+func (bus *eventBus) subscription(topic, name string) *subscription {
+	bus.lock.RLock()
+	defer bus.lock.RUnlock()
+
+	for _, sub := range bus.handlers[topic] {
+		if sub.name == name {
+			return sub
+		}
+	}
+
+	return nil
+}
+
+// deliveries splits an event into one delivery per subscription of its topic.
+// An event of a topic without subscriptions is returned as is, it is split once it is handled.
+func (bus *eventBus) deliveries(event *Event) []*Event {
+	subs := bus.subscriptions(event.Topic)
+	if len(subs) == 0 {
+		return []*Event{event}
+	}
+
+	deliveries := make([]*Event, len(subs))
+	for i, sub := range subs {
+		delivery := *event
+		delivery.ID = 0
+		delivery.Subscriber = sub.name
+		delivery.Headers = maps.Clone(event.Headers)
+		deliveries[i] = &delivery
+	}
+
+	return deliveries
+}
+
+// Publish publishes an event to the topic within the context of the bus. See PublishCtx.
+func (bus *eventBus) Publish(topic string, data []byte, opts ...PublishOptions) error {
+	return bus.PublishCtx(bus.ctx, topic, data, opts...)
+}
 
-	bus.handlers[topic] = append(bus.handlers[topic], handler)
-	bus.delay[topic] = delaysDuration
+// PublishCtx publishes an event to the topic. The outbox row is written through the transaction found in ctx,
+// and the event is dispatched in memory only after that transaction is committed,
+// so a rolled back transaction never delivers its events.
+// Only the first of opts is taken into account.
+//
+// A full queue is handled according to the backpressure policy, see WithBackpressure. An event rejected by it
+// is reported with ErrQueueFull, unless the event was persisted to the outbox and is only dispatched later.
+// Events published within a transaction are dispatched after the commit, a rejection is only logged then.
+func (bus *eventBus) PublishCtx(ctx context.Context, topic string, data []byte, opts ...PublishOptions) error {
+	return bus.PublishAt(ctx, topic, data, time.Time{}, opts...)
 }
 
-func (bus *eventBus) Publish(topic string, data []byte) {
+// PublishAfter publishes an event to the topic that is not handled before the delay passes. See PublishCtx.
+func (bus *eventBus) PublishAfter(
+	ctx context.Context,
+	topic string,
+	data []byte,
+	delay time.Duration,
+	opts ...PublishOptions,
+) error {
+	return bus.PublishAt(ctx, topic, data, bus.now().Add(delay), opts...)
+}
+
+// PublishAt publishes an event to the topic that is not handled before the given moment. See PublishCtx.
+// The moment is persisted in the outbox, so scheduled events survive restarts.
+// Events with an ordering key keep their publishing order, a delayed event holds back later events of its key.
+func (bus *eventBus) PublishAt(
+	ctx context.Context,
+	topic string,
+	data []byte,
+	at time.Time,
+	opts ...PublishOptions,
+) error {
+	if bus.draining() {
+		bus.recordPublish(topic, "closed")
+		return ErrBusClosed
+	}
+
+	var opt PublishOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+
+	policy := bus.backpressurePolicy(opt)
+	if policy == BackpressurePersist && bus.outbox == nil {
+		return ErrOutboxNotConfigured
+	}
+	delayed := bus.now().Before(at)
+	if policy == BackpressureFailFast && !delayed && bus.full(topic) {
+		bus.recordPublish(topic, "full")
+		return ErrQueueFull
+	}
+
+	ctx, span := bus.startSpan(ctx, "publish "+topic)
+	defer span.End()
+	span.SetAttributeString(SpanAttrTopic, topic)
+
 	event := &Event{
-		Data:      data,
-		Topic:     topic,
-		Retry:     0,
-		NextRetry: 0,
-		AckStatus: NACK,
+		Data:        data,
+		Topic:       topic,
+		Retry:       0,
+		NextRetry:   0,
+		AckStatus:   NACK,
+		AvailableAt: at,
+		CreatedAt:   bus.now(),
+		Headers:     bus.injectHeaders(ctx, opt.Headers),
+		OrderingKey: opt.OrderingKey,
+		DedupKey:    opt.DedupKey,
 	}
+	deliveries := bus.deliveries(event)
+
+	span.SetAttributeInt(SpanAttrDeliveries, len(deliveries))
 
 	if bus.outbox != nil {
-		outboxEvent := convertEventToOutboxEvent(event)
-		if err := bus.outbox.InsertEvent(bus.ctx, outboxEvent); err != nil {
-			bus.log.ErrorCtx(bus.ctx, err, "failed to save event to outbox")
-			return
+		leased := bus.relay != nil && !delayed && policy != BackpressurePersist
+		saved, err := bus.saveDeliveries(ctx, deliveries, leased)
+		if err != nil {
+			span.RecordError(err)
+			span.SetError("save event to outbox")
+			bus.recordPublish(topic, "outbox")
+			return fmt.Errorf("save event to outbox: %w", err)
+		}
+		if len(saved) == 0 {
+			bus.log.DebugCtx(ctx, "Duplicate event dropped")
+			bus.recordDuplicate(topic)
+			return nil
 		}
-		event.ID = outboxEvent.ID
+		deliveries = saved
+		span.SetAttributeInt(SpanAttrEventID, deliveries[0].ID)
 	}
 
-	bus.queue <- event
+	bus.recordPublish(topic, "")
+
+	// delayed events are claimed by the relay once they are due
+	if policy == BackpressurePersist || bus.relay != nil && delayed {
+		return nil
+	}
+
+	var rejected error
+	transactions.AfterCommit(ctx, func() {
+		for _, delivery := range deliveries {
+			if bus.relay != nil && delivery.ID != 0 {
+				bus.relay.track(delivery.ID)
+			}
+
+			if bus.relay == nil && !bus.load.claim(delivery.ID) || !bus.admit(delivery) {
+				continue
+			}
+
+			if delayed {
+				bus.scheduleEvent(bus.ctx, delivery)
+				continue
+			}
+
+			if err := bus.dispatch(ctx, delivery, policy); err != nil {
+				bus.reject(ctx, delivery, err)
+				if delivery.ID == 0 {
+					rejected = err
+				}
+			}
+		}
+	})
+
+	return rejected
+}
+
+// reject gives up on dispatching a delivery in memory. A delivery saved to the outbox is left there,
+// its lease expires and the relay claims it again, otherwise it is dropped.
+func (bus *eventBus) reject(ctx context.Context, delivery *Event, err error) {
+	bus.release(ctx, delivery)
+
+	if delivery.ID != 0 {
+		if bus.relay != nil {
+			bus.relay.forget(delivery.ID)
+		}
+		bus.log.WarnCtx(ctx, "Event left in outbox: %s", err)
+		return
+	}
+
+	bus.log.ErrorCtx(ctx, err, "Event dropped")
+	bus.recordPublish(delivery.Topic, "full")
 }
 
 // StartProcessing begins processing events from the queue. It listens for cancellation via the provided context to gracefully stop processing.
+// Events are handled by a bounded worker pool, see SetConcurrency and SubscribeOptions.Concurrency.
 func (bus *eventBus) StartProcessing(ctx context.Context) error {
-	err := bus.loadEventsFromOutbox(ctx)
-	if err != nil {
+	if (bus.relay != nil || bus.retention != nil) && bus.outbox == nil {
+		return ErrOutboxNotConfigured
+	}
+	if topic, ok := bus.unnamedSubscription(); ok && bus.outbox != nil {
+		return fmt.Errorf("%w: a subscription of topic %s needs SubscribeOptions.Name with the outbox",
+			ErrUnnamedSubscription, topic)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pool := newWorkerPool(bus, cancel)
+
+	bus.lock.Lock()
+	bus.pool = pool
+	bus.lock.Unlock()
+
+	bus.lock.RLock()
+	sampled := bus.metricsInterval > 0
+	bus.lock.RUnlock()
+	if sampled {
+		go bus.runMetrics(ctx)
+	}
+
+	if bus.retention != nil {
+		go bus.runRetention(ctx)
+	}
+
+	if bus.relay != nil {
+		go bus.runRelay(ctx)
+	} else if err := bus.loadEventsFromOutbox(ctx); err != nil {
 		return err
 	}
 
@@ -115,63 +509,195 @@ func (bus *eventBus) StartProcessing(ctx context.Context) error {
 		case <-ctx.Done():
 			bus.log.InfoContext(ctx, "Processing stopped due to context cancellation")
 			return nil
+		case <-bus.drain:
+			select {
+			case <-pool.idle():
+			case <-ctx.Done():
+			}
+			bus.log.InfoContext(ctx, "Processing stopped, event bus drained")
+			return nil
 		case event, ok := <-bus.queue:
 			if !ok {
 				bus.log.InfoContext(ctx, "Processing stopped, queue channel closed")
 				return nil
 			}
-			go processEvent(ctx, bus, event)
+			pool.dispatch(ctx, event)
+			bus.inflight.Add(-1)
 		}
 	}
 }
 
 // processEvent handles the processing of a single event, including retry logic and error handling.
+// An event not yet split into deliveries is split and every delivery is handled in turn.
 func processEvent(ctx context.Context, bus *eventBus, event *Event) {
+	if event.Subscriber == "" {
+		for _, delivery := range bus.fanOut(ctx, event) {
+			if bus.admit(delivery) {
+				processEvent(ctx, bus, delivery)
+			}
+		}
+		bus.release(ctx, event)
+		return
+	}
+
+	sub := bus.subscription(event.Topic, event.Subscriber)
+	if sub != nil && sub.batch != nil {
+		bus.batchEvent(ctx, sub, event)
+		return
+	}
+
+	ctx = bus.extractHeaders(ctx, event)
 	ctx = bus.AddEventToCtx(ctx, event)
 
-	handlers, ok := bus.handlers[event.Topic]
-	if !ok {
+	if sub == nil {
+		bus.log.DebugCtx(ctx, "No subscription for event")
+		bus.release(ctx, event)
 		return
 	}
-	for _, handler := range handlers {
-		status := handler(ctx, event)
-		maxRetries := len(bus.delay[event.Topic])
-		switch {
-		case status == NACK && event.Retry < maxRetries:
-			event.Retry++
-			event.NextRetry = bus.delay[event.Topic][event.Retry-1]
-			if bus.outbox != nil {
-				bus.updateEventStatus(ctx, event)
-			}
-			go bus.retryEvent(ctx, event)
-		case event.Retry >= maxRetries:
-			bus.log.DebugCtx(ctx, "Max retries for event")
-			if bus.outbox != nil {
-				bus.markEventAsFailed(ctx, event.ID)
-			}
-		case status == ACK:
-			bus.log.DebugCtx(ctx, "Message acknowledged")
-			if bus.outbox != nil {
-				bus.markEventAsProcessed(ctx, event.ID)
-			}
+
+	ctx, span := bus.startSpan(ctx, "process "+event.Topic)
+	span.SetAttributeString(SpanAttrTopic, event.Topic)
+	span.SetAttributeString(SpanAttrSubscriber, event.Subscriber)
+	span.SetAttributeInt(SpanAttrEventID, event.ID)
+	span.SetAttributeInt(SpanAttrRetry, event.Retry)
+
+	started := time.Now()
+	status := bus.runHandler(ctx, sub, event)
+	handled, took := status, time.Since(started)
+
+	var (
+		delay time.Duration
+		retry bool
+	)
+	if status == NACK {
+		delay, retry = nextRetry(sub.policy, event)
+	}
+
+	switch {
+	case status == ACK:
+	case retry:
+		status = NACK
+	default:
+		status = DEAD
+	}
+
+	endConsumerSpan(span, status, event.LastError)
+	bus.recordHandled(event, handled, status, took)
+	bus.recordOutcome(ctx, event, handled)
+
+	switch status {
+	case ACK:
+		bus.log.DebugCtx(ctx, "Message acknowledged")
+		event.AckStatus = ACK
+		if bus.outbox != nil {
+			bus.markEventAsProcessed(ctx, event.ID)
 		}
+		if bus.relay != nil {
+			bus.relay.forget(event.ID)
+		}
+		bus.release(ctx, event)
+	case NACK:
+		event.Retry++
+		event.NextRetry = delay
+		event.AvailableAt = bus.now().Add(event.NextRetry)
+		if bus.outbox != nil {
+			bus.updateEventStatus(ctx, event)
+		}
+		if bus.relay != nil {
+			bus.rescheduleEvent(ctx, event)
+		} else {
+			bus.scheduleEvent(ctx, event)
+		}
+	default:
+		bus.log.DebugCtx(ctx, "Max retries for event, moving it to dead letters")
+		event.AckStatus = DEAD
+		if bus.outbox != nil {
+			bus.markEventAsDead(ctx, event)
+		}
+		if bus.relay != nil {
+			bus.relay.forget(event.ID)
+		}
+		bus.release(ctx, event)
 	}
 }
 
-// retryEvent attempts to re-enqueue an event for processing after a delay, respecting the provided context.
-func (bus *eventBus) retryEvent(ctx context.Context, event *Event) {
+// fanOut splits an event published before its topic had subscriptions into deliveries.
+// With the outbox the deliveries replace the event row, which is acknowledged.
+func (bus *eventBus) fanOut(ctx context.Context, event *Event) []*Event {
+	deliveries := bus.deliveries(event)
+	if len(deliveries) == 1 && deliveries[0] == event {
+		bus.log.DebugCtx(bus.AddEventToCtx(ctx, event), "No subscription for event")
+		return nil
+	}
+
+	if bus.outbox != nil {
+		saved, err := bus.saveDeliveries(ctx, deliveries, bus.relay != nil)
+		if err != nil {
+			bus.log.ErrorCtx(ctx, err, "Failed to save event deliveries to outbox")
+			return nil
+		}
+		bus.markEventAsProcessed(ctx, event.ID)
+		deliveries = saved
+	}
+
+	if bus.relay != nil {
+		bus.relay.forget(event.ID)
+		for _, delivery := range deliveries {
+			bus.relay.track(delivery.ID)
+		}
+	}
+
+	return deliveries
+}
+
+// scheduleEvent re-enqueues an event for processing once its AvailableAt moment passes, respecting the provided context.
+// The timer starts right away, the event waits for it in a goroutine of its own.
+// Events still waiting when the bus starts draining are left to Shutdown.
+func (bus *eventBus) scheduleEvent(ctx context.Context, event *Event) {
+	clock := bus.clockOf()
+	timer := clock.NewTimer(event.AvailableAt.Sub(clock.Now()))
+
+	bus.scheduledLock.Lock()
+	bus.scheduled[event] = struct{}{}
+	bus.scheduledLock.Unlock()
+
+	go bus.awaitEvent(ctx, event, timer)
+}
+
+// awaitEvent waits for the timer of a scheduled event and puts the event in the queue.
+// The timer is stopped once the event is in the queue, so a fired timer is never mistaken for an idle bus.
+func (bus *eventBus) awaitEvent(ctx context.Context, event *Event, timer Timer) {
+	defer timer.Stop()
+
 	select {
+	case <-bus.drain:
+		return
 	case <-ctx.Done():
+		// processing stops once drained, the event is left to Shutdown then
+		if bus.draining() {
+			return
+		}
 		bus.log.DebugCtx(ctx, "Retry canceled due to context cancellation for event: %+v\n", event)
-		return
-	case <-time.After(event.NextRetry):
+	case <-timer.C():
+		bus.inflight.Add(1)
 		select {
 		case bus.queue <- event:
 			bus.log.DebugCtx(ctx, "Event re-enqueued after delay")
+		case <-bus.drain:
+			bus.inflight.Add(-1)
+			return
 		case <-ctx.Done():
+			bus.inflight.Add(-1)
+			if bus.draining() {
+				return
+			}
 			bus.log.DebugCtx(ctx, "Failed to enqueue event due to context cancellation")
 		}
 	}
+
+	bus.scheduledLock.Lock()
+	delete(bus.scheduled, event)
+	bus.scheduledLock.Unlock()
 }
 
 // Stop triggers the stopping of the event bus processing by cancelling the context.
@@ -180,7 +706,16 @@ func (bus *eventBus) Stop() {
 }
 
 func (bus *eventBus) ExceededMaxRetries(event *Event) bool {
-	return event.Retry > len(bus.delay[event.Topic])
+	sub := bus.subscription(event.Topic, event.Subscriber)
+	if sub == nil {
+		return false
+	}
+
+	limiter, ok := sub.policy.(retryLimiter)
+	if !ok {
+		return false
+	}
+	return event.Retry > limiter.MaxRetries()
 }
 
 func (bus *eventBus) AddEventToCtx(ctx context.Context, event *Event) context.Context {
@@ -188,31 +723,83 @@ func (bus *eventBus) AddEventToCtx(ctx context.Context, event *Event) context.Co
 		"event_data":              string(event.Data),
 		"event_retry":             event.Retry,
 		"event_topic":             event.Topic,
+		"event_subscriber":        event.Subscriber,
 		"event_nextRetry_minutes": event.NextRetry.Minutes(),
 		"event_ackStatus":         event.AckStatus,
+		"event_availableAt":       event.AvailableAt,
+		"event_headers":           event.Headers,
+		"event_orderingKey":       event.OrderingKey,
+		"event_dedupKey":          event.DedupKey,
 	})
 }
 
 // convertEventToOutboxEvent converts an Event to an OutboxEvent.
 func convertEventToOutboxEvent(event *Event) *OutboxEvent {
 	return &OutboxEvent{
-		ID:        event.ID,
-		Data:      event.Data,
-		Topic:     event.Topic,
-		Retry:     event.Retry,
-		NextRetry: uint(event.NextRetry.Minutes()),
-		AckStatus: event.AckStatus,
+		ID:          event.ID,
+		Data:        event.Data,
+		Topic:       event.Topic,
+		Retry:       event.Retry,
+		NextRetry:   uint(event.NextRetry.Minutes()),
+		AckStatus:   event.AckStatus,
+		Subscriber:  event.Subscriber,
+		LastError:   event.LastError,
+		Headers:     event.Headers,
+		OrderingKey: event.OrderingKey,
+		DedupKey:    event.DedupKey,
+		AvailableAt: unixMilli(event.AvailableAt),
+		CreatedAt:   unixSeconds(event.CreatedAt),
+		UpdatedAt:   time.Now().Unix(),
 	}
 }
 
 // convertOutboxEventToEvent converts an OutboxEvent to an Event.
 func convertOutboxEventToEvent(outboxEvent *OutboxEvent) *Event {
 	return &Event{
-		ID:        outboxEvent.ID,
-		Data:      outboxEvent.Data,
-		Topic:     outboxEvent.Topic,
-		Retry:     outboxEvent.Retry,
-		NextRetry: time.Duration(outboxEvent.NextRetry) * time.Minute,
-		AckStatus: outboxEvent.AckStatus,
+		ID:          outboxEvent.ID,
+		Data:        outboxEvent.Data,
+		Topic:       outboxEvent.Topic,
+		Retry:       outboxEvent.Retry,
+		NextRetry:   time.Duration(outboxEvent.NextRetry) * time.Minute,
+		AckStatus:   outboxEvent.AckStatus,
+		Subscriber:  outboxEvent.Subscriber,
+		LastError:   outboxEvent.LastError,
+		Headers:     outboxEvent.Headers,
+		OrderingKey: outboxEvent.OrderingKey,
+		DedupKey:    outboxEvent.DedupKey,
+		AvailableAt: fromUnixMilli(outboxEvent.AvailableAt),
+		CreatedAt:   fromUnixSeconds(outboxEvent.CreatedAt),
+	}
+}
+
+// unixMilli returns t as Unix milliseconds, the zero time is returned as 0.
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// unixSeconds returns t as Unix seconds, the zero time is returned as 0.
+func unixSeconds(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// fromUnixSeconds is the inverse of unixSeconds.
+func fromUnixSeconds(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+// fromUnixMilli is the inverse of unixMilli.
+func fromUnixMilli(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
 	}
+	return time.UnixMilli(ms)
 }
@@ -2,14 +2,32 @@ package queue_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/suite"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 
 	"github.com/gateway-fm/scriptorium/clog"
+	"github.com/gateway-fm/scriptorium/helper"
+	"github.com/gateway-fm/scriptorium/metrics"
 	"github.com/gateway-fm/scriptorium/queue"
+	"github.com/gateway-fm/scriptorium/queue/queuetest"
+	"github.com/gateway-fm/scriptorium/repository_testing"
+	"github.com/gateway-fm/scriptorium/transactions"
 )
 
 type EventBusSuite struct {
@@ -33,75 +51,2420 @@ func (s *EventBusSuite) SetupTest() {
 }
 
 func (s *EventBusSuite) TestRetryLogic() {
+	ackOnThirdRetry := func(_ context.Context, event *queue.Event) queue.AckStatus {
+		if event.Retry < 3 {
+			return queue.NACK
+		}
+
+		return queue.ACK
+	}
+
 	s.Run("test one topic", func() {
-		retryDelays := []int{1, 1, 1}
+		h := queuetest.New(s.T())
+		h.Bus.Subscribe("topic", ackOnThirdRetry, []int{1, 1, 1}, time.Second, queue.SubscribeOptions{Name: "sub"})
+		h.Start()
 
-		received := make(chan bool, 2)
+		s.Require().NoError(h.Bus.Publish("topic", []byte("Test Event")))
+		h.RunUntilIdle()
 
-		s.bus.Subscribe("topic", func(_ context.Context, event *queue.Event) queue.AckStatus {
-			if event.Retry < 3 {
-				return queue.NACK
+		deliveries := h.Deliveries("topic")
+		s.Require().Len(deliveries, 4)
+		s.Equal(queue.ACK, deliveries[3].Status)
+		s.Equal(3*time.Second, deliveries[3].At.Sub(deliveries[0].At))
+	})
+
+	s.Run("test multiple topics", func() {
+		h := queuetest.New(s.T())
+		h.Bus.Subscribe("first-topic", ackOnThirdRetry, []int{1, 1, 1}, time.Second, queue.SubscribeOptions{Name: "sub"})
+		h.Bus.Subscribe("second-topic", ackOnThirdRetry, []int{1, 1, 1}, time.Second, queue.SubscribeOptions{Name: "sub"})
+		h.Start()
+
+		s.Require().NoError(h.Bus.Publish("first-topic", []byte("Test Event")))
+		s.Require().NoError(h.Bus.Publish("second-topic", []byte("Test Event")))
+		h.RunUntilIdle()
+
+		for _, topic := range []string{"first-topic", "second-topic"} {
+			deliveries := h.Deliveries(topic)
+			s.Require().Len(deliveries, 4, topic)
+			s.Equal(queue.ACK, deliveries[3].Status, topic)
+		}
+	})
+}
+
+func (s *EventBusSuite) TestConcurrencyLimit() {
+	s.Run("per topic limit", func() {
+		var (
+			running atomic.Int32
+			peak    atomic.Int32
+		)
+
+		release := make(chan struct{})
+		done := make(chan struct{}, 10)
+
+		s.bus.Subscribe("limited-topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+			current := running.Add(1)
+			for {
+				prev := peak.Load()
+				if current <= prev || peak.CompareAndSwap(prev, current) {
+					break
+				}
 			}
 
-			received <- true
+			<-release
+			running.Add(-1)
+			done <- struct{}{}
 
 			return queue.ACK
-		}, retryDelays, time.Second)
+		}, nil, time.Second, queue.SubscribeOptions{Concurrency: 2})
+
+		for i := 0; i < 10; i++ {
+			s.Require().NoError(s.bus.Publish("limited-topic", []byte("Test Event")))
+		}
+
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
 
-		s.bus.Publish("topic", []byte("Test Event"))
 		go func() {
-			err := s.bus.StartProcessing(s.ctx)
+			err := s.bus.StartProcessing(ctx)
 			s.Require().NoError(err)
 		}()
-		defer s.bus.Stop()
 
-		select {
-		case <-received:
-			s.T().Log("Event processed successfully after retries")
-		case <-time.After(4 * time.Second):
-			s.FailNow("Event was not processed successfully within the expected time")
+		s.Require().Eventually(func() bool {
+			stats := s.bus.PoolStats().Topics["limited-topic"]
+			return stats.InFlight == 2 && stats.Capacity == 2
+		}, time.Second, 10*time.Millisecond)
+
+		close(release)
+
+		for i := 0; i < 10; i++ {
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				s.FailNow("Events were not processed within the expected time")
+			}
 		}
+
+		s.Require().LessOrEqual(peak.Load(), int32(2))
 	})
 
-	s.Run("test multiple topics", func() {
-		retryDelays := []int{1, 1, 1}
-		received := make(chan bool, 2)
+	s.Run("bus-wide limit", func() {
+		bus := queue.NewEventBus(s.ctx, 100)
+		bus.SetLogger(s.log)
+		bus.SetConcurrency(1)
 
-		s.bus.Subscribe("first-topic", func(_ context.Context, event *queue.Event) queue.AckStatus {
-			if event.Retry < 3 {
-				return queue.NACK
+		release := make(chan struct{})
+		done := make(chan struct{}, 2)
+
+		handler := func(_ context.Context, _ *queue.Event) queue.AckStatus {
+			<-release
+			done <- struct{}{}
+			return queue.ACK
+		}
+
+		bus.Subscribe("first-topic", handler, nil, time.Second)
+		bus.Subscribe("second-topic", handler, nil, time.Second)
+
+		s.Require().NoError(bus.Publish("first-topic", []byte("Test Event")))
+		s.Require().NoError(bus.Publish("second-topic", []byte("Test Event")))
+
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		go func() {
+			err := bus.StartProcessing(ctx)
+			s.Require().NoError(err)
+		}()
+
+		s.Require().Eventually(func() bool {
+			stats := bus.PoolStats()
+			return stats.InFlight == 1 && len(stats.Topics) == 2
+		}, time.Second, 10*time.Millisecond)
+
+		s.Require().Equal(1, bus.PoolStats().Capacity)
+		close(release)
+
+		for i := 0; i < 2; i++ {
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				s.FailNow("Events were not processed within the expected time")
 			}
+		}
+	})
+}
+
+func (s *EventBusSuite) TestDeadLetter() {
+	s.Run("stops retrying after max retries", func() {
+		h := queuetest.New(s.T())
+		h.Bus.Subscribe("dead-topic", func(_ context.Context, event *queue.Event) queue.AckStatus {
+			event.SetError(errors.New("downstream unavailable"))
+			return queue.NACK
+		}, []int{10, 10}, time.Millisecond, queue.SubscribeOptions{Name: "sub"})
+
+		s.Require().NoError(h.Bus.Publish("dead-topic", []byte("Test Event")))
+		h.Start()
+		h.RunUntilIdle()
+
+		h.AssertDelivered("dead-topic", []byte("Test Event"), 3)
+		h.AssertDeadLettered("dead-topic", []byte("Test Event"))
+	})
+
+	s.Run("dead-letters rejected events immediately", func() {
+		h := queuetest.New(s.T())
+		h.Bus.Subscribe("rejected-topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+			return queue.DEAD
+		}, []int{10, 10}, time.Millisecond, queue.SubscribeOptions{Name: "sub"})
+
+		s.Require().NoError(h.Bus.Publish("rejected-topic", []byte("Test Event")))
+		h.Start()
+		h.RunUntilIdle()
+
+		h.AssertDelivered("rejected-topic", []byte("Test Event"), 1)
+		h.AssertDeadLettered("rejected-topic", []byte("Test Event"))
+	})
+
+	s.Run("requires outbox", func() {
+		_, err := s.bus.ListDeadLetters(s.ctx, queue.DeadLetterFilter{Topic: "dead-topic"})
+		s.Require().ErrorIs(err, queue.ErrOutboxNotConfigured)
+
+		err = s.bus.ReplayDeadLetter(s.ctx, 1)
+		s.Require().ErrorIs(err, queue.ErrOutboxNotConfigured)
+
+		_, err = s.bus.PurgeDeadLetters(s.ctx, queue.DeadLetterFilter{})
+		s.Require().ErrorIs(err, queue.ErrOutboxNotConfigured)
+	})
+}
+
+// recordingDB is an orm.DB recording the statements it receives without a database.
+// Statements affect the row counts programmed in rows one after the other, no row once they run out.
+// Like go-pg, a statement expecting a single row fails with pg.ErrNoRows when it affects none.
+type recordingDB struct {
+	lock       sync.Mutex
+	statements []string
+	rows       []int
+}
+
+func (db *recordingDB) Transaction(context.Context) transactions.Transaction {
+	return db
+}
+
+func (db *recordingDB) Model(model ...interface{}) *orm.Query {
+	return orm.NewQuery(db, model...)
+}
+
+func (db *recordingDB) ModelContext(ctx context.Context, model ...interface{}) *orm.Query {
+	return orm.NewQueryContext(ctx, db, model...)
+}
+
+func (db *recordingDB) Exec(query interface{}, params ...interface{}) (orm.Result, error) {
+	return db.run(query, params, false)
+}
 
-			received <- true
+func (db *recordingDB) ExecContext(_ context.Context, query interface{}, params ...interface{}) (orm.Result, error) {
+	return db.run(query, params, false)
+}
+
+func (db *recordingDB) ExecOne(query interface{}, params ...interface{}) (orm.Result, error) {
+	return db.run(query, params, true)
+}
+
+func (db *recordingDB) ExecOneContext(_ context.Context, query interface{}, params ...interface{}) (orm.Result, error) {
+	return db.run(query, params, true)
+}
+
+func (db *recordingDB) Query(_, query interface{}, params ...interface{}) (orm.Result, error) {
+	return db.run(query, params, false)
+}
+
+func (db *recordingDB) QueryContext(_ context.Context, _, query interface{}, params ...interface{}) (orm.Result, error) {
+	return db.run(query, params, false)
+}
+
+func (db *recordingDB) QueryOne(_, query interface{}, params ...interface{}) (orm.Result, error) {
+	return db.run(query, params, true)
+}
+
+func (db *recordingDB) QueryOneContext(
+	_ context.Context, _, query interface{}, params ...interface{},
+) (orm.Result, error) {
+	return db.run(query, params, true)
+}
+
+func (db *recordingDB) CopyFrom(io.Reader, interface{}, ...interface{}) (orm.Result, error) {
+	return nil, errors.New("copy is not supported")
+}
+
+func (db *recordingDB) CopyTo(io.Writer, interface{}, ...interface{}) (orm.Result, error) {
+	return nil, errors.New("copy is not supported")
+}
+
+func (db *recordingDB) Context() context.Context {
+	return context.Background()
+}
+
+func (db *recordingDB) Formatter() orm.QueryFormatter {
+	return orm.NewFormatter()
+}
+
+func (db *recordingDB) run(query interface{}, params []interface{}, one bool) (orm.Result, error) {
+	var statement []byte
+	switch q := query.(type) {
+	case orm.QueryAppender:
+		var err error
+		if statement, err = q.AppendQuery(orm.NewFormatter(), nil); err != nil {
+			return nil, err
+		}
+	case string:
+		statement = orm.NewFormatter().FormatQuery(nil, q, params...)
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.statements = append(db.statements, string(statement))
+	rows := 0
+	if len(db.rows) > 0 {
+		rows, db.rows = db.rows[0], db.rows[1:]
+	}
+
+	if one && rows == 0 {
+		return nil, pg.ErrNoRows
+	}
+	return recordedResult(rows), nil
+}
+
+// recorded returns the statements received so far.
+func (db *recordingDB) recorded() []string {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	return append([]string(nil), db.statements...)
+}
+
+// recordedResult is the result of a statement of recordingDB affecting the given number of rows.
+type recordedResult int
+
+func (r recordedResult) Model() orm.Model {
+	return nil
+}
+
+func (r recordedResult) RowsAffected() int {
+	return int(r)
+}
+
+func (r recordedResult) RowsReturned() int {
+	return int(r)
+}
+
+func (s *EventBusSuite) TestReplayDeadLettersReportsRevivedEvents() {
+	store := queuetest.NewMemoryOutbox(nil)
+	s.Require().NoError(store.InsertEvents(s.ctx, []*queue.OutboxEvent{
+		{Topic: "dead-topic", Subscriber: "sub", AckStatus: queue.DEAD},
+		{Topic: "dead-topic", Subscriber: "sub", AckStatus: queue.DEAD},
+		{Topic: "dead-topic", Subscriber: "sub", AckStatus: queue.DEAD},
+	}, time.Hour))
+
+	// the queue holds a single event and nothing consumes it
+	bus := queue.NewEventBus(s.ctx, 1)
+	bus.SetLogger(s.log)
+	bus.(queue.Testable).WithOutboxStore(store)
+
+	ctx, cancel := context.WithTimeout(s.ctx, 50*time.Millisecond)
+	defer cancel()
+
+	count, err := bus.ReplayDeadLetters(ctx, queue.DeadLetterFilter{Topic: "dead-topic"})
+	s.Require().ErrorIs(err, context.DeadlineExceeded)
+	s.Require().Equal(3, count)
+
+	for _, event := range store.Events() {
+		s.Require().Equal(queue.NACK, event.AckStatus)
+	}
+}
+
+func (s *EventBusSuite) TestReplayMissingDeadLetter() {
+	db := &recordingDB{}
+
+	_, err := queue.NewOutboxRepository(db).ReviveDeadEvent(s.ctx, 42)
+	s.Require().ErrorIs(err, queue.ErrEventNotFound)
+
+	s.bus.WithOutbox(db)
+	s.Require().ErrorIs(s.bus.ReplayDeadLetter(s.ctx, 42), queue.ErrEventNotFound)
+
+	rec := httptest.NewRecorder()
+	s.bus.AdminHandler(queue.AdminOptions{Writable: true, Authorizer: queue.AllowAll}).
+		ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/queue/events/42/replay", nil))
+	s.Require().Equal(http.StatusNotFound, rec.Code)
+}
 
+func (s *EventBusSuite) TestRelayRequiresOutbox() {
+	bus := queue.NewEventBus(s.ctx, 100)
+	bus.SetLogger(s.log)
+	bus.WithRelay(queue.RelayOptions{Owner: "instance-1"})
+
+	err := bus.StartProcessing(s.ctx)
+	s.Require().ErrorIs(err, queue.ErrOutboxNotConfigured)
+}
+
+func (s *EventBusSuite) TestRelay() {
+	relayOptions := queue.RelayOptions{
+		Owner:         "instance-1",
+		PollInterval:  10 * time.Millisecond,
+		LeaseDuration: 3 * time.Second,
+	}
+
+	insert := func(store *queuetest.MemoryOutbox, subscriber string) int {
+		event := &queue.OutboxEvent{
+			Topic:      "relay-topic",
+			Subscriber: subscriber,
+			Data:       []byte("event"),
+			AckStatus:  queue.NACK,
+		}
+		s.Require().NoError(store.InsertEvents(s.ctx, []*queue.OutboxEvent{event}, 0))
+		return event.ID
+	}
+	stored := func(store *queuetest.MemoryOutbox, id int) *queue.OutboxEvent {
+		event, err := store.GetEvent(s.ctx, id)
+		s.Require().NoError(err)
+		return event
+	}
+
+	s.Run("claims events and extends their leases while they are handled", func() {
+		h := queuetest.New(s.T())
+		h.Bus.WithRelay(relayOptions)
+
+		handling := make(chan struct{})
+		done := make(chan struct{})
+		h.Bus.Subscribe("relay-topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+			close(handling)
+			<-done
 			return queue.ACK
-		}, retryDelays, time.Second)
+		}, nil, time.Second, queue.SubscribeOptions{Name: "sub"})
+
+		id := insert(h.Outbox, "sub")
+		h.Start()
 
-		s.bus.Subscribe("second-topic", func(_ context.Context, event *queue.Event) queue.AckStatus {
-			if event.Retry < 3 {
+		<-handling
+		claimed := stored(h.Outbox, id)
+		s.Require().Equal("instance-1", claimed.LeaseOwner)
+		s.Require().Equal(h.Clock.Now().Add(relayOptions.LeaseDuration).Unix(), claimed.LeaseUntil)
+
+		other, err := h.Outbox.ClaimEvents(s.ctx, "instance-2", 10, time.Minute)
+		s.Require().NoError(err)
+		s.Require().Empty(other)
+
+		// the heartbeat runs every third of the lease
+		h.Clock.Advance(relayOptions.LeaseDuration / 3)
+		s.Require().Eventually(func() bool {
+			return stored(h.Outbox, id).LeaseUntil == claimed.LeaseUntil+1
+		}, time.Second, time.Millisecond)
+
+		close(done)
+		h.WaitIdle()
+		s.Require().Equal(queue.ACK, stored(h.Outbox, id).AckStatus)
+	})
+
+	s.Run("releases the lease of a NACKed event so it is claimed again", func() {
+		h := queuetest.New(s.T())
+		h.Bus.WithRelay(relayOptions)
+
+		var calls atomic.Int32
+		h.Bus.Subscribe("relay-topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+			if calls.Add(1) == 1 {
 				return queue.NACK
 			}
+			return queue.ACK
+		}, []int{1}, time.Millisecond, queue.SubscribeOptions{Name: "sub"})
+
+		id := insert(h.Outbox, "sub")
+		h.Start()
+		h.WaitIdle()
 
-			received <- true
+		event := stored(h.Outbox, id)
+		s.Require().Equal(queue.NACK, event.AckStatus)
+		s.Require().Empty(event.LeaseOwner)
 
+		// the retry is claimed by the next poll
+		h.Advance(relayOptions.PollInterval)
+
+		event = stored(h.Outbox, id)
+		s.Require().Equal(queue.ACK, event.AckStatus)
+		s.Require().Equal(int32(2), calls.Load())
+		s.Require().Equal(1, event.Retry)
+	})
+
+	s.Run("releases the leases held when processing stops", func() {
+		store := queuetest.NewMemoryOutbox(nil)
+		bus := queue.NewEventBus(s.ctx, 100)
+		bus.SetLogger(s.log)
+		bus.(queue.Testable).WithOutboxStore(store)
+		bus.WithRelay(relayOptions)
+
+		handling := make(chan struct{})
+		done := make(chan struct{})
+		defer close(done)
+		bus.Subscribe("relay-topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+			close(handling)
+			<-done
 			return queue.ACK
-		}, retryDelays, time.Second)
+		}, nil, time.Second, queue.SubscribeOptions{Name: "sub"})
+
+		id := insert(store, "sub")
+
+		ctx, cancel := context.WithCancel(s.ctx)
+		go func() { _ = bus.StartProcessing(ctx) }()
+
+		<-handling
+		s.Require().Equal("instance-1", stored(store, id).LeaseOwner)
+
+		cancel()
+		s.Require().Eventually(func() bool {
+			return stored(store, id).LeaseOwner == ""
+		}, time.Second, 10*time.Millisecond)
+
+		other, err := store.ClaimEvents(s.ctx, "instance-2", 10, time.Minute)
+		s.Require().NoError(err)
+		s.Require().Len(other, 1)
+		s.Require().Equal(id, other[0].ID)
+	})
+}
+
+func (s *EventBusSuite) TestUnnamedSubscriptionWithOutbox() {
+	handler := func(_ context.Context, _ *queue.Event) queue.AckStatus { return queue.ACK }
+
+	bus := queue.NewEventBus(s.ctx, 100)
+	bus.SetLogger(s.log)
+	bus.(queue.Testable).WithOutboxStore(queuetest.NewMemoryOutbox(nil))
+	bus.Subscribe("named-topic", handler, nil, time.Second, queue.SubscribeOptions{Name: "named"})
+	bus.Subscribe("unnamed-topic", handler, nil, time.Second)
+
+	err := bus.StartProcessing(s.ctx)
+	s.Require().ErrorIs(err, queue.ErrUnnamedSubscription)
+	s.Require().ErrorContains(err, "unnamed-topic")
+}
+
+func (s *EventBusSuite) TestRetentionRequiresOutbox() {
+	bus := queue.NewEventBus(s.ctx, 100)
+	bus.SetLogger(s.log)
+	bus.WithRetention(queue.RetentionOptions{
+		Period: 24 * time.Hour,
+		Topics: map[string]time.Duration{"audit": 0},
+	})
+
+	err := bus.StartProcessing(s.ctx)
+	s.Require().ErrorIs(err, queue.ErrOutboxNotConfigured)
+}
+
+// batchCountingOutbox counts the batches of acknowledged events removed from a MemoryOutbox.
+type batchCountingOutbox struct {
+	*queuetest.MemoryOutbox
+	batches atomic.Int32
+}
+
+func (o *batchCountingOutbox) DeleteAckedEvents(ctx context.Context, filter queue.AckedFilter, limit int) (int, error) {
+	o.batches.Add(1)
+	return o.MemoryOutbox.DeleteAckedEvents(ctx, filter, limit)
+}
+
+func (s *EventBusSuite) TestRetention() {
+	now := time.Now()
+	acked := func(topic string, age time.Duration) *queue.OutboxEvent {
+		return &queue.OutboxEvent{
+			Topic:      topic,
+			Subscriber: "sub",
+			Data:       []byte(topic + " " + age.String()),
+			AckStatus:  queue.ACK,
+			CreatedAt:  now.Add(-age).Unix(),
+			UpdatedAt:  now.Add(-age).Unix(),
+		}
+	}
+	data := func(events []*queue.OutboxEvent) []string {
+		var all []string
+		for _, event := range events {
+			all = append(all, string(event.Data))
+		}
+		return all
+	}
+	start := func(store queue.OutboxStore, opts queue.RetentionOptions, events ...*queue.OutboxEvent) *recordingRegistry {
+		s.Require().NoError(store.InsertEvents(s.ctx, events, time.Hour))
 
-		s.bus.Publish("first-topic", []byte("Test Event"))
-		s.bus.Publish("second-topic", []byte("Test Event"))
+		registry := newRecordingRegistry()
+		bus := queue.NewEventBus(s.ctx, 100)
+		bus.SetLogger(s.log)
+		bus.WithMetrics(registry, time.Minute)
+		bus.(queue.Testable).WithOutboxStore(store)
+		bus.WithRetention(opts)
+
+		ctx, cancel := context.WithCancel(s.ctx)
+		s.T().Cleanup(cancel)
 
 		go func() {
-			err := s.bus.StartProcessing(s.ctx)
-			s.Require().NoError(err)
+			_ = bus.StartProcessing(ctx)
 		}()
+		return registry
+	}
+
+	s.Run("delete", func() {
+		store := queuetest.NewMemoryOutbox(nil)
+		dead := acked("topic", 2*time.Hour)
+		dead.AckStatus = queue.DEAD
+		start(store, queue.RetentionOptions{Period: time.Hour, Interval: time.Hour},
+			acked("topic", 2*time.Hour), acked("topic", time.Minute), dead)
+
+		// only acknowledged events are removed
+		s.Require().Eventually(func() bool {
+			return len(store.Events()) == 2
+		}, time.Second, 10*time.Millisecond)
+		s.Require().Equal([]string{"topic 1m0s", "topic 2h0m0s"}, data(store.Events()))
+		s.Require().Empty(store.Archived())
+	})
+
+	s.Run("archive", func() {
+		store := queuetest.NewMemoryOutbox(nil)
+		start(store, queue.RetentionOptions{Period: time.Hour, Interval: time.Hour, Archive: true},
+			acked("topic", 2*time.Hour), acked("topic", time.Minute))
+
+		s.Require().Eventually(func() bool {
+			return len(store.Archived()) == 1
+		}, time.Second, 10*time.Millisecond)
+		s.Require().Equal([]string{"topic 2h0m0s"}, data(store.Archived()))
+		s.Require().Equal([]string{"topic 1m0s"}, data(store.Events()))
+	})
+
+	s.Run("topic overrides and exclusion", func() {
+		store := queuetest.NewMemoryOutbox(nil)
+		start(store, queue.RetentionOptions{
+			Period:   24 * time.Hour,
+			Topics:   map[string]time.Duration{"short": time.Hour, "audit": 0},
+			Interval: time.Hour,
+		}, acked("short", 2*time.Hour), acked("other", 2*time.Hour), acked("other", 48*time.Hour), acked("audit", 48*time.Hour))
+
+		// a topic with its own period is removed sooner, one kept forever is excluded from the default period
+		s.Require().Eventually(func() bool {
+			return len(store.Events()) == 2
+		}, time.Second, 10*time.Millisecond)
+		s.Require().Equal([]string{"other 2h0m0s", "audit 48h0m0s"}, data(store.Events()))
+	})
+
+	s.Run("batches", func() {
+		store := &batchCountingOutbox{MemoryOutbox: queuetest.NewMemoryOutbox(nil)}
+
+		var events []*queue.OutboxEvent
+		for i := range 5 {
+			events = append(events, acked("topic", time.Duration(i+2)*time.Hour))
+		}
+		registry := start(store, queue.RetentionOptions{Period: time.Hour, Interval: time.Hour, BatchSize: 2}, events...)
+
+		s.Require().Eventually(func() bool {
+			removed, ok := registry.gauge("*/retention/gauge/deleted")
+			return ok && removed == 5
+		}, time.Second, 10*time.Millisecond)
+		s.Require().Empty(store.Events())
+		// two full batches are followed by a partial one, which ends the run
+		s.Require().Equal(int32(3), store.batches.Load())
+	})
+}
+
+func (s *EventBusSuite) TestIdempotentRequiresOutbox() {
+	handled := false
+	handler := queue.Idempotent(s.bus, transactions.NewTrmStub(), func(_ context.Context, _ *queue.Event) queue.AckStatus {
+		handled = true
+		return queue.ACK
+	})
+
+	event := &queue.Event{Topic: "idempotent-topic", Subscriber: "idempotent-topic#0", DedupKey: "key"}
+	s.Require().Equal(queue.NACK, handler(s.ctx, event))
+	s.Require().False(handled)
+	s.Require().Equal(queue.ErrOutboxNotConfigured.Error(), event.LastError)
+}
+
+func (s *EventBusSuite) TestInsertDuplicateEvent() {
+	// expiring the dedup keys touches no row, the first event is inserted and its duplicate skipped
+	db := &recordingDB{rows: []int{0, 1, 0}}
+	repo := queue.NewOutboxRepository(db)
+
+	first := &queue.OutboxEvent{ID: 5, Topic: "dedup-topic", Subscriber: "sub", DedupKey: "key", AckStatus: queue.NACK}
+	duplicate := &queue.OutboxEvent{ID: 7, Topic: "dedup-topic", Subscriber: "sub", DedupKey: "key", AckStatus: queue.NACK}
+
+	s.Require().NoError(repo.InsertEvents(s.ctx, []*queue.OutboxEvent{first, duplicate}, time.Hour))
+	s.Require().Equal(5, first.ID)
+	s.Require().Zero(duplicate.ID)
+
+	statements := db.recorded()
+	s.Require().Len(statements, 3)
+	s.Require().Contains(statements[0], `SET dedup_key = ''`)
+	s.Require().Contains(statements[0], `(ack_status <> 'NACK')`)
+	s.Require().Contains(statements[1], "ON CONFLICT (topic, subscriber, dedup_key) WHERE dedup_key <> '' DO NOTHING")
+	s.Require().Contains(statements[1], "RETURNING *")
+
+	// the key of a pending event outlives the window
+	clock := queuetest.NewFakeClock(time.Now())
+	store := queuetest.NewMemoryOutbox(clock)
+	pending := &queue.OutboxEvent{Topic: "dedup-topic", Subscriber: "sub", DedupKey: "key", AckStatus: queue.NACK}
+	s.Require().NoError(store.InsertEvents(s.ctx, []*queue.OutboxEvent{pending}, time.Hour))
+
+	clock.Advance(2 * time.Hour)
+	late := &queue.OutboxEvent{Topic: "dedup-topic", Subscriber: "sub", DedupKey: "key", AckStatus: queue.NACK}
+	s.Require().NoError(store.InsertEvents(s.ctx, []*queue.OutboxEvent{late}, time.Hour))
+	s.Require().Zero(late.ID)
+}
+
+func (s *EventBusSuite) TestProcessedEventsRetention() {
+	store := queuetest.NewMemoryOutbox(nil)
+
+	bus := queue.NewEventBus(s.ctx, 100)
+	bus.SetLogger(s.log)
+	bus.(queue.Testable).WithOutboxStore(store)
+	bus.WithRetention(queue.RetentionOptions{Processed: time.Hour, Interval: time.Hour})
+
+	expired := &queue.ProcessedEvent{
+		Topic: "processed-topic", Subscriber: "sub", Key: "expired", ProcessedAt: time.Now().Add(-2 * time.Hour).Unix(),
+	}
+	recent := &queue.ProcessedEvent{
+		Topic: "processed-topic", Subscriber: "sub", Key: "recent", ProcessedAt: time.Now().Unix(),
+	}
+	for _, event := range []*queue.ProcessedEvent{expired, recent} {
+		first, err := store.MarkProcessed(s.ctx, event)
+		s.Require().NoError(err)
+		s.Require().True(first)
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	go func() {
+		_ = bus.StartProcessing(ctx)
+	}()
+
+	// the expired record is forgotten, marking its event again is a first time
+	s.Require().Eventually(func() bool {
+		first, err := store.MarkProcessed(s.ctx, expired)
+		return err == nil && first
+	}, time.Second, 10*time.Millisecond)
+
+	first, err := store.MarkProcessed(s.ctx, recent)
+	s.Require().NoError(err)
+	s.Require().False(first)
+}
+
+func (s *EventBusSuite) TestMigrate() {
+	// every statement succeeds, the schema version reads as zero so all migrations are applied
+	newDB := func() *recordingDB {
+		rows := make([]int, 100)
+		for i := range rows {
+			rows[i] = 1
+		}
+		return &recordingDB{rows: rows}
+	}
 
-		defer s.bus.Stop()
+	s.Run("default tables", func() {
+		db := newDB()
+		s.Require().NoError(queue.Migrate(s.ctx, transactions.NewTrmStub(), db))
+
+		statements := db.recorded()
+		s.Require().Equal(`SELECT pg_advisory_xact_lock(hashtext('"outbox_events"'))`, statements[0])
+		s.Require().Contains(statements[1], `CREATE TABLE IF NOT EXISTS "outbox_events_migrations" (`)
+		s.Require().Equal(`SELECT coalesce(max(version), 0) FROM "outbox_events_migrations"`, statements[2])
+		s.Require().Contains(statements[3], `CREATE TABLE IF NOT EXISTS "outbox_events" (`)
+	})
+
+	s.Run("schema and quoting", func() {
+		db := newDB()
+		opts := queue.OutboxOptions{Schema: "queue", Table: `my"events`}
+		s.Require().NoError(queue.Migrate(s.ctx, transactions.NewTrmStub(), db, opts))
+
+		statements := db.recorded()
+		s.Require().Equal(`SELECT pg_advisory_xact_lock(hashtext('"queue"."my""events"'))`, statements[0])
+		s.Require().Equal(`CREATE SCHEMA IF NOT EXISTS "queue"`, statements[1])
+
+		all := strings.Join(statements, "\n")
+		for _, want := range []string{
+			`CREATE TABLE IF NOT EXISTS "queue"."my""events_migrations" (`,
+			`CREATE TABLE IF NOT EXISTS "queue"."my""events" (`,
+			`WHERE i.indrelid = '"queue"."my""events"'::regclass`,
+			// indexes live in the schema of their table, their names are never qualified
+			`CREATE UNIQUE INDEX IF NOT EXISTS "my""events_dedup_key_idx" ON "queue"."my""events"`,
+			`CREATE INDEX IF NOT EXISTS "my""events_pending_idx" ON "queue"."my""events"`,
+			`CREATE TABLE IF NOT EXISTS "queue"."processed_events" (`,
+			`CREATE INDEX IF NOT EXISTS "processed_events_processed_at_idx" ON "queue"."processed_events"`,
+			`CREATE TABLE IF NOT EXISTS "queue"."my""events_archive" (LIKE "queue"."my""events")`,
+		} {
+			s.Require().Contains(all, want)
+		}
+
+		var versions []string
+		for _, statement := range statements {
+			if strings.HasPrefix(statement, `INSERT INTO "queue"."my""events_migrations"`) {
+				versions = append(versions, strings.SplitN(statement, "VALUES (", 2)[1][:1])
+			}
+		}
+		s.Require().Equal([]string{"1", "2", "3", "4", "5", "6", "7", "8"}, versions)
+	})
+}
+
+// TestMigratePostgres migrates a fresh schema of the database at QUEUE_TEST_DATABASE_URL, it is skipped without it.
+func (s *EventBusSuite) TestMigratePostgres() {
+	dbURL := os.Getenv("QUEUE_TEST_DATABASE_URL")
+	if dbURL == "" {
+		s.T().Skip("QUEUE_TEST_DATABASE_URL is not set")
+	}
+
+	db := repository_testing.InitDB(s.ctx, s.T(), dbURL)
+	defer db.Close()
+
+	schema := fmt.Sprintf("queue_test_%d", time.Now().UnixNano())
+	defer func() {
+		_, err := db.ExecContext(s.ctx, "DROP SCHEMA IF EXISTS ? CASCADE", pg.Ident(schema))
+		s.Require().NoError(err)
+	}()
+
+	factory := transactions.NewPgTransactionFactory(db)
+	trm := transactions.NewPgTransactionManager(factory, transactions.Options{})
+	opts := queue.OutboxOptions{Schema: schema, Table: "events"}
+
+	// migrating again is a no-op
+	s.Require().NoError(queue.Migrate(s.ctx, trm, factory, opts))
+	s.Require().NoError(queue.Migrate(s.ctx, trm, factory, opts))
+
+	var applied int
+	_, err := db.QueryOneContext(s.ctx, pg.Scan(&applied), "SELECT count(*) FROM ?", pg.Ident(schema+".events_migrations"))
+	s.Require().NoError(err)
+	s.Require().Equal(8, applied)
+
+	repo := queue.NewOutboxRepository(factory, opts)
+
+	event := &queue.OutboxEvent{Topic: "migrated-topic", Subscriber: "sub", DedupKey: "key", AckStatus: queue.NACK}
+	duplicate := &queue.OutboxEvent{Topic: "migrated-topic", Subscriber: "sub", DedupKey: "key", AckStatus: queue.NACK}
+	s.Require().NoError(repo.InsertEvents(s.ctx, []*queue.OutboxEvent{event}, time.Hour))
+	s.Require().NoError(repo.InsertEvents(s.ctx, []*queue.OutboxEvent{duplicate}, time.Hour))
+	s.Require().NotZero(event.ID)
+	s.Require().Zero(duplicate.ID)
+
+	pending, err := repo.LoadPendingEvents(s.ctx)
+	s.Require().NoError(err)
+	s.Require().Len(pending, 1)
+
+	first, err := repo.MarkProcessed(s.ctx, &queue.ProcessedEvent{Topic: "migrated-topic", Subscriber: "sub", Key: "key"})
+	s.Require().NoError(err)
+	s.Require().True(first)
+
+	deleted, err := repo.DeleteProcessedEvents(s.ctx, time.Now(), 10)
+	s.Require().NoError(err)
+	s.Require().Equal(1, deleted)
+}
+
+func (s *EventBusSuite) TestPublishCtx() {
+	received := make(chan string, 2)
+
+	s.bus.Subscribe("tx-topic", func(_ context.Context, event *queue.Event) queue.AckStatus {
+		received <- string(event.Data)
+		return queue.ACK
+	}, nil, time.Second)
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	go func() {
+		err := s.bus.StartProcessing(ctx)
+		s.Require().NoError(err)
+	}()
+
+	trm := transactions.NewTrmStub()
+
+	s.Run("rolled back transaction is not delivered", func() {
+		err := trm.Do(s.ctx, func(ctx context.Context) error {
+			s.Require().NoError(s.bus.PublishCtx(ctx, "tx-topic", []byte("rolled back")))
+			return errors.New("rollback")
+		})
+		s.Require().Error(err)
+	})
+
+	s.Run("committed transaction is delivered after commit", func() {
+		err := trm.Do(s.ctx, func(ctx context.Context) error {
+			s.Require().NoError(s.bus.PublishCtx(ctx, "tx-topic", []byte("committed")))
+
+			select {
+			case <-received:
+				s.FailNow("Event was delivered before commit")
+			case <-time.After(100 * time.Millisecond):
+			}
+
+			return nil
+		})
+		s.Require().NoError(err)
 
 		select {
-		case <-received:
-			s.T().Log("Event processed successfully after retries")
-		case <-time.After(4 * time.Second):
-			s.FailNow("Event was not processed successfully within the expected time")
+		case data := <-received:
+			s.Require().Equal("committed", data)
+		case <-time.After(time.Second):
+			s.FailNow("Event was not delivered after commit")
+		}
+	})
+}
+
+func (s *EventBusSuite) TestPublishAfter() {
+	h := queuetest.New(s.T())
+	h.Bus.Subscribe("scheduled-topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+		return queue.ACK
+	}, nil, time.Second, queue.SubscribeOptions{Name: "sub"})
+	h.Start()
+
+	publishedAt := h.Clock.Now()
+	s.Require().NoError(h.Bus.PublishAfter(s.ctx, "scheduled-topic", []byte("Test Event"), 300*time.Millisecond))
+
+	h.Advance(299 * time.Millisecond)
+	h.AssertDelivered("scheduled-topic", []byte("Test Event"), 0)
+
+	h.Advance(time.Millisecond)
+	deliveries := h.Deliveries("scheduled-topic")
+	s.Require().Len(deliveries, 1)
+	s.Require().Equal(300*time.Millisecond, deliveries[0].At.Sub(publishedAt))
+}
+
+func (s *EventBusSuite) TestRetryPolicies() {
+	s.Run("delays", func() {
+		policy := queue.NewDelaysPolicy([]int{1, 2}, time.Second)
+
+		delay, ok := policy.Next(&queue.Event{Retry: 1})
+		s.Require().True(ok)
+		s.Require().Equal(2*time.Second, delay)
+
+		_, ok = policy.Next(&queue.Event{Retry: 2})
+		s.Require().False(ok)
+	})
+
+	s.Run("linear", func() {
+		policy := queue.LinearPolicy{Initial: time.Second, Step: time.Second, Retries: 3}
+
+		delay, ok := policy.Next(&queue.Event{Retry: 2})
+		s.Require().True(ok)
+		s.Require().Equal(3*time.Second, delay)
+
+		_, ok = policy.Next(&queue.Event{Retry: 3})
+		s.Require().False(ok)
+	})
+
+	s.Run("exponential", func() {
+		policy := queue.ExponentialPolicy{Initial: time.Second, Multiplier: 2, Max: 5 * time.Second, Retries: 5}
+
+		delay, ok := policy.Next(&queue.Event{Retry: 2})
+		s.Require().True(ok)
+		s.Require().Equal(4*time.Second, delay)
+
+		delay, ok = policy.Next(&queue.Event{Retry: 3})
+		s.Require().True(ok)
+		s.Require().Equal(5*time.Second, delay)
+	})
+
+	s.Run("exponential with jitter", func() {
+		policy := queue.ExponentialPolicy{Initial: time.Second, Jitter: 0.5, Retries: 1}
+
+		for i := 0; i < 100; i++ {
+			delay, ok := policy.Next(&queue.Event{})
+			s.Require().True(ok)
+			s.Require().GreaterOrEqual(delay, 500*time.Millisecond)
+			s.Require().LessOrEqual(delay, 1500*time.Millisecond)
 		}
 	})
+
+	s.Run("max elapsed", func() {
+		policy := queue.MaxElapsedPolicy{
+			Policy:     queue.FixedPolicy{Delay: time.Minute, Retries: 10},
+			MaxElapsed: time.Hour,
+		}
+
+		_, ok := policy.Next(&queue.Event{CreatedAt: time.Now().Add(-30 * time.Minute)})
+		s.Require().True(ok)
+
+		_, ok = policy.Next(&queue.Event{CreatedAt: time.Now().Add(-time.Hour)})
+		s.Require().False(ok)
+	})
+
+	s.Run("retry after hint", func() {
+		var calls atomic.Int32
+
+		h := queuetest.New(s.T())
+		h.Bus.Subscribe("throttled-topic", func(_ context.Context, event *queue.Event) queue.AckStatus {
+			if calls.Add(1) == 1 {
+				event.SetRetryAfter(200 * time.Millisecond)
+				return queue.NACK
+			}
+			return queue.ACK
+		}, nil, 0, queue.SubscribeOptions{Name: "sub", RetryPolicy: queue.FixedPolicy{Delay: time.Hour, Retries: 1}})
+
+		s.Require().NoError(h.Bus.Publish("throttled-topic", []byte("Test Event")))
+		h.Start()
+		h.RunUntilIdle()
+
+		deliveries := h.Deliveries("throttled-topic")
+		s.Require().Len(deliveries, 2)
+		s.Require().Equal(queue.ACK, deliveries[1].Status)
+		s.Require().Equal(200*time.Millisecond, deliveries[1].At.Sub(deliveries[0].At))
+	})
+}
+
+func (s *EventBusSuite) TestSubscribersAreIndependent() {
+	var first, second atomic.Int32
+
+	h := queuetest.New(s.T())
+	h.Bus.Subscribe("fan-out-topic", func(_ context.Context, event *queue.Event) queue.AckStatus {
+		s.Require().Equal("first", event.Subscriber)
+		first.Add(1)
+		return queue.ACK
+	}, []int{10}, time.Millisecond, queue.SubscribeOptions{Name: "first"})
+
+	h.Bus.Subscribe("fan-out-topic", func(_ context.Context, event *queue.Event) queue.AckStatus {
+		s.Require().Equal("second", event.Subscriber)
+		if second.Add(1) == 1 {
+			return queue.NACK
+		}
+		return queue.ACK
+	}, []int{10}, time.Millisecond, queue.SubscribeOptions{Name: "second"})
+
+	s.Require().NoError(h.Bus.Publish("fan-out-topic", []byte("Test Event")))
+	h.Start()
+	h.RunUntilIdle()
+
+	s.Require().Equal(int32(1), first.Load())
+	s.Require().Equal(int32(2), second.Load())
+}
+
+func (s *EventBusSuite) TestPublishBeforeSubscribe() {
+	received := make(chan string, 2)
+
+	s.Require().NoError(s.bus.Publish("late-topic", []byte("Test Event")))
+
+	for _, name := range []string{"first", "second"} {
+		s.bus.Subscribe("late-topic", func(_ context.Context, event *queue.Event) queue.AckStatus {
+			received <- event.Subscriber
+			return queue.ACK
+		}, nil, time.Second, queue.SubscribeOptions{Name: name})
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	go func() {
+		err := s.bus.StartProcessing(ctx)
+		s.Require().NoError(err)
+	}()
+
+	subscribers := make([]string, 0, 2)
+	for i := 0; i < 2; i++ {
+		select {
+		case name := <-received:
+			subscribers = append(subscribers, name)
+		case <-time.After(time.Second):
+			s.FailNow("Event was not delivered to every subscriber")
+		}
+	}
+
+	s.Require().ElementsMatch([]string{"first", "second"}, subscribers)
+}
+
+func (s *EventBusSuite) TestShutdown() {
+	s.Run("waits for in-flight handlers", func() {
+		bus := queue.NewEventBus(s.ctx, 100)
+		bus.SetLogger(s.log)
+
+		started := make(chan struct{})
+		var finished atomic.Bool
+
+		bus.Subscribe("slow-topic", func(ctx context.Context, _ *queue.Event) queue.AckStatus {
+			close(started)
+			time.Sleep(200 * time.Millisecond)
+			finished.Store(ctx.Err() == nil)
+			return queue.ACK
+		}, nil, time.Second)
+
+		s.Require().NoError(bus.Publish("slow-topic", []byte("Test Event")))
+
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			err := bus.StartProcessing(s.ctx)
+			s.Require().NoError(err)
+		}()
+
+		<-started
+
+		ctx, cancel := context.WithTimeout(s.ctx, time.Second)
+		defer cancel()
+
+		s.Require().NoError(bus.Shutdown(ctx))
+		s.Require().True(finished.Load())
+		s.Require().ErrorIs(bus.PublishCtx(s.ctx, "slow-topic", []byte("Test Event")), queue.ErrBusClosed)
+
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			s.FailNow("Processing did not stop after shutdown")
+		}
+	})
+
+	s.Run("reports what was left at the deadline", func() {
+		bus := queue.NewEventBus(s.ctx, 100)
+		bus.SetLogger(s.log)
+
+		started := make(chan struct{})
+
+		bus.Subscribe("stuck-topic", func(ctx context.Context, _ *queue.Event) queue.AckStatus {
+			close(started)
+			<-ctx.Done()
+			return queue.NACK
+		}, nil, time.Second)
+
+		nacked := make(chan struct{})
+
+		bus.Subscribe("retried-topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+			close(nacked)
+			return queue.NACK
+		}, []int{1}, time.Hour)
+
+		s.Require().NoError(bus.Publish("stuck-topic", []byte("Test Event")))
+		s.Require().NoError(bus.Publish("retried-topic", []byte("Test Event")))
+
+		go func() {
+			err := bus.StartProcessing(s.ctx)
+			s.Require().NoError(err)
+		}()
+
+		<-started
+		<-nacked
+		s.Require().Eventually(func() bool {
+			return bus.PoolStats().InFlight == 1
+		}, time.Second, 10*time.Millisecond)
+
+		ctx, cancel := context.WithTimeout(s.ctx, 100*time.Millisecond)
+		defer cancel()
+
+		err := bus.Shutdown(ctx)
+
+		var shutdownErr *queue.ShutdownError
+		s.Require().ErrorAs(err, &shutdownErr)
+		s.Require().ErrorIs(err, context.DeadlineExceeded)
+		s.Require().Equal(1, shutdownErr.InFlight)
+		s.Require().Equal(1, shutdownErr.Scheduled)
+	})
+
+	s.Run("persists retries scheduled while draining", func() {
+		store := queuetest.NewMemoryOutbox(nil)
+		bus := queue.NewEventBus(s.ctx, 100)
+		bus.SetLogger(s.log)
+		bus.(queue.Testable).WithOutboxStore(store)
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+
+		bus.Subscribe("draining-topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+			close(started)
+			<-release
+			return queue.NACK
+		}, []int{1}, time.Hour, queue.SubscribeOptions{Name: "sub"})
+
+		go func() {
+			_ = bus.StartProcessing(s.ctx)
+		}()
+		s.Require().NoError(bus.Publish("draining-topic", []byte("Test Event")))
+		<-started
+
+		shutdown := make(chan error, 1)
+		go func() {
+			shutdown <- bus.Shutdown(s.ctx)
+		}()
+
+		// the handler only fails once the bus is draining
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+
+		var shutdownErr *queue.ShutdownError
+		s.Require().ErrorAs(<-shutdown, &shutdownErr)
+		s.Require().Equal(1, shutdownErr.Scheduled)
+
+		events := store.Events()
+		s.Require().Len(events, 1)
+		s.Require().Equal(queue.NACK, events[0].AckStatus)
+		s.Require().Equal(1, events[0].Retry)
+	})
+}
+
+func (s *EventBusSuite) TestHeadersPropagation() {
+	type result struct {
+		requestID string
+		publicKey string
+		headers   map[string]string
+	}
+
+	received := make(chan result, 1)
+
+	s.bus.WithPropagators(queue.PublisherPropagator("billing"))
+	s.bus.Subscribe("headers-topic", func(ctx context.Context, event *queue.Event) queue.AckStatus {
+		received <- result{
+			requestID: helper.GetRequestID(ctx),
+			publicKey: helper.GetPublicKey(ctx),
+			headers:   event.Headers,
+		}
+		return queue.ACK
+	}, nil, time.Second)
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	go func() {
+		err := s.bus.StartProcessing(ctx)
+		s.Require().NoError(err)
+	}()
+
+	publishCtx := helper.SetRequestID(s.ctx, "reqid://test")
+	publishCtx = context.WithValue(publishCtx, helper.PublicKey, "0xabc")
+
+	s.Require().NoError(s.bus.PublishCtx(publishCtx, "headers-topic", []byte("Test Event")))
+
+	select {
+	case res := <-received:
+		s.Require().Equal("reqid://test", res.requestID)
+		s.Require().Equal("0xabc", res.publicKey)
+		s.Require().Equal("billing", res.headers[queue.HeaderPublisher])
+		s.Require().Equal("reqid://test", res.headers[queue.HeaderRequestID])
+	case <-time.After(time.Second):
+		s.FailNow("Event was not delivered within the expected time")
+	}
+}
+
+type recordedSpan struct {
+	lock   *sync.Mutex
+	name   string
+	attrs  map[string]any
+	errMsg string
+	ended  bool
+}
+
+func (s *recordedSpan) End() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ended = true
+}
+
+func (s *recordedSpan) RecordError(_ error) {}
+
+func (s *recordedSpan) SetError(description string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.errMsg = description
+}
+
+func (s *recordedSpan) SetAttributeInt(k string, v int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attrs[k] = v
+}
+
+func (s *recordedSpan) SetAttributeString(k string, v string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attrs[k] = v
+}
+
+type recordingTracer struct {
+	lock  sync.Mutex
+	spans []*recordedSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, spanName string) (context.Context, queue.Span) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	span := &recordedSpan{lock: &t.lock, name: spanName, attrs: make(map[string]any)}
+	t.spans = append(t.spans, span)
+	return ctx, span
+}
+
+// find returns copies of the ended spans with the given name.
+func (t *recordingTracer) find(name string) []recordedSpan {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var spans []recordedSpan
+	for _, span := range t.spans {
+		if span.name == name && span.ended {
+			attrs := make(map[string]any, len(span.attrs))
+			for k, v := range span.attrs {
+				attrs[k] = v
+			}
+			spans = append(spans, recordedSpan{name: span.name, attrs: attrs, errMsg: span.errMsg, ended: true})
+		}
+	}
+	return spans
+}
+
+func (s *EventBusSuite) TestTracing() {
+	tracer := &recordingTracer{}
+	s.bus.WithTracer(tracer)
+
+	s.bus.Subscribe("traced-topic", func(_ context.Context, event *queue.Event) queue.AckStatus {
+		if event.Retry == 0 {
+			event.SetError(errors.New("not yet"))
+			return queue.NACK
+		}
+		return queue.ACK
+	}, []int{10}, time.Millisecond)
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	go func() {
+		err := s.bus.StartProcessing(ctx)
+		s.Require().NoError(err)
+	}()
+
+	s.Require().NoError(s.bus.PublishCtx(s.ctx, "traced-topic", []byte("Test Event")))
+
+	s.Require().Eventually(func() bool {
+		return len(tracer.find("process traced-topic")) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	publish := tracer.find("publish traced-topic")
+	s.Require().Len(publish, 1)
+	s.Require().Equal("traced-topic", publish[0].attrs[queue.SpanAttrTopic])
+
+	process := tracer.find("process traced-topic")
+	s.Require().Equal(string(queue.NACK), process[0].attrs[queue.SpanAttrAckStatus])
+	s.Require().Equal("not yet", process[0].errMsg)
+	s.Require().Equal(string(queue.ACK), process[1].attrs[queue.SpanAttrAckStatus])
+	s.Require().Equal(1, process[1].attrs[queue.SpanAttrRetry])
+}
+
+// traceKey keeps the trace of a propagatingTracer in the context.
+type traceKey struct{}
+
+// propagatingTracer is a recordingTracer that propagates the name of the span started on publish as traceparent.
+type propagatingTracer struct {
+	*recordingTracer
+}
+
+func (t propagatingTracer) Start(ctx context.Context, spanName string) (context.Context, queue.Span) {
+	if ctx.Value(traceKey{}) == nil {
+		ctx = context.WithValue(ctx, traceKey{}, spanName)
+	}
+	return t.recordingTracer.Start(ctx, spanName)
+}
+
+func (propagatingTracer) Inject(ctx context.Context, headers map[string]string) {
+	if trace, ok := ctx.Value(traceKey{}).(string); ok {
+		headers[queue.HeaderTraceparent] = trace
+	}
+}
+
+func (propagatingTracer) Extract(ctx context.Context, headers map[string]string) context.Context {
+	if trace, ok := headers[queue.HeaderTraceparent]; ok {
+		ctx = context.WithValue(ctx, traceKey{}, trace)
+	}
+	return ctx
+}
+
+func (s *EventBusSuite) TestTracerPropagatesTraceContext() {
+	s.bus.WithTracer(propagatingTracer{recordingTracer: &recordingTracer{}})
+
+	type delivery struct {
+		header string
+		trace  any
+	}
+	delivered := make(chan delivery, 1)
+	s.bus.Subscribe("propagated-topic", func(ctx context.Context, event *queue.Event) queue.AckStatus {
+		delivered <- delivery{header: event.Headers[queue.HeaderTraceparent], trace: ctx.Value(traceKey{})}
+		return queue.ACK
+	}, nil, time.Second)
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	go func() {
+		_ = s.bus.StartProcessing(ctx)
+	}()
+
+	s.Require().NoError(s.bus.PublishCtx(s.ctx, "propagated-topic", []byte("Test Event")))
+
+	select {
+	case got := <-delivered:
+		s.Require().Equal("publish propagated-topic", got.header)
+		s.Require().Equal("publish propagated-topic", got.trace)
+	case <-time.After(time.Second):
+		s.Fail("event not delivered")
+	}
+}
+
+type recordingRegistry struct {
+	lock      sync.Mutex
+	counts    map[string]int
+	durations map[string]int
+	gauges    map[string]float64
+}
+
+func newRecordingRegistry() *recordingRegistry {
+	return &recordingRegistry{
+		counts:    make(map[string]int),
+		durations: make(map[string]int),
+		gauges:    make(map[string]float64),
+	}
+}
+
+func metricKey(labels prometheus.Labels) string {
+	return labels["sub_type"] + "/" + labels["operation"] + "/" + labels["status"] + "/" + labels["message"]
+}
+
+func (r *recordingRegistry) Inc(_ string, labels prometheus.Labels) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.counts[metricKey(labels)]++
+}
+
+func (r *recordingRegistry) RecordDuration(_ string, labels prometheus.Labels, _ float64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.durations[metricKey(labels)]++
+}
+
+func (r *recordingRegistry) SetGauge(_ string, labels prometheus.Labels, value float64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.gauges[metricKey(labels)] = value
+}
+
+func (r *recordingRegistry) PrometheusRegistry() *prometheus.Registry {
+	return nil
+}
+
+func (r *recordingRegistry) count(key string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.counts[key]
+}
+
+func (r *recordingRegistry) duration(key string) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.durations[key]
+}
+
+func (r *recordingRegistry) gauge(key string) (float64, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	value, ok := r.gauges[key]
+	return value, ok
+}
+
+func (s *EventBusSuite) TestMetrics() {
+	registry := newRecordingRegistry()
+
+	h := queuetest.New(s.T())
+	h.Bus.WithMetrics(registry, time.Minute)
+	h.Bus.Subscribe("metered-topic", func(_ context.Context, event *queue.Event) queue.AckStatus {
+		if string(event.Data) == "fail" {
+			return queue.NACK
+		}
+		return queue.ACK
+	}, []int{10}, time.Millisecond, queue.SubscribeOptions{Name: "metered"})
+	h.Start()
+
+	s.Require().NoError(h.Bus.PublishCtx(s.ctx, "metered-topic", []byte("ok")))
+	s.Require().NoError(h.Bus.PublishCtx(s.ctx, "metered-topic", []byte("fail")))
+	h.WaitIdle()
+	s.Require().Zero(registry.count("metered-topic/dead_letter/info/metered"))
+
+	h.Advance(10 * time.Millisecond)
+	s.Require().Equal(1, registry.count("metered-topic/dead_letter/info/metered"))
+	s.Require().Equal(2, registry.count("metered-topic/publish/success/"))
+	s.Require().Equal(1, registry.count("metered-topic/ack/info/metered"))
+	s.Require().Equal(2, registry.count("metered-topic/nack/info/metered"))
+	s.Require().Equal(1, registry.count("metered-topic/retry/info/metered"))
+	s.Require().Equal(3, registry.duration("metered-topic/handle/duration/metered"))
+
+	_, ok := registry.gauge("metered-topic/queue_depth/gauge/")
+	s.Require().False(ok)
+
+	h.Advance(time.Minute)
+	depth, ok := registry.gauge("metered-topic/queue_depth/gauge/")
+	s.Require().True(ok)
+	s.Require().Zero(depth)
+}
+
+func (s *EventBusSuite) TestMetricsWithoutGauges() {
+	registry := newRecordingRegistry()
+
+	h := queuetest.New(s.T())
+	// only the methods of metrics.Registry are promoted, the bus cannot set gauges through it
+	h.Bus.WithMetrics(struct{ metrics.Registry }{registry}, time.Minute)
+	h.Bus.Subscribe("counted-topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+		return queue.ACK
+	}, nil, time.Millisecond, queue.SubscribeOptions{Name: "counted"})
+	h.Start()
+
+	s.Require().NoError(h.Bus.PublishCtx(s.ctx, "counted-topic", []byte("ok")))
+	h.Advance(time.Minute)
+
+	s.Require().Equal(1, registry.count("counted-topic/ack/info/counted"))
+	_, ok := registry.gauge("counted-topic/queue_depth/gauge/")
+	s.Require().False(ok)
+}
+
+func (s *EventBusSuite) TestMetricsSampleOnTheClock() {
+	registry := newRecordingRegistry()
+
+	h := queuetest.New(s.T())
+	h.Bus.WithMetrics(registry, time.Minute)
+	h.Bus.Subscribe("sampled-topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+		return queue.ACK
+	}, nil, time.Second, queue.SubscribeOptions{Name: "sampled"})
+	h.Bus.Pause("sampled-topic")
+	h.Start()
+
+	s.Require().NoError(h.Bus.Publish("sampled-topic", []byte("parked")))
+	h.WaitIdle()
+
+	_, ok := registry.gauge("sampled-topic/backlog_age/gauge/")
+	s.Require().False(ok)
+
+	h.Advance(time.Minute)
+	age, ok := registry.gauge("sampled-topic/backlog_age/gauge/")
+	s.Require().True(ok)
+	s.Equal(time.Minute.Seconds(), age)
+}
+
+func (s *EventBusSuite) TestOrderingKey() {
+	var failed atomic.Bool
+
+	h := queuetest.New(s.T())
+	h.Bus.Subscribe("ordered-topic", func(_ context.Context, event *queue.Event) queue.AckStatus {
+		if string(event.Data) == "a1" && !failed.Swap(true) {
+			return queue.NACK
+		}
+		return queue.ACK
+	}, []int{100}, time.Millisecond, queue.SubscribeOptions{Name: "sub"})
+	h.Start()
+
+	for _, data := range []string{"a1", "a2", "b1", "a3"} {
+		key := data[:1]
+		s.Require().NoError(h.Bus.PublishCtx(s.ctx, "ordered-topic", []byte(data), queue.PublishOptions{OrderingKey: key}))
+	}
+	h.RunUntilIdle()
+
+	var handled []string
+	for _, delivery := range h.Deliveries("ordered-topic") {
+		if delivery.Status == queue.ACK {
+			handled = append(handled, string(delivery.Data))
+		}
+	}
+
+	// b1 does not wait for the retry of a1, a2 and a3 do
+	s.Require().Equal([]string{"b1", "a1", "a2", "a3"}, handled)
+}
+
+func (s *EventBusSuite) TestHandlerPanicAndTimeout() {
+	var panics, timeouts atomic.Int32
+
+	s.bus.Subscribe("panic-topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+		if panics.Add(1) == 1 {
+			panic("boom")
+		}
+		return queue.ACK
+	}, []int{10}, time.Millisecond)
+
+	s.bus.Subscribe("timeout-topic", func(ctx context.Context, _ *queue.Event) queue.AckStatus {
+		if timeouts.Add(1) == 1 {
+			// hang past the timeout, ignoring the cancellation for a while
+			<-ctx.Done()
+			time.Sleep(50 * time.Millisecond)
+		}
+		return queue.ACK
+	}, []int{10}, time.Millisecond, queue.SubscribeOptions{Timeout: 20 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	go func() {
+		err := s.bus.StartProcessing(ctx)
+		s.Require().NoError(err)
+	}()
+
+	s.Require().NoError(s.bus.Publish("panic-topic", []byte("Test Event")))
+	s.Require().NoError(s.bus.Publish("timeout-topic", []byte("Test Event")))
+
+	// both events are retried after the failed first attempt
+	s.Require().Eventually(func() bool {
+		return panics.Load() == 2 && timeouts.Load() == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func (s *EventBusSuite) TestTimedOutHandlerHoldsItsWorker() {
+	var calls atomic.Int32
+	hung := make(chan struct{})
+
+	s.bus.Subscribe("hung-topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+		if calls.Add(1) == 1 {
+			// ignore the cancellation until released
+			<-hung
+		}
+		return queue.ACK
+	}, []int{10}, time.Millisecond, queue.SubscribeOptions{Concurrency: 1, Timeout: 20 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	go func() {
+		err := s.bus.StartProcessing(ctx)
+		s.Require().NoError(err)
+	}()
+
+	s.Require().NoError(s.bus.Publish("hung-topic", []byte("first")))
+	s.Require().NoError(s.bus.Publish("hung-topic", []byte("second")))
+
+	// the attempt is failed once timed out, but the only worker of the topic waits for the handler
+	time.Sleep(100 * time.Millisecond)
+	s.Require().Equal(int32(1), calls.Load())
+	s.Require().Equal(1, s.bus.PoolStats().Topics["hung-topic"].InFlight)
+
+	close(hung)
+
+	// the second event and the retry of the first one are handled once the handler returned
+	s.Require().Eventually(func() bool {
+		return calls.Load() == 3
+	}, time.Second, 10*time.Millisecond)
+}
+
+func (s *EventBusSuite) TestTimedOutHandlerDelaysItsRetry() {
+	var calls, running, overlapped atomic.Int32
+	hung := make(chan struct{})
+
+	s.bus.Subscribe("hung-topic", func(_ context.Context, event *queue.Event) queue.AckStatus {
+		if running.Add(1) > 1 {
+			overlapped.Add(1)
+		}
+		defer running.Add(-1)
+
+		event.Headers["attempt"] = fmt.Sprint(event.Retry)
+		if calls.Add(1) == 1 {
+			// ignore the cancellation until released
+			<-hung
+		}
+		return queue.ACK
+	}, []int{1}, time.Millisecond, queue.SubscribeOptions{Concurrency: 2, Timeout: 20 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	go func() {
+		err := s.bus.StartProcessing(ctx)
+		s.Require().NoError(err)
+	}()
+
+	s.Require().NoError(s.bus.Publish("hung-topic", []byte("event"), queue.PublishOptions{
+		Headers: map[string]string{"origin": "test"},
+	}))
+
+	// the retry is only scheduled once the timed out handler returned, the other worker stays idle
+	time.Sleep(100 * time.Millisecond)
+	s.Require().Equal(int32(1), calls.Load())
+
+	close(hung)
+
+	s.Require().Eventually(func() bool {
+		return calls.Load() == 2
+	}, time.Second, 10*time.Millisecond)
+	s.Require().Zero(overlapped.Load())
+}
+
+func (s *EventBusSuite) TestMiddlewares() {
+	var (
+		lock  sync.Mutex
+		calls []string
+	)
+	record := func(name string) queue.Middleware {
+		return func(next queue.EventHandler) queue.EventHandler {
+			return func(ctx context.Context, event *queue.Event) queue.AckStatus {
+				lock.Lock()
+				calls = append(calls, name)
+				lock.Unlock()
+				return next(ctx, event)
+			}
+		}
+	}
+
+	s.bus.Use(record("bus-1"), record("bus-2"))
+	s.bus.Subscribe("middleware-topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+		lock.Lock()
+		calls = append(calls, "handler")
+		lock.Unlock()
+		return queue.ACK
+	}, []int{10}, time.Millisecond, queue.SubscribeOptions{Middlewares: []queue.Middleware{record("subscription")}})
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	go func() {
+		err := s.bus.StartProcessing(ctx)
+		s.Require().NoError(err)
+	}()
+
+	s.Require().NoError(s.bus.Publish("middleware-topic", []byte("Test Event")))
+
+	s.Require().Eventually(func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(calls) == 4
+	}, time.Second, 10*time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+	s.Require().Equal([]string{"bus-1", "bus-2", "subscription", "handler"}, calls)
+}
+
+func (s *EventBusSuite) TestBuiltInMiddlewares() {
+	panicking := func(_ context.Context, _ *queue.Event) queue.AckStatus {
+		panic("boom")
+	}
+	event := &queue.Event{Topic: "middleware-topic"}
+	s.Require().Equal(queue.NACK, queue.RecoveryMiddleware(s.log)(panicking)(s.ctx, event))
+	s.Require().Equal("event handler panic: boom", event.LastError)
+
+	slow := func(ctx context.Context, _ *queue.Event) queue.AckStatus {
+		<-ctx.Done()
+		return queue.ACK
+	}
+	event = &queue.Event{Topic: "middleware-topic"}
+	s.Require().Equal(queue.NACK, queue.TimeoutMiddleware(10*time.Millisecond)(slow)(s.ctx, event))
+	s.Require().Equal(queue.ErrHandlerTimeout.Error(), event.LastError)
+
+	registry := newRecordingRegistry()
+	tracer := &recordingTracer{}
+	handler := queue.LoggingMiddleware(s.log)(queue.MetricsMiddleware(registry)(queue.TracingMiddleware(tracer)(
+		func(_ context.Context, _ *queue.Event) queue.AckStatus { return queue.ACK },
+	)))
+	event = &queue.Event{Topic: "middleware-topic", Subscriber: "middleware"}
+	s.Require().Equal(queue.ACK, handler(s.ctx, event))
+	s.Require().Equal(1, registry.count("middleware-topic/handler/success/"))
+	s.Require().Equal(1, registry.duration("middleware-topic/handler/duration/middleware"))
+	s.Require().Len(tracer.find("handle middleware-topic"), 1)
+}
+
+type typedEvent struct {
+	Name  string `json:"name" msgpack:"name"`
+	Count int    `json:"count" msgpack:"count"`
+}
+
+func (s *EventBusSuite) TestTypedPubSub() {
+	registry := newRecordingRegistry()
+	s.bus.WithMetrics(registry, time.Minute)
+
+	received := make(chan typedEvent, 1)
+	queue.SubscribeTyped(s.bus, queue.JSONCodec{}, "typed-topic",
+		func(_ context.Context, event *queue.Event, value typedEvent) queue.AckStatus {
+			s.Require().Equal(queue.ContentTypeJSON, event.Headers[queue.HeaderContentType])
+			received <- value
+			return queue.ACK
+		}, []int{10, 10}, time.Millisecond, queue.SubscribeOptions{Name: "typed"})
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	go func() {
+		err := s.bus.StartProcessing(ctx)
+		s.Require().NoError(err)
+	}()
+
+	s.Require().NoError(queue.PublishTyped(s.ctx, s.bus, queue.JSONCodec{}, "typed-topic", typedEvent{Name: "a", Count: 1}))
+	s.Require().Equal(typedEvent{Name: "a", Count: 1}, <-received)
+
+	// undecodable events are dead-lettered without retries
+	s.Require().NoError(s.bus.Publish("typed-topic", []byte("not json")))
+	s.Require().NoError(queue.PublishTyped(s.ctx, s.bus, queue.MsgpackCodec{}, "typed-topic", typedEvent{Name: "b"}))
+
+	s.Require().Eventually(func() bool {
+		return registry.count("typed-topic/dead_letter/info/typed") == 2
+	}, time.Second, 10*time.Millisecond)
+	s.Require().Zero(registry.count("typed-topic/retry/info/typed"))
+	s.Require().Empty(received)
+}
+
+func (s *EventBusSuite) TestCodecs() {
+	msg := wrapperspb.String("value")
+	data, err := queue.ProtobufCodec{}.Marshal(msg)
+	s.Require().NoError(err)
+
+	var decoded *wrapperspb.StringValue
+	s.Require().NoError(queue.ProtobufCodec{}.Unmarshal(data, &decoded))
+	s.Require().Equal("value", decoded.GetValue())
+
+	_, err = queue.ProtobufCodec{}.Marshal(typedEvent{})
+	s.Require().Error(err)
+
+	data, err = queue.MsgpackCodec{}.Marshal(typedEvent{Name: "a", Count: 2})
+	s.Require().NoError(err)
+
+	var value typedEvent
+	s.Require().NoError(queue.MsgpackCodec{}.Unmarshal(data, &value))
+	s.Require().Equal(typedEvent{Name: "a", Count: 2}, value)
+}
+
+func (s *EventBusSuite) TestMemorySink() {
+	registry := newRecordingRegistry()
+	s.bus.WithMetrics(registry, time.Minute)
+
+	sink := queue.NewMemorySink("memory")
+	sink.FailWith(errors.New("unavailable"))
+	s.bus.RelayTo("sink-topic", sink, []int{50, 50, 50, 50}, time.Millisecond)
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	go func() {
+		err := s.bus.StartProcessing(ctx)
+		s.Require().NoError(err)
+	}()
+
+	s.Require().NoError(s.bus.Publish("sink-topic", []byte("payload"), queue.PublishOptions{Headers: map[string]string{"x-key": "value"}}))
+
+	s.Require().Eventually(func() bool {
+		return registry.count("sink-topic/retry/info/sink:memory") >= 1
+	}, time.Second, 10*time.Millisecond)
+	sink.FailWith(nil)
+
+	s.Require().Eventually(func() bool {
+		return len(sink.Events()) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	event := sink.Events()[0]
+	s.Require().Equal("payload", string(event.Data))
+	s.Require().Equal("value", event.Headers["x-key"])
+	s.Require().Equal("sink:memory", event.Subscriber)
+
+	// rejected events are dead-lettered without retries
+	retries := registry.count("sink-topic/retry/info/sink:memory")
+	sink.FailWith(fmt.Errorf("%w: invalid", queue.ErrSinkRejected))
+	s.Require().NoError(s.bus.Publish("sink-topic", []byte("invalid")))
+
+	s.Require().Eventually(func() bool {
+		return registry.count("sink-topic/dead_letter/info/sink:memory") == 1
+	}, time.Second, 10*time.Millisecond)
+	s.Require().Equal(retries, registry.count("sink-topic/retry/info/sink:memory"))
+}
+
+func (s *EventBusSuite) TestWebhookSink() {
+	secret := []byte("secret")
+	statuses := make(chan int, 3)
+	statuses <- http.StatusServiceUnavailable
+	statuses <- http.StatusOK
+	statuses <- http.StatusBadRequest
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		s.Require().NoError(err)
+		s.Require().Equal("hook-topic", r.Header.Get(queue.WebhookHeaderTopic))
+		s.Require().True(queue.VerifyWebhook(secret, r.Header.Get(queue.WebhookHeaderTimestamp), body,
+			r.Header.Get(queue.WebhookHeaderSignature)))
+		// only the trace context of the event leaves the process by default
+		s.Require().Equal("00-trace-span-01", r.Header.Get(queue.HeaderTraceparent))
+		s.Require().Empty(r.Header.Get(queue.HeaderPublicKey))
+		s.Require().Empty(r.Header.Get(queue.HeaderRequestID))
+
+		status := <-statuses
+		if status == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", "1")
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink := queue.NewWebhookSink("hook", queue.WebhookOptions{URL: server.URL, Secret: secret})
+	event := &queue.Event{ID: 1, Topic: "hook-topic", Data: []byte(`{"a":1}`), Headers: map[string]string{
+		queue.HeaderTraceparent: "00-trace-span-01",
+		queue.HeaderPublicKey:   "public-key",
+		queue.HeaderRequestID:   "request-id",
+	}}
+
+	err := sink.Send(s.ctx, event)
+	s.Require().Error(err)
+	s.Require().NotErrorIs(err, queue.ErrSinkRejected)
+	s.Require().Equal(time.Second, event.RetryAfter)
+
+	s.Require().NoError(sink.Send(s.ctx, event))
+
+	err = sink.Send(s.ctx, event)
+	s.Require().ErrorIs(err, queue.ErrSinkRejected)
+
+	s.Require().False(queue.VerifyWebhook(secret, "1", []byte("body"), queue.SignWebhook([]byte("other"), "1", []byte("body"))))
+
+	s.Run("forwarded headers", func() {
+		forwarded := make(chan http.Header, 1)
+		server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+			forwarded <- r.Header
+		}))
+		defer server.Close()
+
+		sink := queue.NewWebhookSink("hook", queue.WebhookOptions{
+			URL:            server.URL,
+			ForwardHeaders: []string{queue.HeaderRequestID},
+		})
+		s.Require().NoError(sink.Send(s.ctx, event))
+
+		header := <-forwarded
+		s.Require().Equal("request-id", header.Get(queue.HeaderRequestID))
+		s.Require().Empty(header.Get(queue.HeaderTraceparent))
+		s.Require().Empty(header.Get(queue.HeaderPublicKey))
+	})
+}
+
+func (s *EventBusSuite) TestBackpressure() {
+	bus := queue.NewEventBus(s.ctx, 1)
+	bus.SetLogger(s.log)
+
+	s.Run("done ctx with room in the queue", func() {
+		ctx, cancel := context.WithCancel(s.ctx)
+		cancel()
+
+		empty := queue.NewEventBus(ctx, 1)
+		empty.SetLogger(s.log)
+		empty.Stop()
+
+		s.Require().NoError(empty.PublishCtx(ctx, "empty-topic", []byte("first")))
+		s.Require().ErrorIs(empty.PublishCtx(ctx, "empty-topic", []byte("second")), queue.ErrQueueFull)
+	})
+
+	s.Run("fail fast", func() {
+		bus.WithBackpressure(queue.BackpressureFailFast)
+		s.Require().NoError(bus.Publish("full-topic", []byte("first")))
+		s.Require().ErrorIs(bus.Publish("full-topic", []byte("second")), queue.ErrQueueFull)
+	})
+
+	s.Run("block until ctx is done", func() {
+		ctx, cancel := context.WithTimeout(s.ctx, 50*time.Millisecond)
+		defer cancel()
+
+		err := bus.PublishCtx(ctx, "full-topic", []byte("second"),
+			queue.PublishOptions{Backpressure: queue.BackpressureBlock})
+		s.Require().ErrorIs(err, queue.ErrQueueFull)
+		s.Require().ErrorIs(err, context.DeadlineExceeded)
+	})
+
+	s.Run("persist requires outbox", func() {
+		err := bus.Publish("full-topic", []byte("second"), queue.PublishOptions{Backpressure: queue.BackpressurePersist})
+		s.Require().ErrorIs(err, queue.ErrOutboxNotConfigured)
+	})
+}
+
+func (s *EventBusSuite) TestAdminHandler() {
+	handler := func(_ context.Context, _ *queue.Event) queue.AckStatus { return queue.ACK }
+	s.bus.Subscribe("admin-topic", handler, nil, time.Second, queue.SubscribeOptions{Name: "first"})
+	s.bus.Subscribe("admin-topic", handler, nil, time.Second, queue.SubscribeOptions{Name: "second"})
+
+	serve := func(h http.Handler, method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec
+	}
+
+	s.Run("denied without authorizer", func() {
+		h := s.bus.AdminHandler(queue.AdminOptions{Writable: true})
+
+		rec := serve(h, http.MethodGet, "/queue/topics")
+		s.Require().Equal(http.StatusForbidden, rec.Code)
+		s.Require().Contains(rec.Body.String(), queue.ErrAdminUnauthorized.Error())
+		s.Require().Equal(http.StatusForbidden, serve(h, http.MethodDelete, "/queue/dead-letters?all=true").Code)
+	})
+
+	s.Run("read-only by default", func() {
+		h := s.bus.AdminHandler(queue.AdminOptions{Authorizer: queue.AllowAll})
+
+		rec := serve(h, http.MethodGet, "/queue/topics")
+		s.Require().Equal(http.StatusOK, rec.Code)
+
+		var topics []struct {
+			Topic       string   `json:"topic"`
+			Subscribers []string `json:"subscribers"`
+		}
+		s.Require().NoError(json.Unmarshal(rec.Body.Bytes(), &topics))
+		s.Require().Len(topics, 1)
+		s.Require().Equal("admin-topic", topics[0].Topic)
+		s.Require().Equal([]string{"first", "second"}, topics[0].Subscribers)
+
+		s.Require().Equal(http.StatusNotImplemented, serve(h, http.MethodGet, "/queue/stats").Code)
+		s.Require().Equal(http.StatusForbidden, serve(h, http.MethodPost, "/queue/events/1/replay").Code)
+		s.Require().Equal(http.StatusForbidden, serve(h, http.MethodDelete, "/queue/dead-letters").Code)
+	})
+
+	s.Run("authorizer", func() {
+		h := s.bus.AdminHandler(queue.AdminOptions{
+			Prefix:   "/admin/queue",
+			Writable: true,
+			Authorizer: func(r *http.Request, action queue.AdminAction) error {
+				if action == queue.AdminWrite && r.Header.Get("X-Role") != "admin" {
+					return errors.New("admin role required")
+				}
+				return nil
+			},
+		})
+
+		s.Require().Equal(http.StatusOK, serve(h, http.MethodGet, "/admin/queue/topics").Code)
+		s.Require().Equal(http.StatusForbidden, serve(h, http.MethodPost, "/admin/queue/events/1/replay").Code)
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/admin/queue/events/abc/replay", nil)
+		req.Header.Set("X-Role", "admin")
+		h.ServeHTTP(rec, req)
+		s.Require().Equal(http.StatusBadRequest, rec.Code)
+	})
+
+	s.Run("bulk dead letters need a topic or all", func() {
+		store := queuetest.NewMemoryOutbox(nil)
+		s.Require().NoError(store.InsertEvents(s.ctx, []*queue.OutboxEvent{
+			{Topic: "first-topic", Subscriber: "sub", AckStatus: queue.DEAD},
+			{Topic: "second-topic", Subscriber: "sub", AckStatus: queue.DEAD},
+			{Topic: "third-topic", Subscriber: "sub", AckStatus: queue.DEAD},
+		}, time.Hour))
+
+		bus := queue.NewEventBus(s.ctx, 100)
+		bus.SetLogger(s.log)
+		bus.(queue.Testable).WithOutboxStore(store)
+		h := bus.AdminHandler(queue.AdminOptions{Writable: true, Authorizer: queue.AllowAll})
+
+		count := func(rec *httptest.ResponseRecorder) int {
+			s.Require().Equal(http.StatusOK, rec.Code, rec.Body.String())
+			var body struct {
+				Count int `json:"count"`
+			}
+			s.Require().NoError(json.Unmarshal(rec.Body.Bytes(), &body))
+			return body.Count
+		}
+
+		s.Require().Equal(http.StatusBadRequest, serve(h, http.MethodDelete, "/queue/dead-letters").Code)
+		s.Require().Equal(http.StatusBadRequest, serve(h, http.MethodPost, "/queue/dead-letters/replay").Code)
+		s.Require().Equal(http.StatusBadRequest, serve(h, http.MethodDelete, "/queue/dead-letters?subscriber=sub").Code)
+		s.Require().Len(store.Events(), 3)
+
+		s.Require().Equal(1, count(serve(h, http.MethodDelete, "/queue/dead-letters?topic=first-topic")))
+		s.Require().Equal(2, count(serve(h, http.MethodDelete, "/queue/dead-letters?all=true")))
+		s.Require().Empty(store.Events())
+	})
+
+	s.Run("payload only on request", func() {
+		store := queuetest.NewMemoryOutbox(nil)
+		s.Require().NoError(store.InsertEvents(s.ctx, []*queue.OutboxEvent{{
+			Topic:      "admin-topic",
+			Subscriber: "first",
+			AckStatus:  queue.DEAD,
+			Data:       []byte("secret"),
+			Headers:    map[string]string{"x-request-id": "42"},
+		}}, time.Hour))
+
+		bus := queue.NewEventBus(s.ctx, 100)
+		bus.SetLogger(s.log)
+		bus.(queue.Testable).WithOutboxStore(store)
+		h := bus.AdminHandler(queue.AdminOptions{
+			Authorizer: func(r *http.Request, action queue.AdminAction) error {
+				if action == queue.AdminReadPayload && r.Header.Get("X-Role") != "admin" {
+					return errors.New("admin role required")
+				}
+				return nil
+			},
+		})
+		id := store.Events()[0].ID
+
+		for _, target := range []string{"/queue/events", fmt.Sprintf("/queue/events/%d", id)} {
+			rec := serve(h, http.MethodGet, target)
+			s.Require().Equal(http.StatusOK, rec.Code, target)
+			s.Require().NotContains(rec.Body.String(), "x-request-id", target)
+			s.Require().NotContains(rec.Body.String(), `"data"`, target)
+
+			s.Require().Equal(http.StatusForbidden, serve(h, http.MethodGet, target+"?payload=true").Code, target)
+
+			rec = httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, target+"?payload=true", nil)
+			req.Header.Set("X-Role", "admin")
+			h.ServeHTTP(rec, req)
+			s.Require().Equal(http.StatusOK, rec.Code, target)
+			s.Require().Contains(rec.Body.String(), "x-request-id", target)
+			s.Require().Contains(rec.Body.String(), `"data"`, target)
+		}
+	})
+}
+
+func (s *EventBusSuite) TestRateLimit() {
+	registry := newRecordingRegistry()
+
+	h := queuetest.New(s.T())
+	h.Bus.WithMetrics(registry, time.Hour)
+	h.Bus.Subscribe("limited-topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+		return queue.ACK
+	}, []int{10}, time.Millisecond, queue.SubscribeOptions{
+		Name:        "limited",
+		Concurrency: 4,
+		RateLimit:   queue.RateLimit{Rate: 20, Burst: 1},
+	})
+	h.Start()
+
+	for i := 0; i < 5; i++ {
+		s.Require().NoError(h.Bus.Publish("limited-topic", []byte("event")))
+	}
+
+	// the first event uses the burst, the others wait for a token every 50ms
+	h.WaitIdle()
+	h.AssertDelivered("limited-topic", []byte("event"), 1)
+	for i := 2; i <= 5; i++ {
+		h.Advance(50 * time.Millisecond)
+		h.AssertDelivered("limited-topic", []byte("event"), i)
+	}
+
+	s.Require().Positive(registry.count("limited-topic/throttled/info/limited"))
+	s.Require().Zero(registry.count("limited-topic/retry/info/limited"))
+}
+
+func (s *EventBusSuite) TestRateLimitedTopicDoesNotStarveOthers() {
+	bus := queue.NewEventBus(s.ctx, 10)
+	bus.SetLogger(s.log)
+
+	bus.Subscribe("slow-topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+		return queue.ACK
+	}, nil, time.Second, queue.SubscribeOptions{Name: "slow", Concurrency: 1, RateLimit: queue.RateLimit{Rate: 1}})
+
+	fast := make(chan struct{}, 1)
+	bus.Subscribe("fast-topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+		fast <- struct{}{}
+		return queue.ACK
+	}, nil, time.Second, queue.SubscribeOptions{Name: "fast"})
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	go func() {
+		err := bus.StartProcessing(ctx)
+		s.Require().NoError(err)
+	}()
+
+	// the backlog of the slow topic is more than the queue of the bus can hold
+	publishCtx, cancelPublish := context.WithTimeout(s.ctx, time.Second)
+	defer cancelPublish()
+	for range 11 {
+		s.Require().NoError(bus.PublishCtx(publishCtx, "slow-topic", []byte("slow")))
+	}
+
+	s.Require().NoError(bus.PublishCtx(s.ctx, "fast-topic", []byte("fast"),
+		queue.PublishOptions{Backpressure: queue.BackpressureFailFast}))
+
+	select {
+	case <-fast:
+	case <-time.After(time.Second):
+		s.Fail("event of another topic not handled behind the throttled backlog")
+	}
+
+	s.Require().Greater(bus.PoolStats().Topics["slow-topic"].Queued, 0)
+}
+
+func (s *EventBusSuite) TestLaneBoundsPublishers() {
+	bus := queue.NewEventBus(s.ctx, 2)
+	bus.SetLogger(s.log)
+	bus.WithBackpressure(queue.BackpressureFailFast)
+
+	release := make(chan struct{})
+	defer close(release)
+	bus.Subscribe("blocked-topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+		<-release
+		return queue.ACK
+	}, nil, time.Second, queue.SubscribeOptions{Name: "blocked", Concurrency: 1})
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	go func() {
+		_ = bus.StartProcessing(ctx)
+	}()
+
+	accepted := 0
+	for range 100 {
+		err := bus.Publish("blocked-topic", []byte("event"))
+		if err == nil {
+			accepted++
+			continue
+		}
+		s.Require().ErrorIs(err, queue.ErrQueueFull)
+		time.Sleep(time.Millisecond)
+	}
+
+	// one event in the worker, the lane and the queue of the bus hold two each
+	s.Require().LessOrEqual(accepted, 5)
+	s.Require().LessOrEqual(bus.PoolStats().Topics["blocked-topic"].Queued, 4)
+}
+
+func (s *EventBusSuite) TestMaxInFlight() {
+	var (
+		current, peak atomic.Int32
+		handled       atomic.Int32
+	)
+	s.bus.Subscribe("capped-topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+		n := current.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+
+		time.Sleep(20 * time.Millisecond)
+		current.Add(-1)
+		handled.Add(1)
+		return queue.ACK
+	}, nil, time.Millisecond, queue.SubscribeOptions{Name: "capped", Concurrency: 4, MaxInFlight: 2})
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	go func() {
+		err := s.bus.StartProcessing(ctx)
+		s.Require().NoError(err)
+	}()
+
+	for i := 0; i < 8; i++ {
+		s.Require().NoError(s.bus.Publish("capped-topic", []byte("event")))
+	}
+
+	s.Require().Eventually(func() bool {
+		return handled.Load() == 8
+	}, 2*time.Second, 5*time.Millisecond)
+	s.Require().Equal(int32(2), peak.Load())
+}
+
+func (s *EventBusSuite) TestSubscribeBatch() {
+	registry := newRecordingRegistry()
+	s.bus.WithMetrics(registry, time.Minute)
+
+	var (
+		lock    sync.Mutex
+		sizes   []int
+		handled = make(map[string]int)
+	)
+	s.bus.SubscribeBatch("batch-topic", func(_ context.Context, events []*queue.Event) queue.BatchResult {
+		lock.Lock()
+		defer lock.Unlock()
+
+		sizes = append(sizes, len(events))
+		result := queue.BatchStatus(events, queue.ACK)
+		for _, event := range events {
+			handled[string(event.Data)]++
+			if string(event.Data) == "flaky" && event.Retry == 0 {
+				event.SetError(errors.New("flaky"))
+				result[event] = queue.NACK
+			}
+		}
+		return result
+	}, queue.BatchOptions{MaxSize: 3, MaxWait: 50 * time.Millisecond}, []int{10}, time.Millisecond,
+		queue.SubscribeOptions{Name: "batch"})
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+
+	go func() {
+		err := s.bus.StartProcessing(ctx)
+		s.Require().NoError(err)
+	}()
+
+	for _, data := range []string{"a", "b", "flaky", "c", "d"} {
+		s.Require().NoError(s.bus.Publish("batch-topic", []byte(data)))
+	}
+
+	s.Require().Eventually(func() bool {
+		return registry.count("batch-topic/ack/info/batch") == 5
+	}, time.Second, 5*time.Millisecond)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	s.Require().Equal(map[string]int{"a": 1, "b": 1, "flaky": 2, "c": 1, "d": 1}, handled)
+	s.Require().Contains(sizes, 3)
+	for _, size := range sizes {
+		s.Require().LessOrEqual(size, 3)
+	}
+	s.Require().Equal(1, registry.count("batch-topic/retry/info/batch"))
+}
+
+func (s *EventBusSuite) TestPauseResume() {
+	h := queuetest.New(s.T())
+	h.Bus.Subscribe("paused-topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+		return queue.ACK
+	}, nil, time.Millisecond, queue.SubscribeOptions{Name: "sub"})
+	h.Start()
+
+	h.Bus.Pause("paused-topic")
+	s.Require().True(h.Bus.Paused("paused-topic"))
+
+	for i := 0; i < 3; i++ {
+		s.Require().NoError(h.Bus.Publish("paused-topic", []byte("event")))
+	}
+
+	h.WaitIdle()
+	h.AssertDelivered("paused-topic", []byte("event"), 0)
+
+	h.Bus.Resume("paused-topic")
+	s.Require().False(h.Bus.Paused("paused-topic"))
+
+	h.WaitIdle()
+	h.AssertDelivered("paused-topic", []byte("event"), 3)
+}
+
+func (s *EventBusSuite) TestParkLimit() {
+	s.Run("events over the limit are dropped", func() {
+		bus := queue.NewEventBus(s.ctx, 100)
+		bus.SetLogger(s.log)
+		bus.WithParkLimit(2)
+		testable := bus.(queue.Testable)
+
+		var handled atomic.Int32
+		bus.Subscribe("parked-topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+			handled.Add(1)
+			return queue.ACK
+		}, nil, time.Millisecond)
+
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+
+		go func() {
+			_ = bus.StartProcessing(ctx)
+		}()
+
+		bus.Pause("parked-topic")
+		for range 4 {
+			s.Require().NoError(bus.Publish("parked-topic", []byte("event")))
+		}
+		s.Require().Eventually(testable.Idle, time.Second, time.Millisecond)
+
+		bus.Resume("parked-topic")
+		s.Require().Eventually(testable.Idle, time.Second, time.Millisecond)
+		s.Require().Equal(int32(2), handled.Load())
+	})
+
+	s.Run("claimed events are left in the outbox", func() {
+		h := queuetest.New(s.T())
+		h.Bus.WithRelay(queue.RelayOptions{Owner: "instance-1", PollInterval: 10 * time.Millisecond, LeaseDuration: time.Minute})
+		h.Bus.WithParkLimit(1)
+		h.Bus.Subscribe("parked-topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+			return queue.ACK
+		}, nil, time.Millisecond, queue.SubscribeOptions{Name: "sub"})
+		h.Start()
+
+		h.Bus.Pause("parked-topic")
+		for range 3 {
+			s.Require().NoError(h.Bus.Publish("parked-topic", []byte("event")))
+		}
+
+		// the events are not held in memory, their leases are released and the relay does not claim them
+		h.Advance(10 * time.Millisecond)
+		h.AssertDelivered("parked-topic", []byte("event"), 0)
+		s.Require().Len(h.Outbox.Events(), 3)
+		for _, event := range h.Outbox.Events() {
+			s.Require().Empty(event.LeaseOwner)
+		}
+
+		h.Bus.Resume("parked-topic")
+		h.Advance(10 * time.Millisecond)
+		h.AssertDelivered("parked-topic", []byte("event"), 3)
+	})
+}
+
+func (s *EventBusSuite) TestHalfOpenBreakerOnlyCountsTheProbe() {
+	h := queuetest.New(s.T())
+	h.Bus.WithCircuitBreaker(queue.BreakerOptions{Threshold: 1, Cooldown: time.Minute})
+
+	slow, probe := make(chan struct{}), make(chan struct{})
+	var probing atomic.Bool
+	h.Bus.Subscribe("breaker-topic", func(_ context.Context, event *queue.Event) queue.AckStatus {
+		switch {
+		case string(event.Data) == "slow":
+			<-slow
+			return queue.NACK
+		case event.Retry > 0:
+			probing.Store(true)
+			<-probe
+			return queue.ACK
+		}
+		return queue.NACK
+	}, []int{2}, time.Minute, queue.SubscribeOptions{Name: "breaker", Concurrency: 2})
+	h.Start()
+
+	s.Require().NoError(h.Bus.Publish("breaker-topic", []byte("slow")))
+	s.Require().NoError(h.Bus.Publish("breaker-topic", []byte("failing")))
+	s.Require().Eventually(func() bool {
+		return h.Bus.Paused("breaker-topic")
+	}, time.Second, time.Millisecond)
+
+	// the breaker turns half-open, the retry of the failing event is its probe
+	h.Clock.Advance(time.Minute)
+	s.Require().Eventually(func() bool {
+		return !h.Bus.Paused("breaker-topic")
+	}, time.Second, time.Millisecond)
+	h.Clock.Advance(time.Minute)
+	s.Require().Eventually(probing.Load, time.Second, time.Millisecond)
+
+	// the event handled before the breaker opened does not decide it, its retry is scheduled once it was ignored
+	close(slow)
+	s.Require().Eventually(func() bool {
+		return h.Clock.Timers() == 1
+	}, time.Second, time.Millisecond)
+	s.Require().False(h.Bus.Paused("breaker-topic"))
+
+	close(probe)
+	h.WaitIdle()
+	s.Require().False(h.Bus.Paused("breaker-topic"))
+}
+
+func (s *EventBusSuite) TestPauseWhileRateLimited() {
+	h := queuetest.New(s.T())
+	h.Bus.Subscribe("limited-topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+		return queue.ACK
+	}, nil, time.Second, queue.SubscribeOptions{Name: "limited", Concurrency: 1, RateLimit: queue.RateLimit{Rate: 1, Burst: 1}})
+	h.Start()
+
+	s.Require().NoError(h.Bus.Publish("limited-topic", []byte("event")))
+	s.Require().NoError(h.Bus.Publish("limited-topic", []byte("event")))
+	h.WaitIdle()
+	h.AssertDelivered("limited-topic", []byte("event"), 1)
+
+	// the second event waits for its token when the topic is paused
+	h.Bus.Pause("limited-topic")
+	h.Advance(time.Second)
+	h.AssertDelivered("limited-topic", []byte("event"), 1)
+
+	h.Bus.Resume("limited-topic")
+	h.RunUntilIdle()
+	h.AssertDelivered("limited-topic", []byte("event"), 2)
+}
+
+func (s *EventBusSuite) TestCircuitBreaker() {
+	registry := newRecordingRegistry()
+
+	h := queuetest.New(s.T())
+	h.Bus.WithMetrics(registry, time.Hour)
+	h.Bus.WithCircuitBreaker(queue.BreakerOptions{Threshold: 2, Cooldown: 100 * time.Millisecond})
+
+	var healthy atomic.Bool
+	h.Bus.Subscribe("breaker-topic", func(_ context.Context, event *queue.Event) queue.AckStatus {
+		if !healthy.Load() {
+			event.SetError(errors.New("downstream unavailable"))
+			return queue.NACK
+		}
+		return queue.ACK
+	}, []int{10, 10, 10, 10, 10}, time.Millisecond, queue.SubscribeOptions{Name: "breaker"})
+	h.Start()
+
+	s.Require().NoError(h.Bus.Publish("breaker-topic", []byte("first")))
+	s.Require().NoError(h.Bus.Publish("breaker-topic", []byte("second")))
+	h.WaitIdle()
+	s.Require().True(h.Bus.Paused("breaker-topic"))
+
+	// the retries wait for the probe instead of burning the retry budget
+	h.Advance(10 * time.Millisecond)
+	s.Require().Zero(registry.count("breaker-topic/ack/info/breaker"))
+	healthy.Store(true)
+
+	h.Advance(90 * time.Millisecond)
+	s.Require().Equal(2, registry.count("breaker-topic/ack/info/breaker"))
+	s.Require().False(h.Bus.Paused("breaker-topic"))
+	s.Require().Equal(1, registry.count("breaker-topic/breaker/info/open"))
+	s.Require().Equal(1, registry.count("breaker-topic/breaker/info/closed"))
+	s.Require().Equal(2, registry.count("breaker-topic/retry/info/breaker"))
 }
@@ -0,0 +1,132 @@
+package queuetest
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gateway-fm/scriptorium/queue"
+)
+
+// FakeClock is a queue.Clock whose time only moves when Advance is called.
+type FakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer // timers are the pending timers.
+	fired  []*fakeTimer // fired are the timers that fired, until they are stopped.
+}
+
+// NewFakeClock creates a FakeClock showing the given time.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.now
+}
+
+// NewTimer creates a timer firing once the clock is advanced by d, right away when d is not positive.
+func (c *FakeClock) NewTimer(d time.Duration) queue.Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	t := &fakeTimer{clock: c, at: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+		c.fired = append(c.fired, t)
+		return t
+	}
+
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward by d, firing the timers due by then in order of their deadlines.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.now = c.now.Add(d)
+
+	slices.SortStableFunc(c.timers, func(a, b *fakeTimer) int {
+		return a.at.Compare(b.at)
+	})
+
+	fired := 0
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			break
+		}
+		t.c <- t.at
+		fired++
+	}
+	c.fired = append(c.fired, c.timers[:fired]...)
+	c.timers = slices.Delete(c.timers, 0, fired)
+}
+
+// Next returns how long until the earliest pending timer fires, false when no timer is pending.
+func (c *FakeClock) Next() (time.Duration, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.timers) == 0 {
+		return 0, false
+	}
+
+	next := c.timers[0].at
+	for _, t := range c.timers[1:] {
+		if t.at.Before(next) {
+			next = t.at
+		}
+	}
+	return max(next.Sub(c.now), 0), true
+}
+
+// Timers returns the number of pending timers.
+func (c *FakeClock) Timers() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.timers)
+}
+
+// firing returns the number of fired timers not stopped yet. The bus stops a timer once it acted on it,
+// so the events a fired timer releases are accounted for by the bus by then.
+func (c *FakeClock) firing() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return len(c.fired)
+}
+
+// fakeTimer is a timer of a FakeClock.
+type fakeTimer struct {
+	clock *FakeClock
+	at    time.Time
+	c     chan time.Time
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop prevents the timer from firing and reports whether it was still pending.
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+
+	t.clock.fired = slices.DeleteFunc(t.clock.fired, func(fired *fakeTimer) bool {
+		return fired == t
+	})
+
+	for i, pending := range t.clock.timers {
+		if pending == t {
+			t.clock.timers = slices.Delete(t.clock.timers, i, i+1)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,255 @@
+// Package queuetest runs a queue.EventBus deterministically in tests: the bus tells the time with a FakeClock
+// and persists events in a MemoryOutbox, so delays, retries and dead-lettering need neither waiting nor Postgres.
+package queuetest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/gateway-fm/scriptorium/clog"
+	"github.com/gateway-fm/scriptorium/queue"
+)
+
+const (
+	defaultSize    = 1024
+	defaultTimeout = 10 * time.Second
+
+	// idleInterval is how often WaitIdle checks whether the bus settled.
+	idleInterval = time.Millisecond
+
+	// maxSteps bounds RunUntilIdle, a bus still firing timers after that many steps never settles.
+	maxSteps = 10000
+)
+
+// Options configures a Harness.
+type Options struct {
+	Size    int           // Size is the buffer size of the event queue, 1024 when zero.
+	Now     time.Time     // Now is the initial time of the clock, 2024-01-01 UTC when zero.
+	Timeout time.Duration // Timeout bounds the real time waited for the bus to become idle, 10s when zero.
+}
+
+// Delivery records a call of a handler of the bus.
+type Delivery struct {
+	Topic      string
+	Subscriber string
+	Data       []byte
+	Retry      int             // Retry is the number of the attempt, starting at zero.
+	Status     queue.AckStatus // Status is the status returned by the handler, NACK when it panicked.
+	At         time.Time       // At is the time of the clock when the handler was called.
+}
+
+// Harness drives a bus with a FakeClock and a MemoryOutbox and records the deliveries of its handlers.
+// Batch handlers are not wrapped by middlewares, their deliveries are not recorded.
+type Harness struct {
+	Bus    queue.EventBus
+	Clock  *FakeClock
+	Outbox *MemoryOutbox
+
+	t          testing.TB
+	testable   queue.Testable
+	timeout    time.Duration
+	loaded     chan struct{} // loaded is closed once the bus loaded the outbox on start.
+	lock       sync.Mutex
+	deliveries []Delivery
+}
+
+// New creates a harness with a bus that is not processing yet, see Start. Only the first of opts is taken into account.
+func New(t testing.TB, opts ...Options) *Harness {
+	t.Helper()
+
+	var opt Options
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if opt.Size <= 0 {
+		opt.Size = defaultSize
+	}
+	if opt.Now.IsZero() {
+		opt.Now = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = defaultTimeout
+	}
+
+	h := &Harness{
+		Bus:     queue.NewEventBus(context.Background(), opt.Size),
+		Clock:   NewFakeClock(opt.Now),
+		t:       t,
+		timeout: opt.Timeout,
+		loaded:  make(chan struct{}),
+	}
+	h.Outbox = NewMemoryOutbox(h.Clock)
+	h.testable = h.Bus.(queue.Testable)
+
+	h.Bus.SetLogger(clog.NewCustomLogger(io.Discard, clog.LevelError, false))
+	h.testable.WithClock(h.Clock)
+	h.testable.WithOutboxStore(&startStore{MemoryOutbox: h.Outbox, loaded: h.loaded})
+	h.Bus.Use(h.record)
+
+	return h
+}
+
+// startStore reports when the bus loaded the outbox on start, or made its first claim in the relay mode.
+type startStore struct {
+	*MemoryOutbox
+	once   sync.Once
+	loaded chan struct{}
+}
+
+func (s *startStore) LoadPendingEvents(ctx context.Context) ([]*queue.OutboxEvent, error) {
+	defer s.once.Do(func() { close(s.loaded) })
+	return s.MemoryOutbox.LoadPendingEvents(ctx)
+}
+
+func (s *startStore) ClaimEvents(
+	ctx context.Context,
+	owner string,
+	limit int,
+	lease time.Duration,
+	excludeTopics ...string,
+) ([]*queue.OutboxEvent, error) {
+	defer s.once.Do(func() { close(s.loaded) })
+	return s.MemoryOutbox.ClaimEvents(ctx, owner, limit, lease, excludeTopics...)
+}
+
+// record is the middleware recording the deliveries.
+func (h *Harness) record(next queue.EventHandler) queue.EventHandler {
+	return func(ctx context.Context, event *queue.Event) queue.AckStatus {
+		delivery := Delivery{
+			Topic:      event.Topic,
+			Subscriber: event.Subscriber,
+			Data:       event.Data,
+			Retry:      event.Retry,
+			Status:     queue.NACK,
+			At:         h.Clock.Now(),
+		}
+		defer func() {
+			h.lock.Lock()
+			h.deliveries = append(h.deliveries, delivery)
+			h.lock.Unlock()
+		}()
+
+		delivery.Status = next(ctx, event)
+		return delivery.Status
+	}
+}
+
+// Start starts processing and shuts the bus down once the test ends.
+func (h *Harness) Start() {
+	h.t.Helper()
+
+	var err error
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		err = h.Bus.StartProcessing(context.Background())
+	}()
+
+	h.t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+		defer cancel()
+
+		_ = h.Bus.Shutdown(ctx)
+		h.Bus.Stop()
+		<-stopped
+	})
+
+	select {
+	case <-h.loaded:
+	case <-stopped:
+		h.t.Fatalf("event bus stopped on start: %v", err)
+	case <-time.After(h.timeout):
+		h.t.Fatalf("event bus did not start within %s", h.timeout)
+	}
+}
+
+// WaitIdle waits, without moving the clock, until the bus handled every event it can handle right away.
+// The timers that fired are checked first: the bus accounts for the events they release before stopping them.
+func (h *Harness) WaitIdle() {
+	h.t.Helper()
+
+	deadline := time.Now().Add(h.timeout)
+	for h.Clock.firing() > 0 || !h.testable.Idle() {
+		if time.Now().After(deadline) {
+			h.t.Fatalf("event bus not idle within %s", h.timeout)
+		}
+		time.Sleep(idleInterval)
+	}
+}
+
+// Advance moves the clock forward by d and waits for the bus to handle the events that became due.
+func (h *Harness) Advance(d time.Duration) {
+	h.t.Helper()
+
+	h.Clock.Advance(d)
+	h.WaitIdle()
+}
+
+// RunUntilIdle advances the clock from timer to timer until the bus is idle and no timer is pending,
+// so every retry and delayed event runs its course. The relay, the retention and the metrics sampling run on timers
+// of the clock for as long as the bus runs, so a bus using any of them always has a pending timer: drive it with Advance.
+func (h *Harness) RunUntilIdle() {
+	h.t.Helper()
+
+	h.WaitIdle()
+	for range maxSteps {
+		next, ok := h.Clock.Next()
+		if !ok {
+			return
+		}
+		h.Advance(next)
+	}
+
+	h.t.Fatalf("event bus still busy after %d clock steps", maxSteps)
+}
+
+// Deliveries returns the recorded deliveries of the topic, in the order the handlers returned.
+func (h *Harness) Deliveries(topic string) []Delivery {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	var deliveries []Delivery
+	for _, delivery := range h.deliveries {
+		if delivery.Topic == topic {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+	return deliveries
+}
+
+// AssertDelivered asserts that the handlers of the topic were called times times for events with the data,
+// all subscriptions and attempts included.
+func (h *Harness) AssertDelivered(topic string, data []byte, times int) bool {
+	h.t.Helper()
+
+	delivered := 0
+	for _, delivery := range h.Deliveries(topic) {
+		if bytes.Equal(delivery.Data, data) {
+			delivered++
+		}
+	}
+	return assert.Equalf(h.t, times, delivered, "deliveries of %q to topic %s", data, topic)
+}
+
+// AssertDeadLettered asserts that an event of the topic with the data is dead-lettered in the outbox.
+func (h *Harness) AssertDeadLettered(topic string, data []byte) bool {
+	h.t.Helper()
+
+	dead, err := h.Outbox.LoadDeadEvents(context.Background(), queue.DeadLetterFilter{Topic: topic})
+	if !assert.NoError(h.t, err) {
+		return false
+	}
+
+	for _, event := range dead {
+		if bytes.Equal(event.Data, data) {
+			return true
+		}
+	}
+	return assert.Failf(h.t, "event not dead-lettered", "no dead letter of %q in topic %s", data, topic)
+}
@@ -0,0 +1,236 @@
+package queuetest_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+
+	"github.com/gateway-fm/scriptorium/queue"
+	"github.com/gateway-fm/scriptorium/queue/queuetest"
+)
+
+type HarnessSuite struct {
+	suite.Suite
+
+	h *queuetest.Harness
+}
+
+func TestHarnessSuite(t *testing.T) {
+	suite.Run(t, new(HarnessSuite))
+}
+
+func (s *HarnessSuite) SetupTest() {
+	s.h = queuetest.New(s.T())
+}
+
+func (s *HarnessSuite) TestRetriesFollowTheClock() {
+	s.h.Bus.Subscribe("topic", func(_ context.Context, event *queue.Event) queue.AckStatus {
+		if event.Retry < 2 {
+			return queue.NACK
+		}
+		return queue.ACK
+	}, []int{1, 5, 10}, time.Minute, queue.SubscribeOptions{Name: "sub"})
+	s.h.Start()
+
+	started := s.h.Clock.Now()
+	s.Require().NoError(s.h.Bus.Publish("topic", []byte("event")))
+
+	s.h.WaitIdle()
+	s.h.AssertDelivered("topic", []byte("event"), 1)
+
+	s.h.Advance(59 * time.Second)
+	s.h.AssertDelivered("topic", []byte("event"), 1)
+
+	s.h.Advance(time.Second)
+	s.h.AssertDelivered("topic", []byte("event"), 2)
+
+	s.h.RunUntilIdle()
+	s.h.AssertDelivered("topic", []byte("event"), 3)
+
+	deliveries := s.h.Deliveries("topic")
+	s.Require().Len(deliveries, 3)
+	s.Equal(queue.ACK, deliveries[2].Status)
+	s.Equal(6*time.Minute, deliveries[2].At.Sub(started))
+
+	events := s.h.Outbox.Events()
+	s.Require().Len(events, 1)
+	s.Equal(queue.ACK, events[0].AckStatus)
+	s.Equal(2, events[0].Retry)
+}
+
+func (s *HarnessSuite) TestPublishBeforeStart() {
+	s.h.Bus.Subscribe("topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+		return queue.ACK
+	}, nil, time.Second, queue.SubscribeOptions{Name: "sub"})
+
+	s.Require().NoError(s.h.Bus.Publish("topic", []byte("early")))
+	s.h.Start()
+	s.Require().NoError(s.h.Bus.Publish("topic", []byte("late")))
+
+	s.h.WaitIdle()
+	s.h.AssertDelivered("topic", []byte("early"), 1)
+	s.h.AssertDelivered("topic", []byte("late"), 1)
+}
+
+func (s *HarnessSuite) TestDeadLetter() {
+	s.h.Bus.Subscribe("topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+		return queue.NACK
+	}, []int{1, 1}, time.Hour, queue.SubscribeOptions{Name: "sub"})
+	s.h.Start()
+
+	s.Require().NoError(s.h.Bus.Publish("topic", []byte("event")))
+	s.h.RunUntilIdle()
+
+	s.h.AssertDelivered("topic", []byte("event"), 3)
+	s.h.AssertDeadLettered("topic", []byte("event"))
+	s.Equal(0, s.h.Clock.Timers())
+}
+
+func (s *HarnessSuite) TestPublishAfter() {
+	s.h.Bus.Subscribe("topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+		return queue.ACK
+	}, nil, time.Second, queue.SubscribeOptions{Name: "sub"})
+	s.h.Start()
+
+	s.Require().NoError(s.h.Bus.PublishAfter(context.Background(), "topic", []byte("later"), time.Hour))
+	s.Require().NoError(s.h.Bus.Publish("topic", []byte("now")))
+
+	s.h.Advance(59 * time.Minute)
+	s.h.AssertDelivered("topic", []byte("now"), 1)
+	s.h.AssertDelivered("topic", []byte("later"), 0)
+
+	s.h.Advance(time.Minute)
+	s.h.AssertDelivered("topic", []byte("later"), 1)
+}
+
+func (s *HarnessSuite) TestRelayPollsOnTheClock() {
+	s.h.Bus.WithRelay(queue.RelayOptions{Owner: "instance-1", PollInterval: time.Minute, LeaseDuration: time.Hour})
+	s.h.Bus.Subscribe("topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+		return queue.ACK
+	}, nil, time.Second, queue.SubscribeOptions{Name: "sub"})
+	s.h.Start()
+
+	// another instance publishes the event
+	s.Require().NoError(s.h.Outbox.InsertEvents(context.Background(), []*queue.OutboxEvent{{
+		Topic:      "topic",
+		Subscriber: "sub",
+		Data:       []byte("event"),
+		AckStatus:  queue.NACK,
+	}}, 0))
+
+	s.h.Advance(59 * time.Second)
+	s.h.AssertDelivered("topic", []byte("event"), 0)
+
+	s.h.Advance(time.Second)
+	s.h.AssertDelivered("topic", []byte("event"), 1)
+}
+
+func (s *HarnessSuite) TestRetentionRunsOnTheClock() {
+	s.h.Bus.WithRetention(queue.RetentionOptions{Period: time.Hour, Interval: time.Minute})
+	s.h.Bus.Subscribe("topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+		return queue.ACK
+	}, nil, time.Second, queue.SubscribeOptions{Name: "sub"})
+	s.h.Start()
+
+	s.Require().NoError(s.h.Bus.Publish("topic", []byte("event")))
+	s.h.WaitIdle()
+
+	s.h.Advance(59 * time.Minute)
+	s.Len(s.h.Outbox.Events(), 1)
+
+	s.h.Advance(2 * time.Minute)
+	s.Empty(s.h.Outbox.Events())
+}
+
+func (s *HarnessSuite) TestCircuitBreakerCooldown() {
+	s.h.Bus.WithCircuitBreaker(queue.BreakerOptions{Threshold: 1, Cooldown: time.Minute})
+
+	var healthy atomic.Bool
+	s.h.Bus.Subscribe("topic", func(_ context.Context, _ *queue.Event) queue.AckStatus {
+		if healthy.Load() {
+			return queue.ACK
+		}
+		return queue.NACK
+	}, []int{1, 1, 1}, time.Second, queue.SubscribeOptions{Name: "sub", Concurrency: 1})
+	s.h.Start()
+
+	s.Require().NoError(s.h.Bus.Publish("topic", []byte("event")))
+	s.h.WaitIdle()
+	s.True(s.h.Bus.Paused("topic"))
+
+	s.h.Advance(30 * time.Second)
+	s.h.AssertDelivered("topic", []byte("event"), 1)
+
+	healthy.Store(true)
+	s.h.Advance(30 * time.Second)
+	s.h.AssertDelivered("topic", []byte("event"), 2)
+	s.False(s.h.Bus.Paused("topic"))
+}
+
+func (s *HarnessSuite) TestBatchWait() {
+	var batches, handled atomic.Int32
+	s.h.Bus.SubscribeBatch("topic", func(_ context.Context, events []*queue.Event) queue.BatchResult {
+		batches.Add(1)
+		handled.Add(int32(len(events)))
+		return queue.BatchStatus(events, queue.ACK)
+	}, queue.BatchOptions{MaxSize: 3, MaxWait: time.Minute}, nil, time.Second, queue.SubscribeOptions{Name: "sub"})
+	s.h.Start()
+
+	s.Require().NoError(s.h.Bus.Publish("topic", []byte("first")))
+	s.Require().NoError(s.h.Bus.Publish("topic", []byte("second")))
+	s.h.WaitIdle()
+	s.Zero(batches.Load())
+
+	s.h.Advance(time.Minute)
+	s.Equal(int32(1), batches.Load())
+	s.Equal(int32(2), handled.Load())
+
+	for range 3 {
+		s.Require().NoError(s.h.Bus.Publish("topic", []byte("full")))
+	}
+	s.h.WaitIdle()
+	s.Equal(int32(2), batches.Load())
+	s.Equal(int32(5), handled.Load())
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	clock := queuetest.NewFakeClock(start)
+
+	late := clock.NewTimer(2 * time.Second)
+	early := clock.NewTimer(time.Second)
+	stopped := clock.NewTimer(time.Second)
+
+	if !stopped.Stop() {
+		t.Fatal("pending timer not stopped")
+	}
+	if next, ok := clock.Next(); !ok || next != time.Second {
+		t.Fatalf("next timer in %s, want 1s", next)
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case at := <-early.C():
+		if !at.Equal(start.Add(time.Second)) {
+			t.Fatalf("timer fired at %s", at)
+		}
+	default:
+		t.Fatal("due timer did not fire")
+	}
+	select {
+	case <-late.C():
+		t.Fatal("timer fired early")
+	case <-stopped.C():
+		t.Fatal("stopped timer fired")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	<-late.C()
+	if clock.Timers() != 0 {
+		t.Fatalf("%d timers still pending", clock.Timers())
+	}
+}
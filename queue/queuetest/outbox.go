@@ -0,0 +1,491 @@
+package queuetest
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gateway-fm/scriptorium/queue"
+)
+
+// MemoryOutbox is a queue.OutboxStore keeping the events in memory, so tests of the bus need no Postgres.
+// Transactions found in ctx are ignored, every change applies right away.
+type MemoryOutbox struct {
+	lock      sync.Mutex
+	clock     queue.Clock
+	lastID    int
+	events    map[int]*queue.OutboxEvent
+	archive   []*queue.OutboxEvent
+	processed map[queue.ProcessedEvent]int64 // processed maps the keys of processed events to their ProcessedAt.
+}
+
+// NewMemoryOutbox creates an empty MemoryOutbox telling the time with the clock, the system clock when nil.
+func NewMemoryOutbox(clock queue.Clock) *MemoryOutbox {
+	if clock == nil {
+		clock = queue.SystemClock{}
+	}
+
+	return &MemoryOutbox{
+		clock:     clock,
+		events:    make(map[int]*queue.OutboxEvent),
+		processed: make(map[queue.ProcessedEvent]int64),
+	}
+}
+
+// Events returns a copy of the events in the outbox in the order of their IDs.
+func (o *MemoryOutbox) Events() []*queue.OutboxEvent {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	return o.match(func(*queue.OutboxEvent) bool { return true })
+}
+
+// Archived returns a copy of the events moved to the archive by the retention.
+func (o *MemoryOutbox) Archived() []*queue.OutboxEvent {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	archived := make([]*queue.OutboxEvent, len(o.archive))
+	for i, event := range o.archive {
+		archived[i] = clone(event)
+	}
+	return archived
+}
+
+// match returns copies of the events matching the predicate in the order of their IDs. The lock must be held.
+func (o *MemoryOutbox) match(matches func(*queue.OutboxEvent) bool) []*queue.OutboxEvent {
+	var events []*queue.OutboxEvent
+	for _, event := range o.events {
+		if matches(event) {
+			events = append(events, clone(event))
+		}
+	}
+
+	slices.SortFunc(events, func(a, b *queue.OutboxEvent) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return events
+}
+
+// clone returns a copy of the event that does not share its headers.
+func clone(event *queue.OutboxEvent) *queue.OutboxEvent {
+	c := *event
+	c.Headers = maps.Clone(event.Headers)
+	return &c
+}
+
+// InsertEvents stores the events and sets their IDs. An event with the dedup key of an event of its topic
+// and subscriber inserted within the dedup window, or still pending, is dropped, its ID is left at zero.
+func (o *MemoryOutbox) InsertEvents(_ context.Context, events []*queue.OutboxEvent, dedupWindow time.Duration) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	expired := o.clock.Now().Add(-dedupWindow).Unix()
+	for _, event := range events {
+		if event.DedupKey != "" && o.duplicate(event, expired) {
+			event.ID = 0
+			continue
+		}
+
+		o.lastID++
+		event.ID = o.lastID
+		o.events[event.ID] = clone(event)
+	}
+
+	return nil
+}
+
+// duplicate reports whether an event with the dedup key of the event was inserted since expired or is still pending.
+// The lock must be held.
+func (o *MemoryOutbox) duplicate(event *queue.OutboxEvent, expired int64) bool {
+	for _, existing := range o.events {
+		if existing.Topic == event.Topic && existing.Subscriber == event.Subscriber &&
+			existing.DedupKey == event.DedupKey && (existing.CreatedAt >= expired || existing.AckStatus == queue.NACK) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *MemoryOutbox) LoadPendingEvents(_ context.Context) ([]*queue.OutboxEvent, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	return o.match(func(event *queue.OutboxEvent) bool { return event.AckStatus == queue.NACK }), nil
+}
+
+func (o *MemoryOutbox) GetEvent(_ context.Context, eventID int) (*queue.OutboxEvent, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	event, ok := o.events[eventID]
+	if !ok {
+		return nil, queue.ErrEventNotFound
+	}
+	return clone(event), nil
+}
+
+func (o *MemoryOutbox) UpdateEventStatus(ctx context.Context, event *queue.OutboxEvent) error {
+	return o.UpdateEventStatuses(ctx, []*queue.OutboxEvent{event})
+}
+
+func (o *MemoryOutbox) UpdateEventStatuses(_ context.Context, events []*queue.OutboxEvent) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, event := range events {
+		if stored, ok := o.events[event.ID]; ok {
+			stored.Retry = event.Retry
+			stored.NextRetry = event.NextRetry
+			stored.AvailableAt = event.AvailableAt
+			stored.AckStatus = event.AckStatus
+			stored.LastError = event.LastError
+		}
+	}
+	return nil
+}
+
+func (o *MemoryOutbox) MarkEventAsProcessed(ctx context.Context, eventID int) error {
+	return o.MarkEventsAsProcessed(ctx, []int{eventID})
+}
+
+func (o *MemoryOutbox) MarkEventsAsProcessed(_ context.Context, eventIDs []int) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	now := o.clock.Now().Unix()
+	for _, id := range eventIDs {
+		if stored, ok := o.events[id]; ok {
+			stored.AckStatus = queue.ACK
+			stored.UpdatedAt = now
+		}
+	}
+	return nil
+}
+
+func (o *MemoryOutbox) MarkEventAsDead(ctx context.Context, eventID int, lastError string) error {
+	return o.MarkEventsAsDead(ctx, []*queue.OutboxEvent{{ID: eventID, LastError: lastError}})
+}
+
+func (o *MemoryOutbox) MarkEventsAsDead(_ context.Context, events []*queue.OutboxEvent) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	now := o.clock.Now().Unix()
+	for _, event := range events {
+		if stored, ok := o.events[event.ID]; ok {
+			stored.AckStatus = queue.DEAD
+			stored.LastError = event.LastError
+			stored.FailedAt = now
+			stored.UpdatedAt = now
+		}
+	}
+	return nil
+}
+
+// deadMatcher returns the predicate of the dead-lettered events matching the filter.
+func deadMatcher(filter queue.DeadLetterFilter) func(*queue.OutboxEvent) bool {
+	return func(event *queue.OutboxEvent) bool {
+		return event.AckStatus == queue.DEAD &&
+			(filter.Topic == "" || event.Topic == filter.Topic) &&
+			(filter.Subscriber == "" || event.Subscriber == filter.Subscriber) &&
+			(filter.From.IsZero() || event.FailedAt >= filter.From.Unix()) &&
+			(filter.To.IsZero() || event.FailedAt < filter.To.Unix())
+	}
+}
+
+// LoadDeadEvents returns the dead-lettered events matching the filter, oldest failures first.
+func (o *MemoryOutbox) LoadDeadEvents(_ context.Context, filter queue.DeadLetterFilter) ([]*queue.OutboxEvent, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	events := o.match(deadMatcher(filter))
+	slices.SortStableFunc(events, func(a, b *queue.OutboxEvent) int {
+		return cmp.Compare(a.FailedAt, b.FailedAt)
+	})
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, nil
+}
+
+func (o *MemoryOutbox) ReviveDeadEvents(_ context.Context, filter queue.DeadLetterFilter) ([]*queue.OutboxEvent, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	events := o.match(deadMatcher(filter))
+	for i, event := range events {
+		events[i] = o.revive(event.ID)
+	}
+	return events, nil
+}
+
+func (o *MemoryOutbox) ReviveDeadEvent(_ context.Context, eventID int) (*queue.OutboxEvent, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if event, ok := o.events[eventID]; !ok || event.AckStatus != queue.DEAD {
+		return nil, queue.ErrEventNotFound
+	}
+	return o.revive(eventID), nil
+}
+
+// revive resets the retry state of a stored event and returns a copy of it. The lock must be held.
+func (o *MemoryOutbox) revive(eventID int) *queue.OutboxEvent {
+	stored := o.events[eventID]
+	stored.Retry = 0
+	stored.NextRetry = 0
+	stored.AvailableAt = 0
+	stored.AckStatus = queue.NACK
+	stored.FailedAt = 0
+	stored.LeaseOwner = ""
+	stored.LeaseUntil = 0
+	stored.UpdatedAt = o.clock.Now().Unix()
+	return clone(stored)
+}
+
+func (o *MemoryOutbox) DeleteDeadEvents(_ context.Context, filter queue.DeadLetterFilter) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	events := o.match(deadMatcher(filter))
+	for _, event := range events {
+		delete(o.events, event.ID)
+	}
+	return len(events), nil
+}
+
+// ClaimEvents leases up to limit due pending events that are not leased by anyone else to the owner.
+// Events with an ordering key are only claimed once no earlier event with the key is pending for their subscriber.
+func (o *MemoryOutbox) ClaimEvents(
+	_ context.Context,
+	owner string,
+	limit int,
+	lease time.Duration,
+	excludeTopics ...string,
+) ([]*queue.OutboxEvent, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	now := o.clock.Now()
+	due := o.match(func(event *queue.OutboxEvent) bool {
+		return event.AckStatus == queue.NACK &&
+			event.LeaseUntil <= now.Unix() &&
+			event.AvailableAt <= now.UnixMilli() &&
+			!slices.Contains(excludeTopics, event.Topic) &&
+			!o.blocked(event)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	for i, event := range due {
+		stored := o.events[event.ID]
+		stored.LeaseOwner = owner
+		stored.LeaseUntil = now.Add(lease).Unix()
+		due[i] = clone(stored)
+	}
+	return due, nil
+}
+
+// blocked reports whether an earlier event with the ordering key of the event is pending. The lock must be held.
+func (o *MemoryOutbox) blocked(event *queue.OutboxEvent) bool {
+	if event.OrderingKey == "" {
+		return false
+	}
+
+	for _, earlier := range o.events {
+		if earlier.ID < event.ID && earlier.AckStatus == queue.NACK && earlier.Topic == event.Topic &&
+			earlier.Subscriber == event.Subscriber && earlier.OrderingKey == event.OrderingKey {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *MemoryOutbox) ExtendLeases(_ context.Context, owner string, eventIDs []int, lease time.Duration) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	until := o.clock.Now().Add(lease).Unix()
+	for _, id := range eventIDs {
+		if stored, ok := o.events[id]; ok && stored.LeaseOwner == owner {
+			stored.LeaseUntil = until
+		}
+	}
+	return nil
+}
+
+func (o *MemoryOutbox) ReleaseLeases(_ context.Context, owner string, eventIDs []int, until time.Time) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, id := range eventIDs {
+		if stored, ok := o.events[id]; ok && stored.LeaseOwner == owner {
+			stored.LeaseOwner = ""
+			stored.LeaseUntil = until.Unix()
+		}
+	}
+	return nil
+}
+
+func (o *MemoryOutbox) OldestPendingEvents(_ context.Context) (map[string]time.Time, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	now := o.clock.Now().UnixMilli()
+	oldest := make(map[string]int64)
+	for _, event := range o.events {
+		if event.AckStatus != queue.NACK || event.AvailableAt > now {
+			continue
+		}
+
+		at := max(event.AvailableAt, event.CreatedAt*1000)
+		if current, ok := oldest[event.Topic]; !ok || at < current {
+			oldest[event.Topic] = at
+		}
+	}
+
+	times := make(map[string]time.Time, len(oldest))
+	for topic, at := range oldest {
+		times[topic] = time.UnixMilli(at)
+	}
+	return times, nil
+}
+
+func (o *MemoryOutbox) MarkProcessed(_ context.Context, event *queue.ProcessedEvent) (bool, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	key := queue.ProcessedEvent{Topic: event.Topic, Subscriber: event.Subscriber, Key: event.Key}
+	if _, ok := o.processed[key]; ok {
+		return false, nil
+	}
+	o.processed[key] = event.ProcessedAt
+	return true, nil
+}
+
+func (o *MemoryOutbox) DeleteProcessedEvents(_ context.Context, before time.Time, limit int) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	deleted := 0
+	for key, processedAt := range o.processed {
+		if deleted == limit {
+			break
+		}
+		if processedAt < before.Unix() {
+			delete(o.processed, key)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// ackedMatcher returns the predicate of the acknowledged events matching the filter.
+func ackedMatcher(filter queue.AckedFilter) func(*queue.OutboxEvent) bool {
+	return func(event *queue.OutboxEvent) bool {
+		return event.AckStatus == queue.ACK &&
+			event.UpdatedAt < filter.Before.Unix() &&
+			(filter.Topic == "" || event.Topic == filter.Topic) &&
+			!slices.Contains(filter.ExcludeTopics, event.Topic)
+	}
+}
+
+// ackedBatch removes up to limit acknowledged events matching the filter and returns them. The lock must be held.
+func (o *MemoryOutbox) ackedBatch(filter queue.AckedFilter, limit int) []*queue.OutboxEvent {
+	events := o.match(ackedMatcher(filter))
+	if len(events) > limit {
+		events = events[:limit]
+	}
+
+	for _, event := range events {
+		delete(o.events, event.ID)
+	}
+	return events
+}
+
+func (o *MemoryOutbox) DeleteAckedEvents(_ context.Context, filter queue.AckedFilter, limit int) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	return len(o.ackedBatch(filter, limit)), nil
+}
+
+func (o *MemoryOutbox) ArchiveAckedEvents(_ context.Context, filter queue.AckedFilter, limit int) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	events := o.ackedBatch(filter, limit)
+	o.archive = append(o.archive, events...)
+	return len(events), nil
+}
+
+// ListEvents returns the events matching the filter in the order of their IDs.
+func (o *MemoryOutbox) ListEvents(_ context.Context, filter queue.EventFilter) ([]*queue.OutboxEvent, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	events := o.match(func(event *queue.OutboxEvent) bool {
+		return (filter.Topic == "" || event.Topic == filter.Topic) &&
+			(filter.Subscriber == "" || event.Subscriber == filter.Subscriber) &&
+			(filter.Status == "" || event.AckStatus == filter.Status) &&
+			event.ID > filter.AfterID
+	})
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+	return events, nil
+}
+
+func (o *MemoryOutbox) DeleteEvent(_ context.Context, eventID int) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if _, ok := o.events[eventID]; !ok {
+		return queue.ErrEventNotFound
+	}
+	delete(o.events, eventID)
+	return nil
+}
+
+// EventStats counts the events not acknowledged yet per topic, in order of the topics.
+func (o *MemoryOutbox) EventStats(_ context.Context) ([]*queue.TopicEventStats, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	topics := make(map[string]*queue.TopicEventStats)
+	for _, event := range o.events {
+		if event.AckStatus == queue.ACK {
+			continue
+		}
+
+		stats, ok := topics[event.Topic]
+		if !ok {
+			stats = &queue.TopicEventStats{Topic: event.Topic}
+			topics[event.Topic] = stats
+		}
+
+		switch {
+		case event.AckStatus == queue.DEAD:
+			stats.Dead++
+			continue
+		case event.Retry == 0:
+			stats.Pending++
+		default:
+			stats.Failed++
+		}
+		if stats.OldestPending == 0 || event.CreatedAt < stats.OldestPending {
+			stats.OldestPending = event.CreatedAt
+		}
+	}
+
+	stats := slices.Collect(maps.Values(topics))
+	slices.SortFunc(stats, func(a, b *queue.TopicEventStats) int {
+		return cmp.Compare(a.Topic, b.Topic)
+	})
+	return stats, nil
+}
@@ -0,0 +1,215 @@
+package queue
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+const (
+	defaultRelayPollInterval = time.Second
+	defaultRelayBatchSize    = 100
+	defaultRelayLease        = 30 * time.Second
+	relayReleaseTimeout      = 5 * time.Second
+)
+
+// RelayOptions configures the polling relay mode, in which several bus instances share one outbox table.
+type RelayOptions struct {
+	Owner         string        // Owner identifies the instance holding leases, a random ID is used when empty.
+	PollInterval  time.Duration // PollInterval is the delay between two claim cycles.
+	BatchSize     int           // BatchSize is the maximum number of events claimed per cycle.
+	LeaseDuration time.Duration // LeaseDuration is how long a claimed event stays invisible to other instances.
+}
+
+// relay claims due events from the outbox and keeps the leases of events being processed alive.
+type relay struct {
+	opts   RelayOptions
+	lock   sync.Mutex
+	leased map[int]struct{}
+}
+
+func newRelay(opts RelayOptions) *relay {
+	if opts.Owner == "" {
+		id, err := uuid.NewV4()
+		if err == nil {
+			opts.Owner = id.String()
+		}
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = defaultRelayPollInterval
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultRelayBatchSize
+	}
+	if opts.LeaseDuration <= 0 {
+		opts.LeaseDuration = defaultRelayLease
+	}
+
+	return &relay{
+		opts:   opts,
+		leased: make(map[int]struct{}),
+	}
+}
+
+// WithRelay switches the bus to the polling relay mode. Instead of loading every pending event once on start,
+// the bus claims batches of due events with row leases, so each event is processed by a single instance at a time.
+// It requires WithOutbox.
+func (bus *eventBus) WithRelay(opts RelayOptions) {
+	bus.relay = newRelay(opts)
+}
+
+// runRelay claims due events every poll interval and extends the leases of events in flight
+// until the context is done, then releases the leases left.
+func (bus *eventBus) runRelay(ctx context.Context) {
+	clock := bus.clockOf()
+
+	poll := newTicker(clock, bus.relay.opts.PollInterval)
+	defer poll.stop()
+
+	heartbeat := newTicker(clock, bus.relay.opts.LeaseDuration/3)
+	defer heartbeat.stop()
+
+	defer bus.releaseLeases(context.WithoutCancel(ctx))
+
+	bus.claimEvents(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C():
+			bus.claimEvents(ctx)
+			poll.next()
+		case <-heartbeat.C():
+			bus.extendLeases(ctx)
+			heartbeat.next()
+		}
+	}
+}
+
+// claimEvents leases as many due events as fit into the in-memory queue and the lanes of their topics
+// and enqueues them. Topics whose lane is full are not claimed. Nothing is claimed once the bus is draining.
+func (bus *eventBus) claimEvents(ctx context.Context) {
+	if bus.draining() {
+		return
+	}
+
+	limit := min(bus.relay.opts.BatchSize, cap(bus.queue)-len(bus.queue))
+	blocked := bus.gates.blocked()
+
+	bus.lock.RLock()
+	pool := bus.pool
+	bus.lock.RUnlock()
+
+	if pool != nil {
+		full, room, ok := pool.free()
+		blocked = append(blocked, full...)
+		if ok {
+			limit = min(limit, room)
+		}
+	}
+	if limit <= 0 {
+		return
+	}
+
+	events, err := bus.outbox.ClaimEvents(ctx, bus.relay.opts.Owner, limit, bus.relay.opts.LeaseDuration,
+		blocked...)
+	if err != nil {
+		bus.log.ErrorCtx(ctx, err, "Failed to claim events from outbox")
+		return
+	}
+
+	for _, outboxEvent := range events {
+		bus.relay.track(outboxEvent.ID)
+
+		if err = bus.enqueue(ctx, convertOutboxEventToEvent(outboxEvent)); err != nil {
+			return
+		}
+	}
+}
+
+// extendLeases prolongs the leases of every event the relay holds.
+func (bus *eventBus) extendLeases(ctx context.Context) {
+	ids := bus.relay.ids()
+	if len(ids) == 0 {
+		return
+	}
+
+	if err := bus.outbox.ExtendLeases(ctx, bus.relay.opts.Owner, ids, bus.relay.opts.LeaseDuration); err != nil {
+		bus.log.ErrorCtx(ctx, err, "Failed to extend event leases in outbox")
+	}
+}
+
+// releaseLeases gives up the leases of every event the relay holds, so other instances can claim them right away.
+func (bus *eventBus) releaseLeases(ctx context.Context) {
+	ids := bus.relay.ids()
+	if len(ids) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, relayReleaseTimeout)
+	defer cancel()
+
+	if err := bus.outbox.ReleaseLeases(ctx, bus.relay.opts.Owner, ids, bus.now()); err != nil {
+		bus.log.ErrorCtx(ctx, err, "Failed to release event leases in outbox")
+		return
+	}
+
+	for _, id := range ids {
+		bus.relay.forget(id)
+	}
+}
+
+// rescheduleEvent releases the lease of a NACKed event, it becomes claimable again once its AvailableAt moment passes.
+func (bus *eventBus) rescheduleEvent(ctx context.Context, event *Event) {
+	bus.rescheduleEvents(ctx, []*Event{event})
+}
+
+// rescheduleEvents releases the leases of NACKed events at once, see rescheduleEvent.
+func (bus *eventBus) rescheduleEvents(ctx context.Context, events []*Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	ids := make([]int, len(events))
+	for i, event := range events {
+		bus.relay.forget(event.ID)
+		ids[i] = event.ID
+	}
+
+	err := bus.outbox.ReleaseLeases(ctx, bus.relay.opts.Owner, ids, bus.now())
+	if err != nil {
+		bus.log.ErrorCtx(ctx, err, "Failed to release event leases in outbox")
+	}
+}
+
+// track marks the event as held by the relay.
+func (r *relay) track(eventID int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.leased[eventID] = struct{}{}
+}
+
+// forget marks the event as no longer held by the relay.
+func (r *relay) forget(eventID int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.leased, eventID)
+}
+
+// ids returns the IDs of the events held by the relay.
+func (r *relay) ids() []int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	ids := make([]int, 0, len(r.leased))
+	for id := range r.leased {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
@@ -0,0 +1,148 @@
+package queue
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"time"
+)
+
+const (
+	defaultRetentionInterval  = time.Hour
+	defaultRetentionBatchSize = 1000
+)
+
+// MetricOpRetention is the number of acknowledged events removed from the outbox by the last retention run,
+// the message is "deleted" or "archived". Topics without their own retention are reported under the "*" sub type.
+// Expired records of processed events are reported under the "*" sub type with the "processed" message.
+const MetricOpRetention = "retention"
+
+// RetentionOptions configures the removal of acknowledged events from the outbox.
+type RetentionOptions struct {
+	Period    time.Duration            // Period is how long acknowledged events are kept, forever when zero.
+	Topics    map[string]time.Duration // Topics overrides Period per topic, zero keeps the events of a topic forever.
+	Archive   bool                     // Archive moves events to the archive table instead of deleting them.
+	Interval  time.Duration            // Interval is the delay between two retention runs.
+	BatchSize int                      // BatchSize is the maximum number of events removed per statement.
+
+	// Processed is how long the records of MarkProcessed are kept, forever when zero. It must outlast
+	// the redeliveries of an event, an event redelivered after its record expired is handled again.
+	Processed time.Duration
+}
+
+// retention removes acknowledged events from the outbox in the background.
+type retention struct {
+	opts RetentionOptions
+}
+
+func newRetention(opts RetentionOptions) *retention {
+	if opts.Interval <= 0 {
+		opts.Interval = defaultRetentionInterval
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultRetentionBatchSize
+	}
+
+	return &retention{opts: opts}
+}
+
+// WithRetention makes the bus remove acknowledged events older than their retention period from the outbox
+// while processing. Events are removed in batches, apart from the processing loop. It requires WithOutbox.
+func (bus *eventBus) WithRetention(opts RetentionOptions) {
+	bus.retention = newRetention(opts)
+}
+
+// runRetention removes expired events every interval until ctx is done or the bus drains.
+func (bus *eventBus) runRetention(ctx context.Context) {
+	ticker := newTicker(bus.clockOf(), bus.retention.opts.Interval)
+	defer ticker.stop()
+
+	bus.applyRetention(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-bus.drain:
+			return
+		case <-ticker.C():
+			bus.applyRetention(ctx)
+			ticker.next()
+		}
+	}
+}
+
+// applyRetention removes the expired events of every topic with a retention period.
+func (bus *eventBus) applyRetention(ctx context.Context) {
+	opts := bus.retention.opts
+	now := bus.now()
+
+	// topics with their own retention are excluded from the default one, whatever their period
+	topics := slices.Sorted(maps.Keys(opts.Topics))
+	for _, topic := range topics {
+		if period := opts.Topics[topic]; period > 0 {
+			bus.removeExpired(ctx, topic, AckedFilter{Topic: topic, Before: now.Add(-period)})
+		}
+	}
+	if opts.Period > 0 {
+		bus.removeExpired(ctx, "*", AckedFilter{ExcludeTopics: topics, Before: now.Add(-opts.Period)})
+	}
+	if opts.Processed > 0 {
+		bus.removeProcessed(ctx, now.Add(-opts.Processed))
+	}
+}
+
+// removeExpired removes the events matching the filter batch by batch, reporting their number under the topic.
+func (bus *eventBus) removeExpired(ctx context.Context, topic string, filter AckedFilter) {
+	remove, action := bus.outbox.DeleteAckedEvents, "deleted"
+	if bus.retention.opts.Archive {
+		remove, action = bus.outbox.ArchiveAckedEvents, "archived"
+	}
+
+	total, err := bus.removeBatches(ctx, func(ctx context.Context, limit int) (int, error) {
+		return remove(ctx, filter, limit)
+	})
+	if err != nil {
+		bus.log.ErrorCtx(ctx, err, "Failed to remove acknowledged events of %s from outbox", topic)
+	}
+
+	if total > 0 {
+		bus.log.InfoCtx(ctx, "Retention %s %d acknowledged events of %s", action, total, topic)
+	}
+	bus.setGauge(series(topic, MetricOpRetention).Gauge(float64(total), action))
+}
+
+// removeProcessed deletes the records of events processed before the given time batch by batch.
+func (bus *eventBus) removeProcessed(ctx context.Context, before time.Time) {
+	total, err := bus.removeBatches(ctx, func(ctx context.Context, limit int) (int, error) {
+		return bus.outbox.DeleteProcessedEvents(ctx, before, limit)
+	})
+	if err != nil {
+		bus.log.ErrorCtx(ctx, err, "Failed to remove processed events")
+	}
+
+	if total > 0 {
+		bus.log.InfoCtx(ctx, "Retention deleted %d processed events", total)
+	}
+	bus.setGauge(series("*", MetricOpRetention).Gauge(float64(total), "processed"))
+}
+
+// removeBatches calls remove with the batch size until it removes less than a full batch, ctx is done
+// or the bus drains, and returns the number of removed rows.
+func (bus *eventBus) removeBatches(ctx context.Context, remove func(ctx context.Context, limit int) (int, error)) (int, error) {
+	batchSize := bus.retention.opts.BatchSize
+
+	total := 0
+	for ctx.Err() == nil && !bus.draining() {
+		n, err := remove(ctx, batchSize)
+		if err != nil {
+			return total, err
+		}
+
+		total += n
+		if n < batchSize {
+			break
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,171 @@
+package queue
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+// RetryPolicy decides whether a NACKed event is retried and after which delay.
+type RetryPolicy interface {
+	// Next returns the delay before the next attempt, event.Retry holds the number of retries already made.
+	// It returns false when the event must not be retried anymore.
+	Next(event *Event) (time.Duration, bool)
+}
+
+// retryLimiter is implemented by policies with a fixed number of retries, it backs ExceededMaxRetries.
+type retryLimiter interface {
+	MaxRetries() int
+}
+
+// DelaysPolicy retries an event once per delay, in order.
+type DelaysPolicy struct {
+	Delays []time.Duration
+}
+
+// NewDelaysPolicy creates a DelaysPolicy from delays expressed in units of durationType.
+func NewDelaysPolicy(delays []int, durationType time.Duration) DelaysPolicy {
+	delaysDuration := make([]time.Duration, len(delays))
+
+	for index, delay := range delays {
+		delaysDuration[index] = time.Duration(delay) * durationType
+	}
+
+	return DelaysPolicy{Delays: delaysDuration}
+}
+
+func (p DelaysPolicy) Next(event *Event) (time.Duration, bool) {
+	if event.Retry >= len(p.Delays) {
+		return 0, false
+	}
+	return p.Delays[event.Retry], true
+}
+
+func (p DelaysPolicy) MaxRetries() int {
+	return len(p.Delays)
+}
+
+// FixedPolicy retries an event up to Retries times with the same delay.
+type FixedPolicy struct {
+	Delay   time.Duration
+	Retries int
+}
+
+func (p FixedPolicy) Next(event *Event) (time.Duration, bool) {
+	if event.Retry >= p.Retries {
+		return 0, false
+	}
+	return p.Delay, true
+}
+
+func (p FixedPolicy) MaxRetries() int {
+	return p.Retries
+}
+
+// LinearPolicy retries an event up to Retries times, growing the delay by Step after each retry.
+type LinearPolicy struct {
+	Initial time.Duration
+	Step    time.Duration
+	Retries int
+}
+
+func (p LinearPolicy) Next(event *Event) (time.Duration, bool) {
+	if event.Retry >= p.Retries {
+		return 0, false
+	}
+	return p.Initial + time.Duration(event.Retry)*p.Step, true
+}
+
+func (p LinearPolicy) MaxRetries() int {
+	return p.Retries
+}
+
+// ExponentialPolicy retries an event up to Retries times, multiplying the delay by Multiplier after each retry.
+// The delay is capped by Max when set. Jitter in [0, 1] randomizes the delay by up to that fraction of it,
+// so events failing together do not come back together.
+type ExponentialPolicy struct {
+	Initial    time.Duration
+	Multiplier float64
+	Max        time.Duration
+	Jitter     float64
+	Retries    int
+}
+
+func (p ExponentialPolicy) Next(event *Event) (time.Duration, bool) {
+	if event.Retry >= p.Retries {
+		return 0, false
+	}
+
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+
+	delay := float64(p.Initial) * math.Pow(multiplier, float64(event.Retry))
+	if p.Max > 0 && delay > float64(p.Max) {
+		delay = float64(p.Max)
+	}
+
+	if jitter := min(max(p.Jitter, 0), 1); jitter > 0 {
+		delay += delay * jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(delay), true
+}
+
+func (p ExponentialPolicy) MaxRetries() int {
+	return p.Retries
+}
+
+// MaxElapsedPolicy wraps a policy and stops retrying once the next attempt would happen
+// later than MaxElapsed after the event was published.
+type MaxElapsedPolicy struct {
+	Policy     RetryPolicy
+	MaxElapsed time.Duration
+	Clock      Clock // Clock measures the elapsed time, the system clock when nil.
+}
+
+func (p MaxElapsedPolicy) Next(event *Event) (time.Duration, bool) {
+	delay, ok := p.Policy.Next(event)
+	if !ok {
+		return 0, false
+	}
+
+	clock := p.Clock
+	if clock == nil {
+		clock = SystemClock{}
+	}
+
+	if !event.CreatedAt.IsZero() && clock.Now().Sub(event.CreatedAt)+delay > p.MaxElapsed {
+		return 0, false
+	}
+
+	return delay, true
+}
+
+func (p MaxElapsedPolicy) MaxRetries() int {
+	if limiter, ok := p.Policy.(retryLimiter); ok {
+		return limiter.MaxRetries()
+	}
+	return math.MaxInt
+}
+
+// nextRetry returns the delay before the next attempt of a NACKed event and whether it is retried at all.
+// A retry-after hint set by the handler replaces the delay of the policy, the policy still caps the retries.
+func nextRetry(policy RetryPolicy, event *Event) (time.Duration, bool) {
+	if policy == nil {
+		return 0, false
+	}
+
+	delay, ok := policy.Next(event)
+	if !ok {
+		return 0, false
+	}
+
+	if event.RetryAfter > 0 {
+		delay = event.RetryAfter
+		event.RetryAfter = 0
+	}
+
+	return delay, true
+}
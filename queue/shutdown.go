@@ -0,0 +1,97 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrBusClosed is returned when publishing to a bus that is shutting down.
+var ErrBusClosed = errors.New("event bus is closed")
+
+// ShutdownError reports the events Shutdown left unprocessed. Events left with the outbox configured stay pending
+// there and are picked up again on the next start.
+type ShutdownError struct {
+	InFlight  int   // InFlight is the number of handlers still running when the deadline passed.
+	Queued    int   // Queued is the number of events waiting for a worker, an earlier event of their key or a resume.
+	Scheduled int   // Scheduled is the number of pending retries and delayed events.
+	Err       error // Err is the context error when the deadline passed before the handlers finished.
+}
+
+func (e *ShutdownError) Error() string {
+	msg := fmt.Sprintf("event bus shutdown left %d in-flight, %d queued and %d scheduled events",
+		e.InFlight, e.Queued, e.Scheduled)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *ShutdownError) Unwrap() error {
+	return e.Err
+}
+
+// Shutdown gracefully stops the bus. It stops accepting publishes and dispatching queued events, waits for in-flight
+// handlers to finish and persists pending retries to the outbox, including the ones scheduled by those handlers.
+// When ctx is done first, the handlers left are cancelled. A *ShutdownError is returned if any event was left
+// unprocessed.
+func (bus *eventBus) Shutdown(ctx context.Context) error {
+	bus.closeOnce.Do(func() {
+		bus.closed.Store(true)
+		close(bus.drain)
+	})
+
+	bus.lock.RLock()
+	pool := bus.pool
+	bus.lock.RUnlock()
+
+	report := &ShutdownError{}
+
+	if pool != nil {
+		select {
+		case <-pool.idle():
+		case <-ctx.Done():
+			report.InFlight = int(pool.inFlight.Load())
+			report.Err = ctx.Err()
+			pool.cancel()
+		}
+
+		report.Queued += pool.queued()
+	}
+
+	// the retries are saved even when ctx is done, so the ones scheduled by the handlers are not lost
+	report.Queued += len(bus.queue) + bus.sequencer.held() + bus.gates.held()
+	report.Scheduled = bus.persistScheduled(context.WithoutCancel(ctx))
+
+	if report.InFlight == 0 && report.Queued == 0 && report.Scheduled == 0 {
+		return nil
+	}
+
+	return report
+}
+
+// draining reports whether Shutdown was called.
+func (bus *eventBus) draining() bool {
+	return bus.closed.Load()
+}
+
+// persistScheduled saves the state of events waiting for their AvailableAt moment to the outbox
+// and returns their number.
+func (bus *eventBus) persistScheduled(ctx context.Context) int {
+	bus.scheduledLock.Lock()
+	events := make([]*Event, 0, len(bus.scheduled))
+	for event := range bus.scheduled {
+		events = append(events, event)
+	}
+	bus.scheduledLock.Unlock()
+
+	if bus.outbox != nil {
+		for _, event := range events {
+			if event.ID != 0 {
+				bus.updateEventStatus(ctx, event)
+			}
+		}
+	}
+
+	return len(events)
+}
@@ -0,0 +1,228 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrSinkRejected is wrapped by sinks refusing an event for good, the event is dead-lettered instead of retried.
+var ErrSinkRejected = errors.New("event rejected by sink")
+
+// Webhook request headers set by WebhookSink, along with the event headers listed by WebhookOptions.ForwardHeaders.
+const (
+	WebhookHeaderEventID   = "X-Event-Id"        // WebhookHeaderEventID carries the outbox ID of the event.
+	WebhookHeaderTopic     = "X-Event-Topic"     // WebhookHeaderTopic carries the topic of the event.
+	WebhookHeaderTimestamp = "X-Event-Timestamp" // WebhookHeaderTimestamp carries the unix time of the request.
+	WebhookHeaderSignature = "X-Event-Signature" // WebhookHeaderSignature carries "sha256=<hex HMAC>", see SignWebhook.
+)
+
+const defaultWebhookTimeout = 10 * time.Second
+
+// DefaultWebhookForwardHeaders are the event headers sent along by a WebhookSink unless
+// WebhookOptions.ForwardHeaders lists others. Headers identifying users or requests stay within the process.
+var DefaultWebhookForwardHeaders = []string{HeaderContentType, HeaderTraceparent, HeaderTracestate}
+
+// Sink delivers events outside the process, e.g. to a broker or a webhook. See EventBus.RelayTo.
+//
+// Send returns nil once the sink confirmed the delivery, the event is ACKed then. An error wrapping
+// ErrSinkRejected dead-letters the event, any other error NACKs it. Send may call Event.SetRetryAfter.
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, event *Event) error
+}
+
+// RelayTo delivers the events of the topic to the sink through a subscription named "sink:<name>"
+// unless the options name it otherwise. See Subscribe.
+func (bus *eventBus) RelayTo(
+	topic string,
+	sink Sink,
+	delays []int,
+	durationType time.Duration,
+	opts ...SubscribeOptions,
+) {
+	var opt SubscribeOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if opt.Name == "" {
+		opt.Name = "sink:" + sink.Name()
+	}
+
+	bus.Subscribe(topic, func(ctx context.Context, event *Event) AckStatus {
+		err := sink.Send(ctx, event)
+		if err == nil {
+			return ACK
+		}
+
+		event.SetError(err)
+		if errors.Is(err, ErrSinkRejected) {
+			return DEAD
+		}
+		return NACK
+	}, delays, durationType, opt)
+}
+
+// WebhookOptions configures a WebhookSink.
+type WebhookOptions struct {
+	URL     string            // URL receives the events as POST requests.
+	Secret  []byte            // Secret signs the requests, they are not signed when empty.
+	Headers map[string]string // Headers are added to every request.
+	Client  *http.Client      // Client sends the requests, one with a 10s timeout is used when nil.
+
+	// ForwardHeaders are the event headers sent along with the data, DefaultWebhookForwardHeaders when nil.
+	// An empty, non-nil slice forwards none.
+	ForwardHeaders []string
+}
+
+// WebhookSink posts the data of events to an HTTP endpoint, signed with an HMAC of the request.
+//
+// 2xx responses confirm the delivery. Other 4xx responses than 408 and 429 reject the event, the rest are retried,
+// honouring the Retry-After header given in seconds.
+type WebhookSink struct {
+	name string
+	opts WebhookOptions
+}
+
+// NewWebhookSink creates a webhook sink with the given name.
+func NewWebhookSink(name string, opts WebhookOptions) *WebhookSink {
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: defaultWebhookTimeout}
+	}
+	if opts.ForwardHeaders == nil {
+		opts.ForwardHeaders = DefaultWebhookForwardHeaders
+	}
+
+	return &WebhookSink{name: name, opts: opts}
+}
+
+func (s *WebhookSink) Name() string {
+	return s.name
+}
+
+func (s *WebhookSink) Send(ctx context.Context, event *Event) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.opts.URL, bytes.NewReader(event.Data))
+	if err != nil {
+		return fmt.Errorf("%w: build webhook request: %w", ErrSinkRejected, err)
+	}
+
+	for _, key := range s.opts.ForwardHeaders {
+		if value, ok := event.Headers[key]; ok {
+			req.Header.Set(key, value)
+		}
+	}
+	for key, value := range s.opts.Headers {
+		req.Header.Set(key, value)
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(WebhookHeaderEventID, strconv.Itoa(event.ID))
+	req.Header.Set(WebhookHeaderTopic, event.Topic)
+	req.Header.Set(WebhookHeaderTimestamp, timestamp)
+	if len(s.opts.Secret) > 0 {
+		req.Header.Set(WebhookHeaderSignature, SignWebhook(s.opts.Secret, timestamp, event.Data))
+	}
+
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("send webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// drain the body, so the connection is reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests:
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		return fmt.Errorf("%w: webhook responded %s", ErrSinkRejected, resp.Status)
+	}
+
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		event.SetRetryAfter(time.Duration(seconds) * time.Second)
+	}
+	return fmt.Errorf("webhook responded %s", resp.Status)
+}
+
+// SignWebhook returns the signature of a webhook request, "sha256=" followed by the hex encoded HMAC-SHA256
+// of the timestamp, a dot and the body.
+func SignWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook reports whether the signature matches the timestamp and the body of a webhook request,
+// receivers should reject stale timestamps as well.
+func VerifyWebhook(secret []byte, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhook(secret, timestamp, body)), []byte(signature))
+}
+
+// MemorySink keeps the events sent to it, it is meant for tests.
+type MemorySink struct {
+	name   string
+	lock   sync.Mutex
+	events []*Event
+	err    error
+}
+
+// NewMemorySink creates an in-memory sink with the given name.
+func NewMemorySink(name string) *MemorySink {
+	return &MemorySink{name: name}
+}
+
+func (s *MemorySink) Name() string {
+	return s.name
+}
+
+func (s *MemorySink) Send(_ context.Context, event *Event) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+
+	sent := *event
+	sent.Data = bytes.Clone(event.Data)
+	sent.Headers = maps.Clone(event.Headers)
+	s.events = append(s.events, &sent)
+
+	return nil
+}
+
+// FailWith makes the following sends fail with err, nil makes them succeed again.
+func (s *MemorySink) FailWith(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.err = err
+}
+
+// Events returns copies of the events sent so far, in the order they were sent.
+func (s *MemorySink) Events() []*Event {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	events := make([]*Event, 0, len(s.events))
+	for _, event := range s.events {
+		sent := *event
+		events = append(events, &sent)
+	}
+	return events
+}
@@ -0,0 +1,93 @@
+package queue
+
+import (
+	"context"
+	"errors"
+)
+
+// Span attributes set by the bus.
+const (
+	SpanAttrTopic      = "messaging.destination.name"
+	SpanAttrSubscriber = "messaging.consumer.name"
+	SpanAttrEventID    = "messaging.message.id"
+	SpanAttrRetry      = "messaging.retry"
+	SpanAttrAckStatus  = "messaging.ack_status"
+	SpanAttrDeliveries = "messaging.deliveries"
+	SpanAttrBatchSize  = "messaging.batch.message_count"
+)
+
+// Span is the part of a tracing span used by the bus.
+//
+// It is an alias of an unnamed interface, so tracer adapters living in other modules, like tracing.QueueTracer,
+// can return an identical interface literal without importing this package.
+type Span = interface {
+	End()
+	RecordError(err error)
+	SetError(description string)
+	SetAttributeInt(k string, v int)
+	SetAttributeString(k string, v string)
+}
+
+// Tracer starts the producer span of every published event and the consumer span of every handler invocation.
+// Consumer spans continue the trace of the producer when its trace context is propagated through the event
+// headers: a Tracer that is also a Propagator, like tracing.QueueTracer, injects the traceparent and tracestate
+// headers into every published event.
+type Tracer interface {
+	Start(ctx context.Context, spanName string) (context.Context, Span)
+}
+
+// WithTracer sets the tracer of the bus, no spans are created without it.
+// A tracer implementing Propagator is added to the propagators of the bus as well.
+func (bus *eventBus) WithTracer(tracer Tracer) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	bus.tracer = tracer
+	if propagator, ok := tracer.(Propagator); ok {
+		bus.propagators = append(bus.propagators, propagator)
+	}
+}
+
+// startSpan starts a span with the tracer of the bus, or a no-op span when there is none.
+func (bus *eventBus) startSpan(ctx context.Context, spanName string) (context.Context, Span) {
+	bus.lock.RLock()
+	tracer := bus.tracer
+	bus.lock.RUnlock()
+
+	if tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return tracer.Start(ctx, spanName)
+}
+
+// endConsumerSpan records the outcome of a handler invocation on its span and ends it.
+func endConsumerSpan(span Span, status AckStatus, lastError string) {
+	defer span.End()
+
+	span.SetAttributeString(SpanAttrAckStatus, string(status))
+
+	if status == ACK {
+		return
+	}
+
+	msg := lastError
+	if msg == "" {
+		msg = "event not acknowledged"
+	}
+	span.RecordError(errors.New(msg))
+
+	if status == DEAD {
+		span.SetError("event dead-lettered: " + msg)
+		return
+	}
+	span.SetError(msg)
+}
+
+// noopSpan is used when the bus has no tracer.
+type noopSpan struct{}
+
+func (noopSpan) End()                            {}
+func (noopSpan) RecordError(_ error)             {}
+func (noopSpan) SetError(_ string)               {}
+func (noopSpan) SetAttributeInt(_ string, _ int) {}
+func (noopSpan) SetAttributeString(_, _ string)  {}
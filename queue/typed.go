@@ -0,0 +1,83 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"time"
+)
+
+// ErrUnexpectedContentType is recorded as the error of an event whose content type does not match the codec
+// of its typed subscription.
+var ErrUnexpectedContentType = errors.New("unexpected event content type")
+
+// TypedHandler handles an event along with its data decoded into a value of type T.
+type TypedHandler[T any] func(ctx context.Context, event *Event, value T) AckStatus
+
+// PublishTyped encodes the value with the codec and publishes it to the topic with the content type of the codec
+// in its headers. See EventBus.PublishCtx.
+func PublishTyped[T any](
+	ctx context.Context,
+	bus EventBus,
+	codec Codec,
+	topic string,
+	value T,
+	opts ...PublishOptions,
+) error {
+	data, err := codec.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("encode event: %w", err)
+	}
+
+	var opt PublishOptions
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+
+	headers := make(map[string]string, len(opt.Headers)+1)
+	maps.Copy(headers, opt.Headers)
+	headers[HeaderContentType] = codec.ContentType()
+	opt.Headers = headers
+
+	return bus.PublishCtx(ctx, topic, data, opt)
+}
+
+// SubscribeTyped subscribes a handler receiving the event data decoded with the codec. See EventBus.Subscribe.
+//
+// Events that can't be decoded, or whose content type header differs from the one of the codec, are dead-lettered
+// right away, retrying them would fail the same way. Events without a content type header are decoded as well.
+func SubscribeTyped[T any](
+	bus EventBus,
+	codec Codec,
+	topic string,
+	handler TypedHandler[T],
+	delays []int,
+	durationType time.Duration,
+	opts ...SubscribeOptions,
+) {
+	bus.Subscribe(topic, func(ctx context.Context, event *Event) AckStatus {
+		value, err := decode[T](codec, event)
+		if err != nil {
+			event.SetError(err)
+			return DEAD
+		}
+
+		return handler(ctx, event, value)
+	}, delays, durationType, opts...)
+}
+
+// decode decodes the data of the event with the codec.
+func decode[T any](codec Codec, event *Event) (T, error) {
+	var value T
+
+	if contentType, ok := event.Headers[HeaderContentType]; ok && contentType != codec.ContentType() {
+		return value, fmt.Errorf("%w: %s, want %s", ErrUnexpectedContentType, contentType, codec.ContentType())
+	}
+
+	if err := codec.Unmarshal(event.Data, &value); err != nil {
+		return value, fmt.Errorf("decode event: %w", err)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,370 @@
+package queue
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultConcurrency is the bus-wide limit of in-flight events used unless SetConcurrency is called.
+const DefaultConcurrency = 32
+
+// PoolStats is a snapshot of the worker pool saturation.
+type PoolStats struct {
+	Capacity int                       // Capacity is the bus-wide limit of in-flight events.
+	InFlight int                       // InFlight is the number of events being handled right now.
+	Topics   map[string]TopicPoolStats // Topics holds the saturation of every topic seen by the pool.
+}
+
+// TopicPoolStats is a snapshot of the worker pool saturation for a single topic.
+type TopicPoolStats struct {
+	Capacity int // Capacity is the limit of in-flight events for the topic.
+	InFlight int // InFlight is the number of events of the topic being handled right now.
+	Queued   int // Queued is the number of events of the topic waiting for a worker.
+}
+
+// workerPool runs a fixed set of workers per topic, all of them sharing the bus-wide semaphore.
+type workerPool struct {
+	bus      *eventBus
+	sem      chan struct{}
+	cancel   context.CancelFunc // cancel stops the handlers of the pool.
+	lock     sync.RWMutex
+	lanes    map[string]*lane
+	inFlight atomic.Int64
+	busy     atomic.Int64   // busy counts the workers holding an event, waiting or not, see Idle.
+	workers  sync.WaitGroup // workers tracks the running workers, they exit once the bus is drained.
+}
+
+// lane is a per-topic queue consumed by a fixed number of workers.
+//
+// Pushing to a lane never blocks, so a topic whose events wait for a rate limit, a concurrency cap or slow
+// handlers never stops the dispatch of the other topics. Publishers and the relay are held back once the lane
+// holds size events instead, see eventBus.full, so a lane never holds more than size events and the ones
+// in the queue of the bus.
+type lane struct {
+	limit    int
+	size     int // size is the number of waiting events holding back the publishers of the topic.
+	lock     sync.Mutex
+	events   []*Event      // events wait for a worker, in order of arrival.
+	ready    chan struct{} // ready wakes up a worker when events are waiting.
+	room     chan struct{} // room is closed once an event leaves the full lane, nil while nobody waits for it.
+	inFlight atomic.Int64
+}
+
+// push appends the event to the lane and wakes up a worker.
+func (l *lane) push(event *Event) {
+	l.lock.Lock()
+	l.events = append(l.events, event)
+	l.lock.Unlock()
+
+	l.wake()
+}
+
+// requeue puts back an event taken from the lane, ahead of the waiting ones.
+func (l *lane) requeue(event *Event) {
+	l.lock.Lock()
+	l.events = append([]*Event{event}, l.events...)
+	l.lock.Unlock()
+
+	l.wake()
+}
+
+// pop takes the oldest event of the lane, false when there is none.
+// Another worker is woken up when events are left.
+func (l *lane) pop() (*Event, bool) {
+	l.lock.Lock()
+	if len(l.events) == 0 {
+		l.lock.Unlock()
+		return nil, false
+	}
+
+	event := l.events[0]
+	l.events[0] = nil
+	l.events = l.events[1:]
+	left := len(l.events)
+	if l.room != nil && left < l.size {
+		close(l.room)
+		l.room = nil
+	}
+	l.lock.Unlock()
+
+	if left > 0 {
+		l.wake()
+	}
+	return event, true
+}
+
+// queued returns the number of events waiting in the lane.
+func (l *lane) queued() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return len(l.events)
+}
+
+// free returns the number of events the lane takes before it is full.
+func (l *lane) free() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return max(l.size-len(l.events), 0)
+}
+
+// full returns a channel closed once the lane has room, nil when it has room already.
+func (l *lane) full() <-chan struct{} {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if len(l.events) < l.size {
+		return nil
+	}
+	if l.room == nil {
+		l.room = make(chan struct{})
+	}
+	return l.room
+}
+
+// wake signals a single waiting worker, a signal already pending is enough.
+func (l *lane) wake() {
+	select {
+	case l.ready <- struct{}{}:
+	default:
+	}
+}
+
+func newWorkerPool(bus *eventBus, cancel context.CancelFunc) *workerPool {
+	bus.lock.RLock()
+	defer bus.lock.RUnlock()
+
+	return &workerPool{
+		bus:    bus,
+		sem:    bus.sem,
+		cancel: cancel,
+		lanes:  make(map[string]*lane),
+	}
+}
+
+// SetConcurrency sets the bus-wide limit of in-flight events. It must be called before StartProcessing.
+func (bus *eventBus) SetConcurrency(workers int) {
+	if workers <= 0 {
+		return
+	}
+
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	bus.workers = workers
+	bus.sem = make(chan struct{}, workers)
+}
+
+// PoolStats returns the current saturation of the worker pool.
+func (bus *eventBus) PoolStats() PoolStats {
+	bus.lock.RLock()
+	pool := bus.pool
+	stats := PoolStats{
+		Capacity: bus.workers,
+		Topics:   make(map[string]TopicPoolStats),
+	}
+	bus.lock.RUnlock()
+
+	if pool == nil {
+		return stats
+	}
+
+	stats.InFlight = int(pool.inFlight.Load())
+
+	pool.lock.RLock()
+	defer pool.lock.RUnlock()
+
+	for topic, l := range pool.lanes {
+		stats.Topics[topic] = TopicPoolStats{
+			Capacity: l.limit,
+			InFlight: int(l.inFlight.Load()),
+			Queued:   l.queued(),
+		}
+	}
+
+	return stats
+}
+
+// dispatch hands the event over to the workers of its topic without waiting for them.
+func (p *workerPool) dispatch(ctx context.Context, event *Event) {
+	if l := p.lane(ctx, event.Topic); l != nil {
+		l.push(event)
+	}
+}
+
+// existing returns the lane of the topic without starting it, nil when the topic has none yet.
+func (p *workerPool) existing(topic string) *lane {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.lanes[topic]
+}
+
+// free returns the topics whose lane is full and the least room left in the other lanes, or ok false
+// when no lane has been started yet.
+func (p *workerPool) free() (full []string, room int, ok bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	for topic, l := range p.lanes {
+		free := l.free()
+		if free == 0 {
+			full = append(full, topic)
+			continue
+		}
+		if !ok || free < room {
+			room, ok = free, true
+		}
+	}
+
+	return full, room, ok
+}
+
+// queued returns the number of events waiting for a worker in all lanes.
+func (p *workerPool) queued() int {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	queued := 0
+	for _, l := range p.lanes {
+		queued += l.queued()
+	}
+
+	return queued
+}
+
+// idle returns a channel closed once every worker exited. It must be called after the bus started draining.
+func (p *workerPool) idle() <-chan struct{} {
+	done := make(chan struct{})
+
+	// holding the lock guarantees no lane starts workers while waiting
+	p.lock.Lock()
+	go func() {
+		defer close(done)
+		p.workers.Wait()
+	}()
+	p.lock.Unlock()
+
+	return done
+}
+
+// lane returns the lane of the topic, starting its workers on first use. It returns nil once the bus is draining.
+func (p *workerPool) lane(ctx context.Context, topic string) *lane {
+	p.lock.RLock()
+	l, ok := p.lanes[topic]
+	p.lock.RUnlock()
+
+	if ok {
+		return l
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if l, ok = p.lanes[topic]; ok {
+		return l
+	}
+	if p.bus.draining() {
+		return nil
+	}
+
+	p.bus.lock.RLock()
+	limit := p.bus.concurrency[topic]
+	if limit <= 0 || limit > cap(p.sem) {
+		limit = cap(p.sem)
+	}
+	p.bus.lock.RUnlock()
+
+	l = &lane{
+		limit: limit,
+		size:  max(cap(p.bus.queue), 1),
+		ready: make(chan struct{}, 1),
+	}
+	p.lanes[topic] = l
+
+	p.workers.Add(limit)
+	for i := 0; i < limit; i++ {
+		go p.work(ctx, l)
+	}
+
+	return l
+}
+
+// work processes events of a lane one by one, holding a bus-wide slot for each of them.
+// It exits when the bus starts draining, finishing the event at hand.
+func (p *workerPool) work(ctx context.Context, l *lane) {
+	defer p.workers.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.bus.drain:
+			return
+		case <-l.ready:
+		}
+
+		for ctx.Err() == nil && !p.bus.draining() {
+			// the worker is busy before the event leaves the lane, so Idle never misses it
+			p.busy.Add(1)
+			event, ok := l.pop()
+			if !ok {
+				p.busy.Add(-1)
+				break
+			}
+
+			ok = p.handle(ctx, l, event)
+			p.busy.Add(-1)
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+// handle processes an event taken from the lane. It reports false when the worker must exit.
+func (p *workerPool) handle(ctx context.Context, l *lane, event *Event) bool {
+	if p.bus.park(ctx, event) {
+		return true
+	}
+
+	release, err := p.bus.throttle(ctx, event)
+	if err != nil {
+		return false
+	}
+
+	if p.bus.draining() {
+		// leave the event queued, it is reported by Shutdown
+		l.requeue(event)
+		release()
+		return false
+	}
+
+	// the topic may have been paused while the event waited for its rate limit
+	if p.bus.park(ctx, event) {
+		release()
+		return true
+	}
+	ctx = p.bus.withProbe(ctx, event)
+
+	select {
+	case p.sem <- struct{}{}:
+	case <-ctx.Done():
+		release()
+		return false
+	}
+
+	p.inFlight.Add(1)
+	l.inFlight.Add(1)
+
+	processEvent(ctx, p.bus, event)
+	release()
+
+	l.inFlight.Add(-1)
+	p.inFlight.Add(-1)
+	<-p.sem
+
+	return true
+}
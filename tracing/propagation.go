@@ -0,0 +1,20 @@
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// TraceContextPropagator copies the W3C trace context (traceparent and tracestate) between a context and
+// string headers. It satisfies the queue.Propagator interface, so events published to the queue carry the trace
+// of the publisher and their handlers continue it.
+type TraceContextPropagator struct{}
+
+func (TraceContextPropagator) Inject(ctx context.Context, headers map[string]string) {
+	propagation.TraceContext{}.Inject(ctx, propagation.MapCarrier(headers))
+}
+
+func (TraceContextPropagator) Extract(ctx context.Context, headers map[string]string) context.Context {
+	return propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier(headers))
+}
@@ -0,0 +1,53 @@
+package tracing_test
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/gateway-fm/scriptorium/tracing"
+)
+
+func TestTraceContextPropagator(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	state, _ := trace.ParseTraceState("vendor=value")
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		TraceState: state,
+	})
+
+	headers := make(map[string]string)
+	tracing.TraceContextPropagator{}.Inject(trace.ContextWithSpanContext(context.Background(), sc), headers)
+
+	if got := headers["traceparent"]; got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Fatalf("traceparent %q", got)
+	}
+	if got := headers["tracestate"]; got != "vendor=value" {
+		t.Fatalf("tracestate %q", got)
+	}
+
+	extracted := trace.SpanContextFromContext(tracing.TraceContextPropagator{}.Extract(context.Background(), headers))
+	if extracted.TraceID() != traceID || extracted.SpanID() != spanID || !extracted.IsRemote() {
+		t.Fatalf("extracted span context %+v", extracted)
+	}
+	if extracted.TraceState().Get("vendor") != "value" {
+		t.Fatalf("extracted trace state %q", extracted.TraceState())
+	}
+}
+
+func TestTraceContextPropagatorWithoutSpan(t *testing.T) {
+	headers := make(map[string]string)
+	tracing.TraceContextPropagator{}.Inject(context.Background(), headers)
+	if len(headers) != 0 {
+		t.Fatalf("headers %v injected without a span", headers)
+	}
+
+	ctx := tracing.TraceContextPropagator{}.Extract(context.Background(), map[string]string{"traceparent": "invalid"})
+	if trace.SpanContextFromContext(ctx).IsValid() {
+		t.Fatal("span context extracted from an invalid traceparent")
+	}
+}
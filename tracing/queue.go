@@ -0,0 +1,35 @@
+package tracing
+
+import "context"
+
+// QueueSpan is identical to queue.Span. Both are aliases of the same unnamed interface,
+// which lets QueueTracer satisfy queue.Tracer without this module importing the queue package.
+type QueueSpan = interface {
+	End()
+	RecordError(err error)
+	SetError(description string)
+	SetAttributeInt(k string, v int)
+	SetAttributeString(k string, v string)
+}
+
+// QueueTracer adapts an ITracer to queue.Tracer, e.g. bus.WithTracer(tracing.QueueTracer{Tracer: GetDefaultTracer()}).
+// It is a queue.Propagator as well, so the bus stamps every published event with the W3C trace context
+// of the publisher and the consumer spans continue its trace.
+type QueueTracer struct {
+	TraceContextPropagator
+	Tracer ITracer
+}
+
+func (t QueueTracer) Start(ctx context.Context, spanName string) (context.Context, QueueSpan) {
+	ctx, span := t.Tracer.Start(ctx, spanName)
+	return ctx, queueSpan{ISpan: span}
+}
+
+// queueSpan maps the error status of queue spans to SetStatus.
+type queueSpan struct {
+	ISpan
+}
+
+func (s queueSpan) SetError(description string) {
+	s.SetStatus(Error, description)
+}
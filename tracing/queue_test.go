@@ -0,0 +1,75 @@
+package tracing_test
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/gateway-fm/scriptorium/tracing"
+)
+
+// recordingSpan is an ISpan recording its status.
+type recordingSpan struct {
+	tracing.ISpan
+
+	code        tracing.Code
+	description string
+	ended       bool
+}
+
+func (s *recordingSpan) SetStatus(code tracing.Code, description string) {
+	s.code, s.description = code, description
+}
+
+func (s *recordingSpan) End() {
+	s.ended = true
+}
+
+// recordingTracer is an ITracer starting recordingSpans within a fixed span context.
+type recordingTracer struct {
+	sc    trace.SpanContext
+	names []string
+	spans []*recordingSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, spanName string) (context.Context, tracing.ISpan) {
+	span := &recordingSpan{}
+	t.names = append(t.names, spanName)
+	t.spans = append(t.spans, span)
+	return trace.ContextWithSpanContext(ctx, t.sc), span
+}
+
+func TestQueueTracer(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	tracer := &recordingTracer{sc: trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	})}
+	queueTracer := tracing.QueueTracer{Tracer: tracer}
+
+	ctx, span := queueTracer.Start(context.Background(), "publish topic")
+	span.SetError("failed")
+	span.End()
+
+	if len(tracer.names) != 1 || tracer.names[0] != "publish topic" {
+		t.Fatalf("started spans %v", tracer.names)
+	}
+	if got := tracer.spans[0]; got.code != tracing.Error || got.description != "failed" || !got.ended {
+		t.Fatalf("span status %d %q, ended %t", got.code, got.description, got.ended)
+	}
+
+	// the tracer is the propagator of the bus as well, it stamps the events with the span started on publish
+	headers := make(map[string]string)
+	queueTracer.Inject(ctx, headers)
+	if got := headers["traceparent"]; got != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Fatalf("traceparent %q", got)
+	}
+
+	extracted := trace.SpanContextFromContext(queueTracer.Extract(context.Background(), headers))
+	if extracted.TraceID() != traceID {
+		t.Fatalf("extracted trace %s", extracted.TraceID())
+	}
+}
@@ -0,0 +1,45 @@
+package transactions
+
+import (
+	"context"
+	"sync"
+)
+
+const hooksKey contextKey = "txHooks"
+
+// commitHooks collects callbacks to run once a transaction is committed.
+type commitHooks struct {
+	mu  sync.Mutex
+	fns []func()
+}
+
+// AfterCommit registers fn to be called once the transaction started by Do is committed.
+// fn is dropped if the transaction is rolled back. When ctx is not inside Do, fn is called right away.
+func AfterCommit(ctx context.Context, fn func()) {
+	hooks, ok := ctx.Value(hooksKey).(*commitHooks)
+	if !ok {
+		fn()
+		return
+	}
+
+	hooks.mu.Lock()
+	defer hooks.mu.Unlock()
+
+	hooks.fns = append(hooks.fns, fn)
+}
+
+func withCommitHooks(ctx context.Context) (context.Context, *commitHooks) {
+	hooks := &commitHooks{}
+	return context.WithValue(ctx, hooksKey, hooks), hooks
+}
+
+func (h *commitHooks) run() {
+	h.mu.Lock()
+	fns := h.fns
+	h.fns = nil
+	h.mu.Unlock()
+
+	for _, fn := range fns {
+		fn()
+	}
+}
@@ -20,7 +20,8 @@ func NewPgTransactionManager(trf *PgTransactionFactory, options Options) *PgTran
 	}
 }
 
-// Do function creates Tx for the given tx factory and stores it in the context
+// Do function creates Tx for the given tx factory and stores it in the context.
+// Callbacks registered with AfterCommit run once the Tx is committed.
 func (tm *PgTransactionManager) Do(ctx context.Context, fn func(context.Context) error) error {
 	tx, err := tm.trf.Begin()
 	if err != nil {
@@ -28,6 +29,7 @@ func (tm *PgTransactionManager) Do(ctx context.Context, fn func(context.Context)
 	}
 
 	ctx = context.WithValue(ctx, txKey, tx)
+	ctx, hooks := withCommitHooks(ctx)
 
 	err = fn(ctx)
 
@@ -36,5 +38,11 @@ func (tm *PgTransactionManager) Do(ctx context.Context, fn func(context.Context)
 		return err
 	}
 
-	return tx.Commit()
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	hooks.run()
+
+	return nil
 }
@@ -9,5 +9,13 @@ func NewTrmStub() *TrmStub {
 }
 
 func (t *TrmStub) Do(ctx context.Context, fn func(ctx context.Context) error) error {
-	return fn(ctx)
+	ctx, hooks := withCommitHooks(ctx)
+
+	if err := fn(ctx); err != nil {
+		return err
+	}
+
+	hooks.run()
+
+	return nil
 }